@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/saurabh/protohackers/internal/fakeauthority"
+	"github.com/saurabh/protohackers/internal/logger"
+	"github.com/saurabh/protohackers/internal/pestproto"
+)
+
+var port = flag.String("port", "20547", "Port to listen on")
+var targetsFile = flag.String("targets", "", "JSON file mapping site ids to target populations")
+
+// targetsConfig is the format of the -targets file, e.g.
+//
+//	{"12345": [{"species": "dog", "min": 1, "max": 3}]}
+type targetsConfig map[string][]struct {
+	Species string `json:"species"`
+	Min     uint32 `json:"min"`
+	Max     uint32 `json:"max"`
+}
+
+func loadTargets(path string) (map[uint32][]pestproto.PopulationTarget, error) {
+	targets := make(map[uint32][]pestproto.PopulationTarget)
+	if path == "" {
+		return targets, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg targetsConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+
+	for key, populations := range cfg {
+		site, err := strconv.ParseUint(key, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range populations {
+			targets[uint32(site)] = append(targets[uint32(site)], pestproto.PopulationTarget{
+				Species: p.Species,
+				Min:     p.Min,
+				Max:     p.Max,
+			})
+		}
+	}
+	return targets, nil
+}
+
+func main() {
+	flag.Parse()
+
+	// Setup logging to logs directory
+	logFile, err := logger.Setup("fake-authority")
+	if err != nil {
+		panic(err)
+	}
+	defer logFile.Close()
+
+	targets, err := loadTargets(*targetsFile)
+	if err != nil {
+		log.Fatalln("Failed to load targets:", err)
+	}
+
+	srv := fakeauthority.New(targets)
+	if err := srv.Listen(":" + *port); err != nil {
+		panic(err)
+	}
+
+	log.Printf("Listening on port %s with targets for %d sites", *port, len(targets))
+
+	// Wait for a signal, then report the final policies before shutting down
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	<-sigChan
+
+	log.Println("Shutting down gracefully...")
+	srv.Close()
+
+	for site := range targets {
+		for _, p := range srv.Policies(site) {
+			log.Printf("Site %d: policy %d %s %s", site, p.ID, p.Action, p.Species)
+		}
+	}
+	log.Println("Server stopped")
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"cmp"
+	"crypto/subtle"
+	"encoding/json"
+	"slices"
+	"time"
+)
+
+// topPriorities is how many of the highest ready priorities stats reports
+// for each queue.
+const topPriorities = 5
+
+// defaultPageSize and maxPageSize bound how many jobs list-queue returns.
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// AdminRequest covers the stats, list-queue and peek requests.
+type AdminRequest struct {
+	Request string   `json:"request"`
+	Token   string   `json:"token,omitempty"`
+	Queue   string   `json:"queue,omitempty"`  // list-queue
+	Offset  int      `json:"offset,omitempty"` // list-queue
+	Limit   int      `json:"limit,omitempty"`  // list-queue
+	Queues  []string `json:"queues,omitempty"` // peek
+}
+
+// QueueStats describes one queue for the stats request.
+type QueueStats struct {
+	Ready         int            `json:"ready"`
+	Assigned      int            `json:"assigned"`
+	Delayed       int            `json:"delayed"`
+	OldestAge     float64        `json:"oldest_age"` // seconds since the oldest job was put
+	TopPriorities []uint32       `json:"top_priorities"`
+	Owners        map[uint64]int `json:"owners"` // client id -> jobs it holds
+}
+
+// JobInfo describes one job for the list-queue and peek requests.
+type JobInfo struct {
+	ID         uint64  `json:"id"`
+	Queue      string  `json:"queue"`
+	Pri        uint32  `json:"pri"`
+	State      string  `json:"state"`
+	Age        float64 `json:"age"` // seconds since it was put
+	Owner      uint64  `json:"owner,omitempty"`
+	Deliveries int     `json:"deliveries"`
+	Job        any     `json:"job"`
+}
+
+func jobInfo(job *JobItem, now time.Time) JobInfo {
+	info := JobInfo{
+		ID:         job.id,
+		Queue:      job.queue,
+		Pri:        job.pri,
+		State:      job.state,
+		Age:        now.Sub(job.created).Seconds(),
+		Deliveries: job.deliveries,
+		Job:        job.job,
+	}
+	if job.owner != nil {
+		info.Owner = job.owner.id
+	}
+	return info
+}
+
+// Stats describes every queue that holds a job.
+func (js *JobServer) Stats(now time.Time) map[string]QueueStats {
+	defer js.observe("stats", time.Now())
+
+	stats := make(map[string]QueueStats)
+	for _, s := range js.shards {
+		s.mu.Lock()
+		byQueue := make(map[string][]*JobItem)
+		for _, job := range s.jobs {
+			byQueue[job.queue] = append(byQueue[job.queue], job)
+		}
+		for name, jobs := range byQueue {
+			stats[name] = queueStats(jobs, now)
+		}
+		s.mu.Unlock()
+	}
+	return stats
+}
+
+// queueStats describes the jobs in a queue. Called with its shard locked.
+func queueStats(jobs []*JobItem, now time.Time) QueueStats {
+	qs := QueueStats{TopPriorities: []uint32{}, Owners: map[uint64]int{}}
+	oldest := now
+	for _, job := range jobs {
+		switch job.state {
+		case "ready":
+			qs.Ready++
+			qs.TopPriorities = append(qs.TopPriorities, job.pri)
+		case "assigned":
+			qs.Assigned++
+			qs.Owners[job.owner.id]++
+		case "delayed":
+			qs.Delayed++
+		}
+		if job.created.Before(oldest) {
+			oldest = job.created
+		}
+	}
+	slices.SortFunc(qs.TopPriorities, func(a, b uint32) int { return cmp.Compare(b, a) })
+	qs.TopPriorities = qs.TopPriorities[:min(len(qs.TopPriorities), topPriorities)]
+	qs.OldestAge = now.Sub(oldest).Seconds()
+	return qs
+}
+
+// ListQueue returns up to limit of the jobs in queue, highest priority first,
+// skipping the first offset, and how many jobs the queue holds.
+func (js *JobServer) ListQueue(queue string, offset, limit int, now time.Time) ([]JobInfo, int) {
+	defer js.observe("list-queue", time.Now())
+	s := js.shardOf(queue)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	jobs := s.jobsIn(queue)
+	slices.SortFunc(jobs, func(a, b *JobItem) int {
+		switch {
+		case a.before(b):
+			return -1
+		case b.before(a):
+			return 1
+		}
+		return 0
+	})
+
+	offset = min(max(offset, 0), len(jobs))
+	page := jobs[offset:min(offset+limit, len(jobs))]
+	infos := make([]JobInfo, len(page))
+	for i, job := range page {
+		infos[i] = jobInfo(job, now)
+	}
+	return infos, len(jobs)
+}
+
+// Peek returns the job a get on queues would be given now, without
+// assigning it.
+func (js *JobServer) Peek(queues []string, now time.Time) (JobInfo, error) {
+	defer js.observe("peek", time.Now())
+	unlock := js.lock(queues...)
+	defer unlock()
+
+	job := js.best(queues, nil)
+	if job == nil {
+		return JobInfo{}, errNoJob
+	}
+	return jobInfo(job, now), nil
+}
+
+// handleAdmin answers an admin request.
+func handleAdmin(js *JobServer, raw json.RawMessage) map[string]any {
+	var req AdminRequest
+	if err := json.Unmarshal(raw, &req); err != nil {
+		return map[string]any{"status": "error", "error": "Unmarshal error: " + err.Error()}
+	}
+	if subtle.ConstantTimeCompare([]byte(req.Token), []byte(js.adminToken)) != 1 {
+		return map[string]any{"status": "error", "error": "Unauthorised."}
+	}
+
+	now := time.Now()
+	switch req.Request {
+	case "stats":
+		stats := js.Stats(now)
+		jobs := 0
+		for _, qs := range stats {
+			jobs += qs.Ready + qs.Assigned + qs.Delayed
+		}
+		js.clientsMu.Lock()
+		clients := len(js.clients)
+		js.clientsMu.Unlock()
+		return map[string]any{"status": "ok", "clients": clients, "jobs": jobs, "queues": stats}
+
+	case "list-queue":
+		limit := req.Limit
+		if limit <= 0 {
+			limit = defaultPageSize
+		}
+		limit = min(limit, maxPageSize)
+		jobs, total := js.ListQueue(req.Queue, req.Offset, limit, now)
+		response := map[string]any{"status": "ok", "queue": req.Queue, "total": total, "jobs": jobs}
+		if next := max(req.Offset, 0) + len(jobs); next < total {
+			response["next"] = next
+		}
+		return response
+
+	default: // peek
+		job, err := js.Peek(req.Queues, now)
+		if err != nil {
+			return map[string]any{"status": "no-job"}
+		}
+		return map[string]any{"status": "ok", "job": job}
+	}
+}
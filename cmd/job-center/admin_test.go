@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	js := NewJobServer(nil, testShards)
+	alice, bob := js.Connect(nil), js.Connect(nil)
+	start := time.Now()
+
+	for pri := range uint32(7) {
+		mustPutJob(t, js, "q", "job", pri)
+	}
+	mustPutDelayed(t, js, "q", 100, start.Add(time.Hour))
+	mustPutJob(t, js, "other", "job", 1)
+	mustGetJob(t, js, alice, "q")
+	mustGetJob(t, js, alice, "q")
+	mustGetJob(t, js, bob, "q")
+
+	stats := js.Stats(start.Add(time.Minute))
+	q := stats["q"]
+	if q.Ready != 4 || q.Assigned != 3 || q.Delayed != 1 {
+		t.Errorf("q has %d ready, %d assigned, %d delayed, want 4, 3, 1", q.Ready, q.Assigned, q.Delayed)
+	}
+	if want := []uint32{3, 2, 1, 0}; !reflect.DeepEqual(q.TopPriorities, want) {
+		t.Errorf("q top priorities = %v, want %v", q.TopPriorities, want)
+	}
+	if want := map[uint64]int{alice.id: 2, bob.id: 1}; !reflect.DeepEqual(q.Owners, want) {
+		t.Errorf("q owners = %v, want %v", q.Owners, want)
+	}
+	if q.OldestAge < 59 || q.OldestAge > 60 {
+		t.Errorf("q oldest age = %v, want about 60s", q.OldestAge)
+	}
+	if len(stats) != 2 {
+		t.Errorf("stats for %d queues, want 2", len(stats))
+	}
+
+	// At most topPriorities are reported
+	for pri := range uint32(10) {
+		mustPutJob(t, js, "many", "job", pri)
+	}
+	if got, want := js.Stats(start)["many"].TopPriorities, []uint32{9, 8, 7, 6, 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("many top priorities = %v, want %v", got, want)
+	}
+}
+
+func TestListQueuePages(t *testing.T) {
+	js := NewJobServer(nil, testShards)
+	c := js.Connect(nil)
+	var want []uint64
+	for pri := range uint32(5) {
+		want = append([]uint64{mustPutJob(t, js, "q", "job", pri)}, want...)
+	}
+	mustGetJob(t, js, c, "q")
+
+	var got []uint64
+	for offset := 0; offset < 6; offset += 2 {
+		jobs, total := js.ListQueue("q", offset, 2, time.Now())
+		if total != 5 {
+			t.Errorf("ListQueue(offset %d) total = %d, want 5", offset, total)
+		}
+		for _, job := range jobs {
+			got = append(got, job.ID)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("listed jobs %v, want %v", got, want)
+	}
+
+	// Assigned jobs are listed too, with their owner
+	jobs, _ := js.ListQueue("q", 0, 1, time.Now())
+	if jobs[0].State != "assigned" || jobs[0].Owner != c.id {
+		t.Errorf("first job = %+v, want assigned to client %d", jobs[0], c.id)
+	}
+	if jobs, total := js.ListQueue("missing", 0, 10, time.Now()); len(jobs) != 0 || total != 0 {
+		t.Errorf("ListQueue(missing) = %v, %d, want nothing", jobs, total)
+	}
+}
+
+func TestPeekDoesNotAssign(t *testing.T) {
+	js := NewJobServer(nil, testShards)
+	c := js.Connect(nil)
+	mustPutJob(t, js, "a", "job", 1)
+	id := mustPutJob(t, js, "b", "job", 2)
+
+	job, err := js.Peek([]string{"a", "b"}, time.Now())
+	if err != nil || job.ID != id {
+		t.Errorf("Peek = %+v, %v, want job %d", job, err, id)
+	}
+	if got := mustGetJob(t, js, c, "a", "b"); got != id {
+		t.Errorf("get after peek = job %d, want %d", got, id)
+	}
+	if _, err := js.Peek([]string{"b"}, time.Now()); err != errNoJob {
+		t.Errorf("Peek(b) = %v, want %v", err, errNoJob)
+	}
+}
+
+func TestAdminRequests(t *testing.T) {
+	js := NewJobServer(nil, testShards)
+	conn, _ := serve(t, js)
+	r := bufio.NewReader(conn)
+	for pri := range 3 {
+		fmt.Fprintf(conn, `{"request":"put","queue":"q","job":%d,"pri":%d}`+"\n", pri, pri)
+		expectResponses(t, r, map[string]any{"status": "ok", "id": float64(pri + 1)})
+	}
+
+	conn.Write([]byte(`{"request":"peek","queues":["q"]}` + "\n" +
+		`{"request":"peek","queues":["empty"]}` + "\n"))
+	peek := readResponse(t, r)
+	if job, _ := peek["job"].(map[string]any); job["id"] != 3.0 || job["job"] != 2.0 {
+		t.Errorf("peek = %v, want job 3", peek)
+	}
+	expectResponses(t, r, map[string]any{"status": "no-job"})
+
+	conn.Write([]byte(`{"request":"list-queue","queue":"q","limit":2}` + "\n"))
+	list := readResponse(t, r)
+	if list["status"] != "ok" || list["total"] != 3.0 || list["next"] != 2.0 || len(list["jobs"].([]any)) != 2 {
+		t.Errorf("list-queue = %v, want the first 2 of 3 jobs", list)
+	}
+	conn.Write([]byte(`{"request":"list-queue","queue":"q","offset":2,"limit":2}` + "\n"))
+	if list := readResponse(t, r); list["next"] != nil || len(list["jobs"].([]any)) != 1 {
+		t.Errorf("last page = %v, want 1 job and no next", list)
+	}
+
+	conn.Write([]byte(`{"request":"stats"}` + "\n"))
+	stats := readResponse(t, r)
+	q, _ := stats["queues"].(map[string]any)["q"].(map[string]any)
+	if stats["clients"] != 1.0 || stats["jobs"] != 3.0 || q["ready"] != 3.0 {
+		t.Errorf("stats = %v, want 1 client and 3 ready jobs in q", stats)
+	}
+}
+
+func TestAdminToken(t *testing.T) {
+	js := NewJobServer(nil, testShards)
+	js.adminToken = "secret"
+	conn, _ := serve(t, js)
+	conn.Write([]byte(`{"request":"stats"}` + "\n" +
+		`{"request":"peek","queues":["q"],"token":"guess"}` + "\n" +
+		`{"request":"peek","queues":["q"],"token":"secret"}` + "\n"))
+	expectResponses(t, bufio.NewReader(conn),
+		map[string]any{"status": "error", "error": "Unauthorised."},
+		map[string]any{"status": "error", "error": "Unauthorised."},
+		map[string]any{"status": "no-job"},
+	)
+}
+
+func readResponse(t *testing.T, r *bufio.Reader) map[string]any {
+	t.Helper()
+
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		t.Fatalf("reading response: %v", err)
+	}
+	var response map[string]any
+	if err := json.Unmarshal(line, &response); err != nil {
+		t.Fatalf("bad response %q: %v", line, err)
+	}
+	return response
+}
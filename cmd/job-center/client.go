@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"slices"
+	"sync"
+)
+
+var errDisconnected = errors.New("client disconnected")
+
+// Client is the session of one connection. It owns the jobs assigned to it,
+// keeps count of what it has done, and tracks the gets it is blocked in.
+// Its context is cancelled when the connection goes away, which cancels
+// those gets. Its other fields are guarded by mu, which is taken after any
+// shard locks.
+type Client struct {
+	id      uint64
+	addr    net.Addr
+	ctx     context.Context
+	cancel  context.CancelFunc
+	mu      sync.Mutex
+	held    map[uint64]*JobItem
+	waiting map[*waiter]struct{}
+	stats   ClientStats
+	gone    bool // disconnected, so it can't be assigned jobs
+}
+
+// ClientStats counts the requests a client has made that did something.
+type ClientStats struct {
+	Puts    int // jobs put
+	Gets    int // jobs assigned
+	Aborts  int // jobs given back, including on disconnect
+	Deletes int // jobs deleted
+	Expired int // leases that ran out
+}
+
+func (c *Client) String() string {
+	return fmt.Sprintf("client %d (%v)", c.id, c.addr)
+}
+
+// Connect starts a session for a client connecting from addr.
+func (js *JobServer) Connect(addr net.Addr) *Client {
+	js.clientsMu.Lock()
+	defer js.clientsMu.Unlock()
+
+	js.lastClient++
+	c := &Client{
+		id:      js.lastClient,
+		addr:    addr,
+		held:    make(map[uint64]*JobItem),
+		waiting: make(map[*waiter]struct{}),
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	js.clients[c.id] = c
+	return c
+}
+
+// Hangup is called when a client stops sending requests. Its blocked gets
+// are cancelled, and any it makes from now on fail rather than block, but the
+// requests it has already sent can still be handled.
+func (c *Client) Hangup() {
+	c.cancel()
+}
+
+// Disconnect ends a client's session, hanging it up and putting the jobs it
+// holds back in their queues. It's safe to call more than once.
+func (js *JobServer) Disconnect(c *Client) {
+	js.clientsMu.Lock()
+	_, connected := js.clients[c.id]
+	delete(js.clients, c.id)
+	js.clientsMu.Unlock()
+	if !connected {
+		return
+	}
+	c.cancel()
+
+	c.mu.Lock()
+	c.gone = true
+	held := slices.Collect(maps.Keys(c.held))
+	c.mu.Unlock()
+
+	for _, id := range held {
+		job, unlock := js.lockJob(id, js.deadLetterQueues()...)
+		// Unless it was given back or deleted meanwhile
+		if job != nil && job.owner == c {
+			// Jobs come back ready after a restart anyway, so a journal
+			// failure is no reason to leave them with a client that has gone
+			js.record(journalOp{Op: "abort", ID: job.id})
+			js.requeue(job)
+			c.mu.Lock()
+			c.stats.Aborts++
+			c.mu.Unlock()
+			js.totals.aborts.Add(1)
+		}
+		unlock()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	log.Printf("Disconnected %v after %d puts, %d gets, %d aborts, %d deletes, %d expired",
+		c, c.stats.Puts, c.stats.Gets, c.stats.Aborts, c.stats.Deletes, c.stats.Expired)
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/saurabh/protohackers/internal/recordlog"
+)
+
+const snapshotFile = "snapshot.json"
+
+var errJournalClosed = errors.New("journal closed")
+
+// journalOp is one operation in the write-ahead log. Put carries the whole
+// job; the others only name it.
+type journalOp struct {
+	Seq   uint64 `json:"seq"`
+	Op    string `json:"op"` // put, get, abort, dead or delete
+	ID    uint64 `json:"id"`
+	Queue string `json:"queue,omitempty"`
+	Pri   uint32 `json:"pri,omitempty"`
+	Job   any    `json:"job"`
+
+	NotBefore time.Time `json:"not_before,omitzero"`
+	Created   time.Time `json:"created,omitzero"`
+}
+
+// journalJob is a job as saved in a snapshot.
+type journalJob struct {
+	ID         uint64 `json:"id"`
+	Queue      string `json:"queue"`
+	Pri        uint32 `json:"pri"`
+	Job        any    `json:"job"`
+	Deliveries int    `json:"deliveries,omitempty"`
+
+	NotBefore time.Time `json:"not_before,omitzero"`
+	Created   time.Time `json:"created,omitzero"`
+}
+
+// snapshot holds every job as of operation Seq, and the last id handed out
+// so ids stay monotonic even if the newest jobs were deleted.
+type snapshot struct {
+	Seq    uint64       `json:"seq"`
+	LastID uint64       `json:"last_id"`
+	Jobs   []journalJob `json:"jobs"`
+}
+
+// Journal persists a JobServer as a snapshot plus a write-ahead log of the
+// operations since, split into segments named by their first sequence number:
+//
+//	<dir>/snapshot.json
+//	<dir>/wal-<seq>.log
+//
+// Operations are written to the log before they are applied, and fsynced by
+// Sync, so a killed process loses nothing and a machine crash loses at most
+// what was written since the last Sync. Taking a snapshot starts a new
+// segment, and the older ones are removed once the snapshot is safely on
+// disk. Replay skips operations the snapshot already holds, so a crash
+// between the two steps is harmless.
+type Journal struct {
+	dir      string
+	wal      *recordlog.Log
+	seq      uint64   // last sequence number written
+	segments []string // oldest first; the last is wal
+	mu       sync.Mutex
+
+	// Recovered state, consumed by NewJobServer
+	lastID uint64
+	jobs   []journalJob
+}
+
+// OpenJournal loads the snapshot in dir and replays the log over it.
+//
+// Connections do not survive a restart, so every job comes back ready no
+// matter who held it before.
+func OpenJournal(dir string) (*Journal, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create journal directory: %w", err)
+	}
+
+	var snap snapshot
+	data, err := os.ReadFile(filepath.Join(dir, snapshotFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &snap); err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %w", snapshotFile, err)
+		}
+	}
+
+	jobs := make(map[uint64]*journalJob, len(snap.Jobs))
+	for i := range snap.Jobs {
+		jobs[snap.Jobs[i].ID] = &snap.Jobs[i]
+	}
+	j := &Journal{dir: dir, seq: snap.Seq, lastID: snap.LastID}
+
+	segments, err := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(segments, func(a, b int) bool { return segmentSeq(segments[a]) < segmentSeq(segments[b]) })
+	apply := func(payload []byte) error {
+		var op journalOp
+		if err := json.Unmarshal(payload, &op); err != nil {
+			return err
+		}
+		j.seq = max(j.seq, op.Seq)
+		if op.Seq <= snap.Seq {
+			return nil
+		}
+		job := jobs[op.ID]
+		switch op.Op {
+		case "put":
+			jobs[op.ID] = &journalJob{ID: op.ID, Queue: op.Queue, Pri: op.Pri, Job: op.Job, NotBefore: op.NotBefore, Created: op.Created}
+			j.lastID = max(j.lastID, op.ID)
+		case "get":
+			if job != nil {
+				job.Deliveries++
+			}
+		case "dead":
+			if job != nil {
+				job.Queue = op.Queue
+				job.Deliveries = 0
+			}
+		case "delete":
+			delete(jobs, op.ID)
+		}
+		return nil
+	}
+	for i, path := range segments {
+		j.segments = append(j.segments, path)
+		if i < len(segments)-1 {
+			// Only the newest segment can have been cut short by a crash; a
+			// gap in an older one would lose the operations in it
+			if err := recordlog.Replay(path, apply); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		j.wal, err = recordlog.Open(path, apply)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if j.wal == nil {
+		if err := j.startSegment(); err != nil {
+			return nil, err
+		}
+	}
+
+	j.jobs = make([]journalJob, 0, len(jobs))
+	for _, job := range jobs {
+		j.jobs = append(j.jobs, *job)
+	}
+	sort.Slice(j.jobs, func(a, b int) bool { return j.jobs[a].ID < j.jobs[b].ID })
+	return j, nil
+}
+
+// segmentSeq returns the first sequence number in a log segment.
+func segmentSeq(path string) uint64 {
+	name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "wal-"), ".log")
+	seq, _ := strconv.ParseUint(name, 10, 64)
+	return seq
+}
+
+// startSegment opens a new log segment for the operations after j.seq.
+func (j *Journal) startSegment() error {
+	path := filepath.Join(j.dir, fmt.Sprintf("wal-%020d.log", j.seq+1))
+	wal, err := recordlog.Open(path, func([]byte) error { return nil })
+	if err != nil {
+		return err
+	}
+	if err := recordlog.SyncDir(j.dir); err != nil {
+		wal.Close()
+		return err
+	}
+	j.wal = wal
+	j.segments = append(j.segments, path)
+	return nil
+}
+
+// Record writes op to the log, giving it the next sequence number. It fails
+// once the journal is closed.
+func (j *Journal) Record(op journalOp) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.wal == nil {
+		return errJournalClosed
+	}
+	op.Seq = j.seq + 1
+	payload, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+	if err := j.wal.Write(payload); err != nil {
+		return err
+	}
+	j.seq = op.Seq
+	return nil
+}
+
+// Sync makes every recorded operation durable.
+func (j *Journal) Sync() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.wal == nil {
+		return errJournalClosed
+	}
+	return j.wal.Sync()
+}
+
+// rotate starts a new log segment and returns the last sequence number
+// recorded before it, along with the segments that held them.
+func (j *Journal) rotate() (uint64, []string, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.wal == nil {
+		return 0, nil, errJournalClosed
+	}
+	// Nothing has been recorded since the current segment began
+	if j.wal.Size() == 0 {
+		n := len(j.segments) - 1
+		old := j.segments[:n:n]
+		j.segments = j.segments[n:]
+		return j.seq, old, nil
+	}
+
+	if err := j.wal.Sync(); err != nil {
+		return 0, nil, err
+	}
+	prev, old := j.wal, j.segments
+	j.segments = nil
+	if err := j.startSegment(); err != nil {
+		j.segments = old
+		return 0, nil, err
+	}
+	prev.Close()
+	return j.seq, old, nil
+}
+
+// saveSnapshot writes snap to disk and then removes the log segments whose
+// operations it covers. If it fails they are kept for the next snapshot.
+func (j *Journal) saveSnapshot(snap snapshot, covered []string) (err error) {
+	defer func() {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		if err != nil {
+			j.segments = append(covered, j.segments...)
+			return
+		}
+		for _, path := range covered {
+			if err := os.Remove(path); err != nil {
+				log.Println("Failed to remove log segment:", err)
+			}
+		}
+	}()
+
+	f, err := os.CreateTemp(j.dir, ".tmp-snapshot-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	w := bufio.NewWriter(f)
+	err = json.NewEncoder(w).Encode(snap)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), filepath.Join(j.dir, snapshotFile)); err != nil {
+		return err
+	}
+	return recordlog.SyncDir(j.dir)
+}
+
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.wal == nil {
+		return nil
+	}
+	err := errors.Join(j.wal.Sync(), j.wal.Close())
+	j.wal = nil
+	return err
+}
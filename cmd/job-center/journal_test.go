@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/saurabh/protohackers/internal/recordlog"
+)
+
+func TestJournalReplaysOperations(t *testing.T) {
+	dir := t.TempDir()
+	js, journal := openJobServer(t, dir)
+	conn := js.Connect(nil)
+
+	a := mustPutJob(t, js, "q1", map[string]any{"title": "a"}, 10)
+	b := mustPutJob(t, js, "q1", 0.0, 20)
+	c := mustPutJob(t, js, "q2", "c", 5)
+	d := mustPutJob(t, js, "q2", nil, 1)
+	if job, _, err := js.Get([]string{"q1"}, GetOptions{}, conn); err != nil || job.id != b {
+		t.Fatalf("Get = %v, %v, want job %d", job, err, b)
+	}
+	if err := js.Delete(c, conn); err != nil {
+		t.Fatal(err)
+	}
+	e := mustPutJob(t, js, "q2", "e", 1)
+	if err := js.Delete(e, conn); err != nil {
+		t.Fatal(err)
+	}
+	journal.Close()
+
+	// The assigned job is back and ready, and deleted ids are not reused
+	js, _ = openJobServer(t, dir)
+	conn = js.Connect(nil)
+	want := map[string][]uint64{"q1": {a, b}, "q2": {d}}
+	if got := readyJobs(js); !reflect.DeepEqual(got, want) {
+		t.Errorf("recovered %v, want %v", got, want)
+	}
+	job, queue, err := js.Get([]string{"q1", "q2"}, GetOptions{}, conn)
+	if err != nil || job.id != b || queue != "q1" || job.job != 0.0 || job.pri != 20 {
+		t.Errorf("Get after restart = %+v in %s, %v, want job %d", job, queue, err, b)
+	}
+	if id := mustPutJob(t, js, "q1", "f", 1); id != e+1 {
+		t.Errorf("Put after restart got id %d, want %d", id, e+1)
+	}
+}
+
+func TestJournalSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	js, journal := openJobServer(t, dir)
+	conn := js.Connect(nil)
+
+	a := mustPutJob(t, js, "q", "a", 1)
+	b := mustPutJob(t, js, "q", "b", 2)
+	if err := js.Delete(a, conn); err != nil {
+		t.Fatal(err)
+	}
+	if err := js.Snapshot(); err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	// Nothing new to log, so this keeps the same segment
+	if err := js.Snapshot(); err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	c := mustPutJob(t, js, "q", "c", 3)
+	if err := js.Delete(b, conn); err != nil {
+		t.Fatal(err)
+	}
+	journal.Close()
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+	if len(segments) != 1 {
+		t.Errorf("journal has segments %v, want 1", segments)
+	}
+
+	js, journal = openJobServer(t, dir)
+	if got, want := readyJobs(js), map[string][]uint64{"q": {c}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("recovered %v, want %v", got, want)
+	}
+
+	// A snapshot of an empty server still keeps the last id
+	if err := js.Delete(c, conn); err != nil {
+		t.Fatal(err)
+	}
+	if err := js.Snapshot(); err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	journal.Close()
+	js, _ = openJobServer(t, dir)
+	if id := mustPutJob(t, js, "q", "d", 1); id != c+1 {
+		t.Errorf("Put after restart got id %d, want %d", id, c+1)
+	}
+}
+
+func TestJournalSurvivesCrashDuringSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	js, journal := openJobServer(t, dir)
+	conn := js.Connect(nil)
+
+	a := mustPutJob(t, js, "q", "a", 1)
+	b := mustPutJob(t, js, "q", "b", 2)
+	if err := js.Delete(a, conn); err != nil {
+		t.Fatal(err)
+	}
+	segments, _ := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+	saved, err := os.ReadFile(segments[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := js.Snapshot(); err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	journal.Close()
+
+	// The old segment is back as if the crash came before its removal, so
+	// replay has to skip what the snapshot already holds
+	if err := os.WriteFile(segments[0], saved, 0644); err != nil {
+		t.Fatal(err)
+	}
+	js, _ = openJobServer(t, dir)
+	if got, want := readyJobs(js), map[string][]uint64{"q": {b}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("recovered %v, want %v", got, want)
+	}
+}
+
+func TestJournalDropsTornOperation(t *testing.T) {
+	dir := t.TempDir()
+	js, journal := openJobServer(t, dir)
+
+	a := mustPutJob(t, js, "q", "a", 1)
+	segments, _ := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+	before, err := os.Stat(segments[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustPutJob(t, js, "q", "b", 2)
+	journal.Close()
+
+	if err := os.Truncate(segments[0], before.Size()+5); err != nil {
+		t.Fatal(err)
+	}
+	js, _ = openJobServer(t, dir)
+	if got, want := readyJobs(js), map[string][]uint64{"q": {a}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("recovered %v, want %v", got, want)
+	}
+	if id := mustPutJob(t, js, "q", "c", 1); id != a+1 {
+		t.Errorf("Put after restart got id %d, want %d", id, a+1)
+	}
+}
+
+func TestJournalRefusesTornOlderSegment(t *testing.T) {
+	dir := t.TempDir()
+	js, journal := openJobServer(t, dir)
+
+	mustPutJob(t, js, "q", "a", 1)
+	mustPutJob(t, js, "q", "b", 2)
+	segments, _ := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+	saved, err := os.ReadFile(segments[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := js.Snapshot(); err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	mustPutJob(t, js, "q", "c", 1)
+	journal.Close()
+
+	// Only the newest segment is appended to, so only it can be torn
+	if err := os.WriteFile(segments[0], saved[:len(saved)-5], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenJournal(dir); !errors.Is(err, recordlog.ErrCorrupt) {
+		t.Errorf("OpenJournal = %v, want %v", err, recordlog.ErrCorrupt)
+	}
+}
+
+func TestJournalClosed(t *testing.T) {
+	js, journal := openJobServer(t, t.TempDir())
+	journal.Close()
+
+	if _, err := js.Put("q", "job", 1, time.Time{}, js.Connect(nil)); !errors.Is(err, errJournalClosed) {
+		t.Errorf("Put after Close = %v, want %v", err, errJournalClosed)
+	}
+	if err := js.Snapshot(); !errors.Is(err, errJournalClosed) {
+		t.Errorf("Snapshot after Close = %v, want %v", err, errJournalClosed)
+	}
+	if err := journal.Sync(); !errors.Is(err, errJournalClosed) {
+		t.Errorf("Sync after Close = %v, want %v", err, errJournalClosed)
+	}
+}
+
+func TestConcurrentSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	js, journal := openJobServer(t, dir)
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Go(func() {
+			for range 20 {
+				mustPutJob(t, js, "q", "job", 1)
+				if err := js.Snapshot(); err != nil {
+					t.Errorf("Snapshot: %v", err)
+				}
+			}
+		})
+	}
+	wg.Wait()
+	journal.Close()
+
+	js, _ = openJobServer(t, dir)
+	if got := len(readyJobs(js)["q"]); got != 160 {
+		t.Errorf("recovered %d jobs, want 160", got)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"log"
+	"slices"
+	"time"
+)
+
+// leaseQueue is a min heap of leased jobs by expiry, so the reaper only
+// looks at the ones that have run out.
+type leaseQueue []*JobItem
+
+func (lq leaseQueue) Len() int {
+	return len(lq)
+}
+
+func (lq leaseQueue) Less(i int, j int) bool {
+	return lq[i].expires.Before(lq[j].expires)
+}
+
+func (lq leaseQueue) Swap(i int, j int) {
+	lq[i], lq[j] = lq[j], lq[i]
+	lq[i].leaseIndex = i
+	lq[j].leaseIndex = j
+}
+
+func (lq *leaseQueue) Push(x any) {
+	item := x.(*JobItem)
+	item.leaseIndex = len(*lq)
+	*lq = append(*lq, item)
+}
+
+func (lq *leaseQueue) Pop() any {
+	old := *lq
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	item.leaseIndex = -1
+	*lq = old[0 : n-1]
+	return item
+}
+
+// lease gives an assigned job until now+d to be deleted or renewed. A zero
+// d leaves it assigned for as long as its owner is connected. s is the
+// job's shard, which must be locked.
+func (js *JobServer) lease(s *shard, job *JobItem, d time.Duration, now time.Time) {
+	if d <= 0 {
+		return
+	}
+	job.lease = d
+	job.expires = now.Add(d)
+	if job.leaseIndex >= 0 {
+		heap.Fix(&s.leases, job.leaseIndex)
+	} else {
+		heap.Push(&s.leases, job)
+	}
+}
+
+// unlease drops a job's lease, if it has one.
+func (js *JobServer) unlease(s *shard, job *JobItem) {
+	if job.leaseIndex >= 0 {
+		heap.Remove(&s.leases, job.leaseIndex)
+	}
+	job.lease = 0
+	job.expires = time.Time{}
+}
+
+// Heartbeat renews the lease on a job held by c for another d, or for as long
+// as it was last leased for if d is zero.
+func (js *JobServer) Heartbeat(id uint64, d time.Duration, c *Client) error {
+	defer js.observe("heartbeat", time.Now())
+	job, unlock := js.lockJob(id)
+	defer unlock()
+
+	if job == nil || job.owner != c {
+		return errNoJob
+	}
+	if d <= 0 {
+		d = job.lease
+	}
+	js.lease(js.shardOf(job.queue), job, d, time.Now())
+	return nil
+}
+
+// expire requeues every job whose lease ran out by now, returning how many.
+func (js *JobServer) expire(now time.Time) int {
+	n := 0
+	for _, s := range js.shards {
+		// Requeueing may move a job to the dead letter queue's shard, which
+		// can't be locked while this one is, so note which have expired and
+		// lock them one by one after
+		s.mu.Lock()
+		var expired []*JobItem
+		for next := []int{0}; len(next) > 0; {
+			i := next[len(next)-1]
+			next = next[:len(next)-1]
+			if i < len(s.leases) && !s.leases[i].expires.After(now) {
+				expired = append(expired, s.leases[i])
+				next = append(next, 2*i+1, 2*i+2)
+			}
+		}
+		slices.SortFunc(expired, func(a, b *JobItem) int { return a.expires.Compare(b.expires) })
+		ids := make([]uint64, len(expired))
+		for i, job := range expired {
+			ids[i] = job.id
+		}
+		s.mu.Unlock()
+
+		for _, id := range ids {
+			job, unlock := js.lockJob(id, js.deadLetterQueues()...)
+			// Unless it was given back, deleted or renewed meanwhile
+			if job != nil && job.leaseIndex >= 0 && !job.expires.After(now) {
+				owner := job.owner
+				log.Println("Lease on job", job.id, "held by", owner, "expired")
+				// As on disconnect, the job would come back ready after a
+				// restart anyway, so a journal failure doesn't keep it assigned
+				js.record(journalOp{Op: "abort", ID: job.id})
+				js.requeue(job)
+				owner.mu.Lock()
+				owner.stats.Expired++
+				owner.mu.Unlock()
+				js.totals.expired.Add(1)
+				n++
+			}
+			unlock()
+		}
+	}
+	return n
+}
+
+// Reap requeues jobs whose leases have expired, checking every interval
+// until ctx is done.
+func (js *JobServer) Reap(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			js.expire(now)
+		}
+	}
+}
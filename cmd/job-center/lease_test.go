@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExpiredLeaseRequeuesJob(t *testing.T) {
+	js := NewJobServer(nil, testShards)
+	alice := js.Connect(nil)
+
+	id := mustPutJob(t, js, "q", "job", 1)
+	start := time.Now()
+	if _, _, err := js.Get([]string{"q"}, GetOptions{Lease: time.Second}, alice); err != nil {
+		t.Fatal(err)
+	}
+	if n := js.expire(start); n != 0 {
+		t.Errorf("expire before the lease ran out requeued %d jobs", n)
+	}
+	if n := js.expire(start.Add(2 * time.Second)); n != 1 {
+		t.Errorf("expire after the lease ran out requeued %d jobs, want 1", n)
+	}
+
+	if got, want := readyJobs(js), map[string][]uint64{"q": {id}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ready jobs %v, want %v", got, want)
+	}
+	if err := js.Heartbeat(id, 0, alice); err != errNoJob {
+		t.Errorf("Heartbeat after expiry = %v, want %v", err, errNoJob)
+	}
+	if err := js.Abort(id, alice); err != errNoJob {
+		t.Errorf("Abort after expiry = %v, want %v", err, errNoJob)
+	}
+	if leases := sumShards(js, func(s *shard) int { return len(s.leases) }); alice.stats.Expired != 1 || leases != 0 {
+		t.Errorf("%d expired for alice and %d leases left, want 1 and 0", alice.stats.Expired, leases)
+	}
+}
+
+func TestHeartbeatExtendsLease(t *testing.T) {
+	js := NewJobServer(nil, testShards)
+	alice, bob := js.Connect(nil), js.Connect(nil)
+
+	id := mustPutJob(t, js, "q", "job", 1)
+	if _, _, err := js.Get([]string{"q"}, GetOptions{Lease: time.Second}, alice); err != nil {
+		t.Fatal(err)
+	}
+	if err := js.Heartbeat(id, 0, bob); err != errNoJob {
+		t.Errorf("Heartbeat by another client = %v, want %v", err, errNoJob)
+	}
+
+	start := time.Now()
+	if err := js.Heartbeat(id, 5*time.Second, alice); err != nil {
+		t.Fatal(err)
+	}
+	if n := js.expire(start.Add(2 * time.Second)); n != 0 {
+		t.Errorf("expire within the extended lease requeued %d jobs", n)
+	}
+	// With no duration the lease is renewed for as long again
+	if err := js.Heartbeat(id, 0, alice); err != nil {
+		t.Fatal(err)
+	}
+	if n := js.expire(start.Add(4 * time.Second)); n != 0 {
+		t.Errorf("expire within the renewed lease requeued %d jobs", n)
+	}
+	if n := js.expire(time.Now().Add(6 * time.Second)); n != 1 {
+		t.Errorf("expire after the renewed lease requeued %d jobs, want 1", n)
+	}
+
+	// Deleting a leased job drops its lease
+	mustGetJob(t, js, alice, "q")
+	js.Heartbeat(id, time.Second, alice)
+	if err := js.Delete(id, alice); err != nil {
+		t.Fatal(err)
+	}
+	if leases := sumShards(js, func(s *shard) int { return len(s.leases) }); leases != 0 {
+		t.Errorf("%d leases left after delete", leases)
+	}
+}
+
+func TestDeadLetterAfterMaxDeliveries(t *testing.T) {
+	dir := t.TempDir()
+	js, journal := openJobServer(t, dir)
+	js.maxDeliveries, js.deadLetter = 3, "dlq"
+	alice := js.Connect(nil)
+
+	a := mustPutJob(t, js, "q", "a", 1)
+	b := mustPutJob(t, js, "q", "b", 2)
+
+	// b fails by abort, lease expiry and disconnect
+	mustGetJob(t, js, alice, "q")
+	js.Abort(b, alice)
+	js.Get([]string{"q"}, GetOptions{Lease: time.Millisecond}, alice)
+	js.expire(time.Now().Add(time.Second))
+	mustGetJob(t, js, alice, "q")
+	js.Disconnect(alice)
+
+	// a fails once
+	alice = js.Connect(nil)
+	mustGetJob(t, js, alice, "q")
+	js.Abort(a, alice)
+
+	want := map[string][]uint64{"q": {a}, "dlq": {b}}
+	if got := readyJobs(js); !reflect.DeepEqual(got, want) {
+		t.Errorf("ready jobs %v, want %v", got, want)
+	}
+	journal.Close()
+
+	// The dead letter queue and delivery counts survive a restart, and b has
+	// as many deliveries again from the dead letter queue
+	js, _ = openJobServer(t, dir)
+	js.maxDeliveries, js.deadLetter = 3, "dlq"
+	if got := readyJobs(js); !reflect.DeepEqual(got, want) {
+		t.Errorf("ready jobs after restart %v, want %v", got, want)
+	}
+	alice = js.Connect(nil)
+	for range 2 {
+		mustGetJob(t, js, alice, "q")
+		js.Abort(a, alice)
+	}
+	for range 4 {
+		mustGetJob(t, js, alice, "dlq")
+		js.Abort(b, alice)
+	}
+	want = map[string][]uint64{"dlq": {a, b}}
+	if got := readyJobs(js); !reflect.DeepEqual(got, want) {
+		t.Errorf("ready jobs %v, want %v", got, want)
+	}
+}
+
+func TestLeaseRequests(t *testing.T) {
+	js := NewJobServer(nil, testShards)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go js.Reap(ctx, time.Millisecond)
+	conn, _ := serve(t, js)
+	r := bufio.NewReader(conn)
+
+	conn.Write([]byte(`{"request":"put","queue":"q","job":1,"pri":1}` + "\n" +
+		`{"request":"get","queues":["q"],"lease":50}` + "\n" +
+		`{"request":"heartbeat","id":1}` + "\n" +
+		`{"request":"extend","id":1,"lease":20}` + "\n" +
+		`{"request":"heartbeat","id":2}` + "\n"))
+	expectResponses(t, r,
+		map[string]any{"status": "ok", "id": 1.0},
+		map[string]any{"status": "ok", "id": 1.0},
+		map[string]any{"status": "ok"},
+		map[string]any{"status": "ok"},
+		map[string]any{"status": "no-job"},
+	)
+	waitFor(t, "lease to expire", func() bool { return len(readyJobs(js)["q"]) == 1 })
+	conn.Write([]byte(`{"request":"heartbeat","id":1}` + "\n"))
+	expectResponses(t, r, map[string]any{"status": "no-job"})
+}
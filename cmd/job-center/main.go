@@ -18,6 +18,7 @@ import (
 	"sync"
 	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/saurabh/protohackers/internal/logger"
 )
@@ -30,13 +31,30 @@ type GetRequest struct {
 	Request string   `json:"request"`
 	Queues  []string `json:"queues"`
 	Wait    bool     `json:"wait,omitempty"`
+	Timeout uint64   `json:"timeout,omitempty"` // milliseconds to wait, if not forever
+	Lease   uint64   `json:"lease,omitempty"`   // milliseconds to hold the job without a heartbeat
 }
 
 type PutRequest struct {
-	Request string `json:"request"`
-	Queue   string `json:"queue"`
-	Job     any    `json:"job"`
-	Pri     uint32 `json:"pri"`
+	Request   string          `json:"request"`
+	Queue     string          `json:"queue"`
+	Job       json.RawMessage `json:"job"`
+	Pri       uint32          `json:"pri"`
+	Delay     uint64          `json:"delay,omitempty"`      // milliseconds before the job can be got
+	NotBefore int64           `json:"not_before,omitempty"` // Unix time in seconds before which the job can't be got
+}
+
+// due returns when a put job can first be got, or the zero time if it can be
+// got straight away.
+func (req *PutRequest) due(now time.Time) time.Time {
+	var due time.Time
+	if req.Delay > 0 {
+		due = now.Add(time.Duration(req.Delay) * time.Millisecond)
+	}
+	if notBefore := time.Unix(req.NotBefore, 0); req.NotBefore != 0 && notBefore.After(due) {
+		due = notBefore
+	}
+	return due
 }
 
 type AbortRequest struct {
@@ -49,22 +67,187 @@ type DeleteRequest struct {
 	Id      uint64 `json:"id"`
 }
 
+type HeartbeatRequest struct {
+	Request string `json:"request"`
+	Id      uint64 `json:"id"`
+	Lease   uint64 `json:"lease,omitempty"` // milliseconds, if not the same again
+}
+
 type JobServer struct {
-	queue   map[string]*PriorityQueue // queue name -> priority queue
-	mu      sync.RWMutex
-	cond    *sync.Cond
-	counter atomic.Uint64
+	shards      []*shard
+	where       jobIndex
+	clients     map[uint64]*Client // id -> connected client
+	clientsMu   sync.Mutex         // guards clients and lastClient
+	rescheduled chan struct{}      // tells Schedule the first due job changed
+	counter     atomic.Uint64
+	lastClient  uint64
+	journal     *Journal   // nil if jobs are only kept in memory
+	snapshotMu  sync.Mutex // one Snapshot at a time, so an older one can't replace a newer
+
+	// A job given out maxDeliveries times without being deleted is moved to
+	// the deadLetter queue. Zero means it can be retried forever.
+	maxDeliveries int
+	deadLetter    string
+
+	// Admin requests must carry adminToken, unless it is empty.
+	adminToken string
+
+	// Request lines longer than maxLine bytes, and jobs put larger than
+	// maxJob, are rejected. Zero means no limit.
+	maxLine int
+	maxJob  int
+
+	schemas map[string]*Schema // queue name -> schema jobs put in it must match
+
+	// For /metrics
+	totals  serverTotals
+	latency map[string]*histogram // request type -> how long it took
+}
+
+// GetOptions controls how a get waits and how long it holds the job.
+type GetOptions struct {
+	Wait    bool
+	Timeout time.Duration // how long to wait, if not forever
+	Lease   time.Duration // how long the job is held without a heartbeat, if not until disconnect
+}
+
+var errNoJob = errors.New("job not found")
+
+// NewJobServer returns a server holding the jobs recovered by journal, which
+// records every operation from then on. A nil journal keeps jobs in memory.
+// Its queues are spread across the given number of shards.
+func NewJobServer(journal *Journal, shards int) *JobServer {
+	js := &JobServer{
+		shards:      make([]*shard, max(shards, 1)),
+		clients:     make(map[uint64]*Client),
+		rescheduled: make(chan struct{}, 1),
+		journal:     journal,
+		latency:     make(map[string]*histogram, len(requestTypes)),
+	}
+	for i := range js.shards {
+		js.shards[i] = newShard()
+	}
+	for _, request := range requestTypes {
+		js.latency[request] = newHistogram()
+	}
+	if journal == nil {
+		return js
+	}
+
+	for _, job := range journal.jobs {
+		s := js.shardOf(job.Queue)
+		item := &JobItem{id: job.ID, queue: job.Queue, job: job.Job, pri: job.Pri, deliveries: job.Deliveries, notBefore: job.NotBefore, created: job.Created, index: -1, leaseIndex: -1, dueIndex: -1}
+		s.jobs[item.id] = item
+		js.where.store(item.id, item.queue)
+		if item.notBefore.After(time.Now()) {
+			js.delay(s, item)
+		} else {
+			s.push(item)
+		}
+	}
+	js.counter.Store(journal.lastID)
+	log.Println("Recovered", len(journal.jobs), "jobs, last id", journal.lastID)
+	journal.jobs = nil
+	return js
+}
+
+// record writes op to the journal, if there is one. It's called with the
+// shards of the job's queues locked, before the operation is applied.
+func (js *JobServer) record(op journalOp) error {
+	if js.journal == nil {
+		return nil
+	}
+	if err := js.journal.Record(op); err != nil {
+		log.Println("Journal error:", err)
+		return fmt.Errorf("failed to record %s: %w", op.Op, err)
+	}
+	return nil
+}
+
+// Snapshot saves every job to the journal so the log before it can be
+// dropped. Operations carry on while it is written.
+func (js *JobServer) Snapshot() error {
+	if js.journal == nil {
+		return nil
+	}
+	js.snapshotMu.Lock()
+	defer js.snapshotMu.Unlock()
+
+	// Every operation is recorded with a shard locked, so none is half done
+	unlock := js.lockAll()
+	snap := snapshot{LastID: js.counter.Load()}
+	for _, s := range js.shards {
+		for _, item := range s.jobs {
+			snap.Jobs = append(snap.Jobs, journalJob{ID: item.id, Queue: item.queue, Pri: item.pri, Job: item.job, Deliveries: item.deliveries, NotBefore: item.notBefore, Created: item.created})
+		}
+	}
+	seq, covered, err := js.journal.rotate()
+	unlock()
+	if err != nil {
+		return err
+	}
+
+	snap.Seq = seq
+	if err := js.journal.saveSnapshot(snap, covered); err != nil {
+		return err
+	}
+	log.Println("Saved snapshot of", len(snap.Jobs), "jobs at operation", seq)
+	return nil
+}
+
+// Persist syncs the journal every syncInterval and snapshots it every
+// snapshotInterval until ctx is done.
+func (js *JobServer) Persist(ctx context.Context, syncInterval, snapshotInterval time.Duration) {
+	syncTicker := time.NewTicker(syncInterval)
+	defer syncTicker.Stop()
+	snapshotTicker := time.NewTicker(snapshotInterval)
+	defer snapshotTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-syncTicker.C:
+			if err := js.journal.Sync(); err != nil {
+				log.Println("Journal sync error:", err)
+			}
+		case <-snapshotTicker.C:
+			if err := js.Snapshot(); err != nil {
+				log.Println("Snapshot error:", err)
+			}
+		}
+	}
 }
 
 type JobItem struct {
-	id    uint64
-	job   any
-	pri   uint32
-	index int
-	state string
-	owner net.Addr
+	id         uint64
+	queue      string
+	job        any
+	pri        uint32
+	index      int    // in its queue while it's ready, or -1
+	state      string // ready, assigned or delayed
+	owner      *Client
+	deliveries int // times it has been assigned since it was put or dead-lettered
+	lease      time.Duration
+	expires    time.Time
+	leaseIndex int       // in its shard's leases, or -1
+	notBefore  time.Time // when a delayed job is due
+	dueIndex   int       // in its shard's due, or -1
+	created    time.Time // when it was put
 }
 
+// before reports whether a should be given out ahead of b: it has a higher
+// priority, or the same one and was put first.
+func (a *JobItem) before(b *JobItem) bool {
+	if a.pri != b.pri {
+		return a.pri > b.pri
+	}
+	return a.id < b.id
+}
+
+// PriorityQueue holds the ready jobs in a queue. Assigned jobs are kept in
+// their shard's inflight set, and delayed ones in its due heap, until they
+// are ready again.
 type PriorityQueue []*JobItem
 
 func (pq PriorityQueue) Len() int {
@@ -73,13 +256,7 @@ func (pq PriorityQueue) Len() int {
 
 // We need a max heap
 func (pq PriorityQueue) Less(i int, j int) bool {
-	if pq[i].state == "ready" && pq[j].state != "ready" {
-		return true
-	}
-	if pq[i].state != "ready" && pq[j].state == "ready" {
-		return false
-	}
-	return pq[i].pri > pq[j].pri
+	return pq[i].before(pq[j])
 }
 
 func (pq PriorityQueue) Swap(i int, j int) {
@@ -112,113 +289,271 @@ func (pq *PriorityQueue) Peek() (*JobItem, error) {
 	return (*pq)[0], nil
 }
 
-func (js *JobServer) Put(queue string, job any, pri uint32, conn net.Conn) uint64 {
-	js.mu.Lock()
-	defer js.mu.Unlock()
-
-	if _, exists := js.queue[queue]; !exists {
-		js.queue[queue] = &PriorityQueue{}
-		heap.Init(js.queue[queue])
+// Put adds a job to queue. It can't be got until notBefore, unless that is
+// the zero time.
+func (js *JobServer) Put(queue string, job any, pri uint32, notBefore time.Time, c *Client) (uint64, error) {
+	defer js.observe("put", time.Now())
+	if schema := js.schemas[queue]; schema != nil {
+		if err := schema.Validate(job); err != nil {
+			return 0, fmt.Errorf("%w: %w", errInvalidJob, err)
+		}
 	}
-	id := js.counter.Add(1)
+	s := js.shardOf(queue)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
+	id := js.counter.Add(1)
+	now := time.Now()
+	if err := js.record(journalOp{Op: "put", ID: id, Queue: queue, Pri: pri, Job: job, NotBefore: notBefore, Created: now}); err != nil {
+		return 0, err
+	}
 	newJob := &JobItem{
-		id:    id,
-		job:   job,
-		pri:   pri,
-		state: "ready",
-		owner: nil,
+		id:         id,
+		queue:      queue,
+		job:        job,
+		pri:        pri,
+		index:      -1,
+		owner:      nil,
+		leaseIndex: -1,
+		notBefore:  notBefore,
+		dueIndex:   -1,
+		created:    now,
+	}
+	s.jobs[id] = newJob
+	js.where.store(id, queue)
+	c.mu.Lock()
+	c.stats.Puts++
+	c.mu.Unlock()
+	js.totals.puts.Add(1)
+
+	if notBefore.After(now) {
+		js.delay(s, newJob)
+		log.Println("Put job", newJob.id, "into queue", queue, "with priority", pri, "due at", notBefore)
+		return id, nil
 	}
-	heap.Push(js.queue[queue], newJob)
+	s.push(newJob)
 	log.Println("Put job", newJob.id, "into queue", queue, "with priority", pri)
-
-	js.cond.Broadcast()
-	return id
+	js.handoff(s, queue)
+	return id, nil
 }
 
-func (js *JobServer) Get(queues []string, wait bool, conn net.Conn) (*JobItem, string, error) {
-	js.mu.Lock()
-	defer js.mu.Unlock()
-
-	for {
-		var bestJob *JobItem
-		var bestPri uint32
-		var bestQueue string
-
-		for _, queue := range queues {
-			pq, exists := js.queue[queue]
-			if !exists {
-				continue
-			}
-			job, err := pq.Peek()
-
-			// Skip empty queues or assigned jobs
-			if err != nil || job.state == "assigned" {
-				continue
-			}
-			if bestJob == nil || job.pri > bestPri {
-				bestJob = job
-				bestPri = job.pri
-				bestQueue = queue
-			}
+// Get assigns c the highest priority ready job in queues. If opts.Wait is set
+// it blocks until there is one, unless c disconnects first or opts.Timeout
+// passes.
+func (js *JobServer) Get(queues []string, opts GetOptions, c *Client) (*JobItem, string, error) {
+	defer js.observe("get", time.Now())
+	unlock := js.lock(queues...)
+	if job := js.best(queues, nil); job != nil {
+		queue := job.queue
+		err := js.assign(job, c, opts.Lease)
+		unlock()
+		if err != nil {
+			return nil, "", err
 		}
+		return job, queue, nil
+	}
+	if !opts.Wait {
+		unlock()
+		return nil, "", errNoJob
+	}
+	if c.ctx.Err() != nil {
+		unlock()
+		return nil, "", errDisconnected
+	}
+	w := js.wait(c, queues, opts.Lease)
+	unlock()
+
+	var deadline <-chan time.Time
+	if opts.Timeout > 0 {
+		timer := time.NewTimer(opts.Timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	select {
+	case <-w.ready:
+	case <-c.ctx.Done():
+	case <-deadline:
+	}
 
-		// Found a job, so assign it to the connection
-		if bestJob != nil {
-			bestJob.state = "assigned"
-			bestJob.owner = conn.RemoteAddr()
-			heap.Fix(js.queue[bestQueue], bestJob.index)
-			log.Println("Got job", bestJob.id, "from queue", bestQueue, "with priority", bestPri)
-			return bestJob, bestQueue, nil
+	if !w.claimed.CompareAndSwap(false, true) {
+		// Handed a job, perhaps just as it gave up
+		<-w.ready
+		js.unwait(w)
+		if w.err != nil {
+			return nil, "", w.err
 		}
+		return w.job, w.queue, nil
+	}
+	js.unwait(w)
+	if c.ctx.Err() != nil {
+		return nil, "", errDisconnected
+	}
+	return nil, "", errNoJob
+}
 
-		if !wait {
-			return nil, "", fmt.Errorf("no job found")
+// best returns the highest priority ready job in queues, or nil. If in isn't
+// nil, only the queues it holds are looked at. The shards holding them must
+// be locked.
+func (js *JobServer) best(queues []string, in *shard) *JobItem {
+	var bestJob *JobItem
+	for _, queue := range queues {
+		s := js.shardOf(queue)
+		if in != nil && s != in {
+			continue
+		}
+		pq, exists := s.queue[queue]
+		if !exists {
+			continue
+		}
+		job, err := pq.Peek()
+		if err != nil {
+			continue
+		}
+		if bestJob == nil || job.before(bestJob) {
+			bestJob = job
 		}
+	}
+	return bestJob
+}
 
-		js.cond.Wait()
+// assign gives a ready job to c, leased for d if that's not zero. It fails
+// if c has disconnected, as the jobs it held have already been given back.
+func (js *JobServer) assign(job *JobItem, c *Client, d time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.gone {
+		return errDisconnected
+	}
+	if err := js.record(journalOp{Op: "get", ID: job.id}); err != nil {
+		return err
 	}
+	s := js.shardOf(job.queue)
+	heap.Remove(s.queue[job.queue], job.index)
+	s.inflight[job.id] = job
+	job.state = "assigned"
+	job.owner = c
+	job.deliveries++
+	js.lease(s, job, d, time.Now())
+	c.held[job.id] = job
+	c.stats.Gets++
+	js.totals.gets.Add(1)
+	log.Println("Got job", job.id, "from queue", job.queue, "with priority", job.pri, "for", c)
+	return nil
 }
 
-func (js *JobServer) Abort(id uint64, conn net.Conn, disconnected bool) error {
-	js.mu.Lock()
-	defer js.mu.Unlock()
+// Abort puts a job held by c back in its queue.
+func (js *JobServer) Abort(id uint64, c *Client) error {
+	defer js.observe("abort", time.Now())
+	job, unlock := js.lockJob(id, js.deadLetterQueues()...)
+	defer unlock()
 
-	for _, pq := range js.queue {
-		for _, job := range *pq {
-			if job.owner == conn.RemoteAddr() && (disconnected || job.id == id) {
-				job.state = "ready"
-				job.owner = nil
-				heap.Fix(pq, job.index)
-				log.Println("Aborted job", job.id)
-				js.cond.Broadcast()
-				return nil
-			}
-		}
+	if job == nil || job.owner != c {
+		return errNoJob
+	}
+	if err := js.record(journalOp{Op: "abort", ID: job.id}); err != nil {
+		return err
 	}
-	return fmt.Errorf("job not found")
+	js.requeue(job)
+	c.mu.Lock()
+	c.stats.Aborts++
+	c.mu.Unlock()
+	js.totals.aborts.Add(1)
+	return nil
 }
 
-func (js *JobServer) Delete(id uint64, conn net.Conn) error {
-	js.mu.Lock()
-	defer js.mu.Unlock()
-	for _, pq := range js.queue {
-		for _, job := range *pq {
-			if job.id == id {
-				heap.Remove(pq, job.index)
-				log.Println("Deleted job", job.id)
-				return nil
-			}
-		}
+// requeue makes an assigned job ready again, and hands it to a waiting get if
+// there is one. A job that has used up its deliveries goes to the dead letter
+// queue instead. Called with the shards of its queue and the dead letter
+// queue locked.
+func (js *JobServer) requeue(job *JobItem) {
+	job.owner.mu.Lock()
+	delete(job.owner.held, job.id)
+	job.owner.mu.Unlock()
+	s := js.shardOf(job.queue)
+	js.unlease(s, job)
+	delete(s.inflight, job.id)
+	job.owner = nil
+	log.Println("Aborted job", job.id)
+
+	if js.maxDeliveries > 0 && job.deliveries >= js.maxDeliveries && job.queue != js.deadLetter {
+		s = js.moveToDeadLetter(s, job)
+	}
+	s.push(job)
+	js.handoff(s, job.queue)
+}
+
+// moveToDeadLetter moves job from shard s to the dead letter queue, and
+// returns the shard now holding it. If the move can't be recorded the job
+// stays in its queue, as the journal has it, until it next comes back.
+func (js *JobServer) moveToDeadLetter(s *shard, job *JobItem) *shard {
+	if err := js.record(journalOp{Op: "dead", ID: job.id, Queue: js.deadLetter}); err != nil {
+		log.Println("Kept job", job.id, "in queue", job.queue, "after", job.deliveries, "deliveries:", err)
+		return s
 	}
-	return fmt.Errorf("job not found")
+	delete(s.jobs, job.id)
+	log.Println("Moved job", job.id, "from queue", job.queue, "to", js.deadLetter, "after", job.deliveries, "deliveries")
+	job.queue = js.deadLetter
+	job.deliveries = 0
+	js.totals.deadLettered.Add(1)
+	s = js.shardOf(job.queue)
+	s.jobs[job.id] = job
+	js.where.store(job.id, job.queue)
+	return s
+}
+
+func (js *JobServer) Delete(id uint64, c *Client) error {
+	defer js.observe("delete", time.Now())
+	job, unlock := js.lockJob(id)
+	defer unlock()
+
+	if job == nil {
+		return errNoJob
+	}
+	if err := js.record(journalOp{Op: "delete", ID: job.id}); err != nil {
+		return err
+	}
+	if job.owner != nil {
+		job.owner.mu.Lock()
+		delete(job.owner.held, job.id)
+		job.owner.mu.Unlock()
+	}
+	s := js.shardOf(job.queue)
+	js.unlease(s, job)
+	switch job.state {
+	case "ready":
+		heap.Remove(s.queue[job.queue], job.index)
+	case "assigned":
+		delete(s.inflight, id)
+	case "delayed":
+		heap.Remove(&s.due, job.dueIndex)
+	}
+	delete(s.jobs, id)
+	js.where.delete(id)
+	c.mu.Lock()
+	c.stats.Deletes++
+	c.mu.Unlock()
+	js.totals.deletes.Add(1)
+	log.Println("Deleted job", job.id)
+	return nil
 }
 
 var port = flag.String("port", "50001", "Port to listen on")
+var dataDir = flag.String("data-dir", "", "Directory for the job journal (in-memory if empty)")
+var syncInterval = flag.Duration("sync-interval", time.Second, "How often the journal is fsynced")
+var snapshotInterval = flag.Duration("snapshot-interval", time.Minute, "How often the journal is snapshotted")
+var reapInterval = flag.Duration("reap-interval", 100*time.Millisecond, "How often expired leases are checked for")
+var maxDeliveries = flag.Int("max-deliveries", 0, "Times a job is given out before it is dead-lettered (0 for no limit)")
+var deadLetter = flag.String("dead-letter-queue", "dead-letter", "Queue that jobs out of deliveries are moved to")
+var adminToken = flag.String("admin-token", "", "Token admin requests must carry (none needed if empty)")
+var shardCount = flag.Int("shards", 64, "Number of independently locked shards queues are spread across")
+var maxLine = flag.Int("max-line", 1<<20, "Longest request line read, in bytes (0 for no limit)")
+var maxJob = flag.Int("max-job", 256<<10, "Largest job that can be put, in bytes of JSON (0 for no limit)")
+var schemaFile = flag.String("schemas", "", "JSON file mapping queue names to JSON Schemas their jobs must match")
 
 func main() {
 	go func() {
-		log.Println("Pprof server starting on :6060")
+		log.Println("Pprof and metrics server starting on :6060")
 		log.Fatal(http.ListenAndServe("localhost:6060", nil))
 	}()
 
@@ -254,12 +589,44 @@ func main() {
 		ln.Close()
 	}()
 
-	js := JobServer{
-		queue:   make(map[string]*PriorityQueue),
-		counter: atomic.Uint64{},
+	var journal *Journal
+	if *dataDir != "" {
+		journal, err = OpenJournal(*dataDir)
+		if err != nil {
+			panic(err)
+		}
+		log.Println("Journaling jobs in", *dataDir)
+	}
+	js := NewJobServer(journal, *shardCount)
+	js.maxDeliveries = *maxDeliveries
+	js.deadLetter = *deadLetter
+	js.adminToken = *adminToken
+	js.maxLine = *maxLine
+	js.maxJob = *maxJob
+	if *schemaFile != "" {
+		js.schemas, err = LoadSchemas(*schemaFile)
+		if err != nil {
+			panic(err)
+		}
+		log.Println("Loaded job schemas for", len(js.schemas), "queues from", *schemaFile)
 	}
-	js.cond = sync.NewCond(&js.mu)
-	js.counter.Store(0)
+	http.HandleFunc("/metrics", js.ServeMetrics)
+
+	// Everything that records to the journal is waited for on shutdown,
+	// before the final snapshot is taken and the journal closed
+	var workers sync.WaitGroup
+	if journal != nil {
+		defer journal.Close()
+		defer func() {
+			if err := js.Snapshot(); err != nil {
+				log.Println("Snapshot error:", err)
+			}
+		}()
+		workers.Go(func() { js.Persist(ctx, *syncInterval, *snapshotInterval) })
+	}
+	defer workers.Wait()
+	workers.Go(func() { js.Reap(ctx, *reapInterval) })
+	workers.Go(func() { js.Schedule(ctx) })
 
 	for {
 		conn, err := ln.Accept()
@@ -273,36 +640,94 @@ func main() {
 				continue
 			}
 		}
-		go handleConnection(conn, &js)
+		workers.Go(func() {
+			// Hang up on the client at shutdown, releasing what it holds
+			stop := context.AfterFunc(ctx, func() { conn.Close() })
+			defer stop()
+			handleConnection(conn, js)
+		})
 	}
 }
 
-func handleConnection(conn net.Conn, js *JobServer) {
-	log.Println("New connection from", conn.RemoteAddr())
-	defer conn.Close()
+// maxPipelined is how many requests are read ahead of the one being handled.
+const maxPipelined = 64
 
-	reader := bufio.NewReader(conn)
-	writer := bufio.NewWriter(conn)
+var errLineTooLong = errors.New("line too long")
 
+// readLine reads a line, including its newline, like reader.ReadBytes('\n'),
+// but keeps no more than max bytes of it, unless max is zero. The rest of a
+// longer line is read and discarded, and errLineTooLong returned.
+func readLine(reader *bufio.Reader, max int) ([]byte, error) {
+	var line []byte
+	tooLong := false
 	for {
+		chunk, err := reader.ReadSlice('\n')
+		if max > 0 && len(line)+len(chunk) > max {
+			tooLong, line = true, nil
+		}
+		if !tooLong {
+			line = append(line, chunk...)
+		}
+		switch {
+		case errors.Is(err, bufio.ErrBufferFull):
+			continue
+		case err != nil:
+			return line, err
+		case tooLong:
+			return nil, errLineTooLong
+		}
+		return line, nil
+	}
+}
 
-		// The server must not close the connection in response to an invalid request.
-		// Read line-by-line (each request is terminated by newline)
-		line, err := reader.ReadBytes('\n')
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				log.Println("Connection closed from", conn.RemoteAddr())
-				js.Abort(0, conn, true)
+func handleConnection(conn net.Conn, js *JobServer) {
+	client := js.Connect(conn.RemoteAddr())
+	log.Println("New connection from", conn.RemoteAddr(), "as", client)
+	defer conn.Close()
+	defer js.Disconnect(client)
+
+	// Requests are read ahead of the one being handled, so a client that
+	// hangs up while blocked in a get is noticed and the get cancelled. The
+	// jobs it holds are released once the requests it sent are handled.
+	lines := make(chan []byte, maxPipelined)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(lines)
+		reader := bufio.NewReader(conn)
+		for {
+			// Read line-by-line (each request is terminated by newline). A line
+			// too long to read is passed on as nil, to be answered with an error.
+			line, err := readLine(reader, js.maxLine)
+			if err != nil && !errors.Is(err, errLineTooLong) {
+				if errors.Is(err, io.EOF) {
+					log.Println("Connection closed from", conn.RemoteAddr())
+				} else {
+					log.Println("Read error:", err)
+				}
+				client.Hangup()
+				return
+			}
+			select {
+			case lines <- line:
+			case <-done:
 				return
 			}
-			log.Println("Read error:", err)
-			response, _ := json.Marshal(map[string]any{"status": "error", "error": "Read error: " + err.Error()})
+		}
+	}()
+
+	writer := bufio.NewWriter(conn)
+
+	// The server must not close the connection in response to an invalid request.
+	for line := range lines {
+		if line == nil {
+			log.Println("Request too long from", conn.RemoteAddr())
+			response, _ := json.Marshal(map[string]any{"status": "error", "error": "Request too long."})
 			writer.Write(response)
 			writer.WriteByte('\n')
 			writer.Flush()
 			continue
 		}
-
 		var raw json.RawMessage
 		if err := json.Unmarshal(line, &raw); err != nil {
 			log.Println("Unmarshal error:", err)
@@ -335,9 +760,17 @@ func handleConnection(conn net.Conn, js *JobServer) {
 				continue
 			}
 
-			bestJob, bestQueue, err := js.Get(getReq.Queues, getReq.Wait, conn)
+			bestJob, bestQueue, err := js.Get(getReq.Queues, GetOptions{
+				Wait:    getReq.Wait,
+				Timeout: time.Duration(getReq.Timeout) * time.Millisecond,
+				Lease:   time.Duration(getReq.Lease) * time.Millisecond,
+			}, client)
 			if err != nil {
-				response, marshalErr := json.Marshal(map[string]any{"status": "no-job"})
+				status := map[string]any{"status": "no-job"}
+				if !errors.Is(err, errNoJob) {
+					status = map[string]any{"status": "error", "error": err.Error()}
+				}
+				response, marshalErr := json.Marshal(status)
 				if marshalErr != nil {
 					log.Println("Marshal error:", marshalErr)
 					return // Close connection on marshal error
@@ -380,8 +813,24 @@ func handleConnection(conn net.Conn, js *JobServer) {
 				writer.Flush()
 				continue
 			}
-			jobId := js.Put(putReq.Queue, putReq.Job, putReq.Pri, conn)
-			response, _ := json.Marshal(map[string]any{"status": "ok", "id": jobId})
+			if js.maxJob > 0 && len(putReq.Job) > js.maxJob {
+				response, _ := json.Marshal(map[string]any{"status": "error", "error": "Job too large."})
+				writer.Write(response)
+				writer.WriteByte('\n')
+				writer.Flush()
+				continue
+			}
+			var job any
+			if len(putReq.Job) > 0 {
+				json.Unmarshal(putReq.Job, &job) // already checked to be valid JSON
+			}
+			jobId, err := js.Put(putReq.Queue, job, putReq.Pri, putReq.due(time.Now()), client)
+			var response []byte
+			if err != nil {
+				response, _ = json.Marshal(map[string]any{"status": "error", "error": err.Error()})
+			} else {
+				response, _ = json.Marshal(map[string]any{"status": "ok", "id": jobId})
+			}
 			writer.Write(response)
 			writer.WriteByte('\n')
 			writer.Flush()
@@ -398,10 +847,12 @@ func handleConnection(conn net.Conn, js *JobServer) {
 				continue
 			}
 
-			err := js.Abort(abortReq.Id, conn, false)
+			err := js.Abort(abortReq.Id, client)
 			var response []byte
-			if err != nil {
+			if errors.Is(err, errNoJob) {
 				response, _ = json.Marshal(map[string]any{"status": "no-job"})
+			} else if err != nil {
+				response, _ = json.Marshal(map[string]any{"status": "error", "error": err.Error()})
 			} else {
 				response, _ = json.Marshal(map[string]any{"status": "ok"})
 			}
@@ -421,7 +872,32 @@ func handleConnection(conn net.Conn, js *JobServer) {
 				continue
 			}
 
-			err := js.Delete(deleteReq.Id, conn)
+			err := js.Delete(deleteReq.Id, client)
+			var response []byte
+			if errors.Is(err, errNoJob) {
+				response, _ = json.Marshal(map[string]any{"status": "no-job"})
+			} else if err != nil {
+				response, _ = json.Marshal(map[string]any{"status": "error", "error": err.Error()})
+			} else {
+				response, _ = json.Marshal(map[string]any{"status": "ok"})
+			}
+			writer.Write(response)
+			writer.WriteByte('\n')
+			writer.Flush()
+
+		case "heartbeat", "extend":
+			log.Println("Heartbeat request:", string(raw))
+			var heartbeatReq HeartbeatRequest
+			if err := json.Unmarshal(raw, &heartbeatReq); err != nil {
+				log.Println("Unmarshal error:", err)
+				response, _ := json.Marshal(map[string]any{"status": "error", "error": "Unmarshal error: " + err.Error()})
+				writer.Write(response)
+				writer.WriteByte('\n')
+				writer.Flush()
+				continue
+			}
+
+			err := js.Heartbeat(heartbeatReq.Id, time.Duration(heartbeatReq.Lease)*time.Millisecond, client)
 			var response []byte
 			if err != nil {
 				response, _ = json.Marshal(map[string]any{"status": "no-job"})
@@ -432,6 +908,13 @@ func handleConnection(conn net.Conn, js *JobServer) {
 			writer.WriteByte('\n')
 			writer.Flush()
 
+		case "stats", "list-queue", "peek":
+			log.Println("Admin request:", string(raw))
+			response, _ := json.Marshal(handleAdmin(js, raw))
+			writer.Write(response)
+			writer.WriteByte('\n')
+			writer.Flush()
+
 		default:
 			log.Println("Invalid request:", string(raw))
 			response, _ := json.Marshal(map[string]any{"status": "error", "error": "Unrecognised request type."})
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testShards spreads the queues tests use over several shards, so gets on
+// more than one queue usually cross them.
+const testShards = 8
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// openJobServer opens a journaled server on dir, closing it when the test
+// ends unless the test closes it first.
+func openJobServer(t *testing.T, dir string) (*JobServer, *Journal) {
+	t.Helper()
+
+	journal, err := OpenJournal(dir)
+	if err != nil {
+		t.Fatalf("OpenJournal: %v", err)
+	}
+	t.Cleanup(func() { journal.Close() })
+	return NewJobServer(journal, testShards), journal
+}
+
+// serve handles one connection to js and returns the client's end of it,
+// along with a channel closed once the server is done with it.
+func serve(t *testing.T, js *JobServer) (*net.TCPConn, chan struct{}) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		handleConnection(server, js)
+		close(done)
+	}()
+	return conn.(*net.TCPConn), done
+}
+
+// expectResponses reads a response for each of want and checks that it has
+// the fields given.
+func expectResponses(t *testing.T, r *bufio.Reader, want ...map[string]any) {
+	t.Helper()
+
+	for _, fields := range want {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			t.Fatalf("reading response: %v", err)
+		}
+		var got map[string]any
+		if err := json.Unmarshal(line, &got); err != nil {
+			t.Fatalf("bad response %q: %v", line, err)
+		}
+		for k, v := range fields {
+			if !reflect.DeepEqual(got[k], v) {
+				t.Errorf("response %s has %s = %v, want %v", line, k, got[k], v)
+			}
+		}
+	}
+}
+
+// waitFor polls cond until it holds, failing the test after a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func mustPutJob(t testing.TB, js *JobServer, queue string, job any, pri uint32) uint64 {
+	t.Helper()
+
+	c := js.Connect(nil)
+	defer js.Disconnect(c)
+	id, err := js.Put(queue, job, pri, time.Time{}, c)
+	if err != nil {
+		t.Fatalf("Put(%s): %v", queue, err)
+	}
+	return id
+}
+
+func mustGetJob(t testing.TB, js *JobServer, c *Client, queues ...string) uint64 {
+	t.Helper()
+
+	job, _, err := js.Get(queues, GetOptions{}, c)
+	if err != nil {
+		t.Fatalf("Get(%v): %v", queues, err)
+	}
+	return job.id
+}
+
+// readyJobs returns the ids of the ready jobs in each queue, sorted.
+func readyJobs(js *JobServer) map[string][]uint64 {
+	unlock := js.lockAll()
+	defer unlock()
+
+	jobs := make(map[string][]uint64)
+	for _, s := range js.shards {
+		for name, pq := range s.queue {
+			for _, item := range *pq {
+				if item.state == "ready" {
+					jobs[name] = append(jobs[name], item.id)
+				}
+			}
+			slices.Sort(jobs[name])
+		}
+	}
+	return jobs
+}
+
+// sumShards adds up f over every shard, locking each in turn.
+func sumShards(js *JobServer, f func(s *shard) int) int {
+	n := 0
+	for _, s := range js.shards {
+		s.mu.Lock()
+		n += f(s)
+		s.mu.Unlock()
+	}
+	return n
+}
+
+func TestAbortOnlyReleasesOwnJobs(t *testing.T) {
+	js := NewJobServer(nil, testShards)
+	alice, bob := js.Connect(nil), js.Connect(nil)
+
+	a := mustPutJob(t, js, "q", "a", 2)
+	b := mustPutJob(t, js, "q", "b", 1)
+	mustGetJob(t, js, alice, "q")
+	mustGetJob(t, js, bob, "q")
+
+	tests := []struct {
+		id     uint64
+		client *Client
+		want   error
+	}{
+		{a, bob, errNoJob},
+		{b + 1, bob, errNoJob},
+		{a, alice, nil},
+		{a, alice, errNoJob},
+	}
+	for _, tt := range tests {
+		if err := js.Abort(tt.id, tt.client); err != tt.want {
+			t.Errorf("Abort(%d, %v) = %v, want %v", tt.id, tt.client, err, tt.want)
+		}
+	}
+	if got, want := readyJobs(js), map[string][]uint64{"q": {a}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ready jobs %v, want %v", got, want)
+	}
+}
+
+func TestDisconnectReleasesEveryHeldJob(t *testing.T) {
+	js := NewJobServer(nil, testShards)
+	alice, bob := js.Connect(nil), js.Connect(nil)
+
+	var ids []uint64
+	for i := range 5 {
+		ids = append(ids, mustPutJob(t, js, fmt.Sprint("q", i%2), i, uint32(i)))
+	}
+	for range 3 {
+		mustGetJob(t, js, alice, "q0", "q1")
+	}
+	mustGetJob(t, js, bob, "q0", "q1")
+
+	js.Disconnect(alice)
+	// Bob still holds the best job left once alice took three
+	want := map[string][]uint64{"q0": {ids[0], ids[2], ids[4]}, "q1": {ids[3]}}
+	if got := readyJobs(js); !reflect.DeepEqual(got, want) {
+		t.Errorf("ready jobs %v, want %v", got, want)
+	}
+	if len(alice.held) != 0 || alice.stats.Aborts != 3 {
+		t.Errorf("alice holds %d jobs after %d aborts, want 0 after 3", len(alice.held), alice.stats.Aborts)
+	}
+
+	// A second disconnect changes nothing
+	js.Disconnect(alice)
+	if got := readyJobs(js); !reflect.DeepEqual(got, want) {
+		t.Errorf("ready jobs %v after second disconnect, want %v", got, want)
+	}
+	if _, connected := js.clients[bob.id]; len(js.clients) != 1 || !connected {
+		t.Errorf("connected clients %v, want just bob", js.clients)
+	}
+}
+
+func TestDeleteAssignedJob(t *testing.T) {
+	js := NewJobServer(nil, testShards)
+	alice, bob := js.Connect(nil), js.Connect(nil)
+
+	a := mustPutJob(t, js, "q", "a", 1)
+	mustGetJob(t, js, alice, "q")
+
+	// Anyone may delete a job, even one assigned to someone else
+	if err := js.Delete(a, bob); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := js.Delete(a, bob); err != errNoJob {
+		t.Errorf("second Delete = %v, want %v", err, errNoJob)
+	}
+	if err := js.Abort(a, alice); err != errNoJob {
+		t.Errorf("Abort of deleted job = %v, want %v", err, errNoJob)
+	}
+	if jobs := sumShards(js, func(s *shard) int { return len(s.jobs) }); jobs != 0 || len(alice.held) != 0 {
+		t.Errorf("deleted job still indexed: %d jobs, %d held", jobs, len(alice.held))
+	}
+}
+
+func TestDisconnectCancelsBlockedGet(t *testing.T) {
+	js := NewJobServer(nil, testShards)
+	conn, done := serve(t, js)
+
+	conn.Write([]byte(`{"request":"get","queues":["q"],"wait":true}` + "\n"))
+	waitFor(t, "get to block", func() bool {
+		js.clientsMu.Lock()
+		defer js.clientsMu.Unlock()
+		for _, c := range js.clients {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return len(c.waiting) == 1
+		}
+		return false
+	})
+	conn.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("connection still handled after client went away")
+	}
+
+	// The cancelled get must not take the next job
+	id := mustPutJob(t, js, "q", "job", 1)
+	if got, want := readyJobs(js), map[string][]uint64{"q": {id}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ready jobs %v, want %v", got, want)
+	}
+	if len(js.clients) != 0 {
+		t.Errorf("%d clients still connected, want 0", len(js.clients))
+	}
+}
+
+func TestHalfClosedClientGetsResponses(t *testing.T) {
+	js := NewJobServer(nil, testShards)
+	conn, done := serve(t, js)
+
+	// Everything sent before the client stops writing is still answered
+	conn.Write([]byte(`{"request":"put","queue":"q","job":{"n":1},"pri":5}` + "\n" +
+		`{"request":"get","queues":["q"]}` + "\n" +
+		`{"request":"get","queues":["q"],"wait":true}` + "\n"))
+	conn.CloseWrite()
+	r := bufio.NewReader(conn)
+	expectResponses(t, r,
+		map[string]any{"status": "ok", "id": 1.0},
+		map[string]any{"status": "ok", "id": 1.0, "job": map[string]any{"n": 1.0}, "queue": "q"},
+		map[string]any{"status": "error"},
+	)
+	<-done
+
+	// And the job it held went back when it was gone
+	if got, want := readyJobs(js), map[string][]uint64{"q": {1}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ready jobs %v, want %v", got, want)
+	}
+}
+
+func TestRequestSizeLimits(t *testing.T) {
+	js := NewJobServer(nil, testShards)
+	js.maxLine = 16 << 10
+	js.maxJob = 8 << 10
+	conn, _ := serve(t, js)
+
+	// A line past the limit is answered with an error, however much of it
+	// there is, and the next line read as usual
+	long := `{"request":"put","queue":"q","job":"` + strings.Repeat("x", 100<<10) + `","pri":1}` + "\n"
+	conn.Write([]byte(long + `{"request":"put","queue":"q","job":"small","pri":1}` + "\n" +
+		`{"request":"put","queue":"q","job":"` + strings.Repeat("x", 8<<10) + `","pri":1}` + "\n"))
+	r := bufio.NewReader(conn)
+	expectResponses(t, r,
+		map[string]any{"status": "error", "error": "Request too long."},
+		map[string]any{"status": "ok", "id": 1.0},
+		map[string]any{"status": "error", "error": "Job too large."},
+	)
+
+	// Lines longer than the read buffer are fine within the limit
+	conn.Write([]byte(`{"request":"put","queue":"q","job":"` + strings.Repeat("x", 6<<10) + `","pri":1}` + "\n"))
+	expectResponses(t, r, map[string]any{"status": "ok", "id": 2.0})
+}
+
+func TestReadLine(t *testing.T) {
+	tests := []struct {
+		input string
+		max   int
+		want  []string // "" for errLineTooLong
+	}{
+		{"a\nbc\n", 0, []string{"a\n", "bc\n"}},
+		{"abc\nd\n", 4, []string{"abc\n", "d\n"}},
+		{"abcd\nd\n", 4, []string{"", "d\n"}},
+		{strings.Repeat("a", 10000) + "\nb\n", 100, []string{"", "b\n"}},
+		{strings.Repeat("a", 10000) + "\nb\n", 0, []string{strings.Repeat("a", 10000) + "\n", "b\n"}},
+	}
+	for _, tt := range tests {
+		reader := bufio.NewReaderSize(strings.NewReader(tt.input), 16)
+		for _, want := range tt.want {
+			line, err := readLine(reader, tt.max)
+			if want == "" && err != errLineTooLong || want != "" && (err != nil || string(line) != want) {
+				t.Errorf("readLine(%.20q, %d) = %.20q, %v, want %.20q", tt.input, tt.max, line, err, want)
+			}
+		}
+		if _, err := readLine(reader, tt.max); err != io.EOF {
+			t.Errorf("readLine(%.20q, %d) at end = %v, want EOF", tt.input, tt.max, err)
+		}
+	}
+}
+
+// benchJobs is how many jobs are queued while the benchmarks run.
+const benchJobs = 1_000_000
+
+// fillJobServer returns a server with n jobs of random priority spread over
+// 16 queues, and their ids.
+func fillJobServer(b *testing.B, n int) (*JobServer, []string, []uint64) {
+	b.Helper()
+
+	js := NewJobServer(nil, testShards)
+	queues := make([]string, 16)
+	for i := range queues {
+		queues[i] = fmt.Sprint("queue-", i)
+	}
+	ids := make([]uint64, n)
+	for i := range ids {
+		ids[i] = mustPutJob(b, js, queues[i%len(queues)], i, rand.Uint32N(1000))
+	}
+	return js, queues, ids
+}
+
+func BenchmarkGetAbort(b *testing.B) {
+	js, queues, _ := fillJobServer(b, benchJobs)
+	c := js.Connect(nil)
+
+	for b.Loop() {
+		id := mustGetJob(b, js, c, queues...)
+		if err := js.Abort(id, c); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDelete(b *testing.B) {
+	js, queues, ids := fillJobServer(b, benchJobs)
+	c := js.Connect(nil)
+
+	// Delete a random job and put another in its place, so the server stays
+	// the same size
+	for b.Loop() {
+		i := rand.IntN(len(ids))
+		if err := js.Delete(ids[i], c); err != nil {
+			b.Fatal(err)
+		}
+		ids[i] = mustPutJob(b, js, queues[i%len(queues)], i, rand.Uint32N(1000))
+	}
+}
+
+func BenchmarkDisconnect(b *testing.B) {
+	js, queues, _ := fillJobServer(b, benchJobs)
+	c := js.Connect(nil)
+
+	for b.Loop() {
+		for range 10 {
+			mustGetJob(b, js, c, queues...)
+		}
+		js.Disconnect(c)
+		c = js.Connect(nil)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// requestTypes are the requests whose latency is measured.
+var requestTypes = []string{"get", "put", "abort", "delete", "heartbeat", "stats", "list-queue", "peek"}
+
+// latencyBuckets are the upper bounds of the latency histogram buckets, in
+// seconds.
+var latencyBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// histogram counts durations into latencyBuckets. It's safe for concurrent
+// use, so requests are observed without holding any shard.mu.
+type histogram struct {
+	buckets []atomic.Uint64 // by latencyBuckets, then +Inf; not cumulative
+	sum     atomic.Int64    // nanoseconds
+}
+
+func newHistogram() *histogram {
+	return &histogram{buckets: make([]atomic.Uint64, len(latencyBuckets)+1)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i, _ := slices.BinarySearch(latencyBuckets, d.Seconds())
+	h.buckets[i].Add(1)
+	h.sum.Add(int64(d))
+}
+
+// observe records how long a request that started at start took. It's
+// deferred by the operation serving it.
+func (js *JobServer) observe(request string, start time.Time) {
+	js.latency[request].observe(time.Since(start))
+}
+
+// serverTotals count what has been done across every client there has been.
+type serverTotals struct {
+	puts, gets, aborts, deletes, expired, deadLettered atomic.Int64
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// ServeMetrics writes the server's metrics in the Prometheus text format.
+func (js *JobServer) ServeMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	type depth struct {
+		queue                    string
+		ready, assigned, delayed int
+	}
+	byQueue := make(map[string]*depth)
+	queueDepth := func(queue string) *depth {
+		d, exists := byQueue[queue]
+		if !exists {
+			d = &depth{queue: queue}
+			byQueue[queue] = d
+		}
+		return d
+	}
+	for _, s := range js.shards {
+		s.mu.Lock()
+		for name, pq := range s.queue {
+			queueDepth(name).ready = len(*pq)
+		}
+		for _, job := range s.inflight {
+			queueDepth(job.queue).assigned++
+		}
+		for _, job := range s.due {
+			queueDepth(job.queue).delayed++
+		}
+		s.mu.Unlock()
+	}
+	depths := make([]depth, 0, len(byQueue))
+	for _, d := range byQueue {
+		depths = append(depths, *d)
+	}
+
+	js.clientsMu.Lock()
+	clients, waiting := len(js.clients), 0
+	for _, c := range js.clients {
+		c.mu.Lock()
+		waiting += len(c.waiting)
+		c.mu.Unlock()
+	}
+	js.clientsMu.Unlock()
+
+	slices.SortFunc(depths, func(a, b depth) int { return cmp.Compare(a.queue, b.queue) })
+	fmt.Fprintln(bw, "# HELP jobcenter_queue_jobs Jobs in each queue, by state.")
+	fmt.Fprintln(bw, "# TYPE jobcenter_queue_jobs gauge")
+	for _, d := range depths {
+		queue := labelEscaper.Replace(d.queue)
+		fmt.Fprintf(bw, "jobcenter_queue_jobs{queue=\"%s\",state=\"ready\"} %d\n", queue, d.ready)
+		fmt.Fprintf(bw, "jobcenter_queue_jobs{queue=\"%s\",state=\"assigned\"} %d\n", queue, d.assigned)
+		fmt.Fprintf(bw, "jobcenter_queue_jobs{queue=\"%s\",state=\"delayed\"} %d\n", queue, d.delayed)
+	}
+
+	counters := []struct {
+		name, help string
+		value      *atomic.Int64
+	}{
+		{"jobcenter_jobs_put_total", "Jobs put.", &js.totals.puts},
+		{"jobcenter_jobs_assigned_total", "Jobs assigned to a get.", &js.totals.gets},
+		{"jobcenter_jobs_aborted_total", "Jobs given back, including on disconnect.", &js.totals.aborts},
+		{"jobcenter_jobs_expired_total", "Jobs given back when their lease ran out.", &js.totals.expired},
+		{"jobcenter_jobs_deleted_total", "Jobs deleted.", &js.totals.deletes},
+		{"jobcenter_jobs_dead_lettered_total", "Jobs moved to the dead letter queue.", &js.totals.deadLettered},
+	}
+	for _, c := range counters {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.value.Load())
+	}
+
+	fmt.Fprintf(bw, "# HELP jobcenter_waiting_gets Gets blocked waiting for a job.\n# TYPE jobcenter_waiting_gets gauge\njobcenter_waiting_gets %d\n", waiting)
+	fmt.Fprintf(bw, "# HELP jobcenter_clients Connected clients.\n# TYPE jobcenter_clients gauge\njobcenter_clients %d\n", clients)
+
+	fmt.Fprintln(bw, "# HELP jobcenter_request_duration_seconds How long requests took, including time blocked.")
+	fmt.Fprintln(bw, "# TYPE jobcenter_request_duration_seconds histogram")
+	for _, request := range requestTypes {
+		h := js.latency[request]
+		var count uint64
+		for i, bound := range latencyBuckets {
+			count += h.buckets[i].Load()
+			fmt.Fprintf(bw, "jobcenter_request_duration_seconds_bucket{request=\"%s\",le=\"%s\"} %d\n",
+				request, strconv.FormatFloat(bound, 'g', -1, 64), count)
+		}
+		count += h.buckets[len(latencyBuckets)].Load()
+		fmt.Fprintf(bw, "jobcenter_request_duration_seconds_bucket{request=\"%s\",le=\"+Inf\"} %d\n", request, count)
+		fmt.Fprintf(bw, "jobcenter_request_duration_seconds_sum{request=\"%s\"} %s\n",
+			request, strconv.FormatFloat(time.Duration(h.sum.Load()).Seconds(), 'g', -1, 64))
+		fmt.Fprintf(bw, "jobcenter_request_duration_seconds_count{request=\"%s\"} %d\n", request, count)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scrape returns every sample /metrics serves, by name and labels.
+func scrape(t *testing.T, js *JobServer) map[string]float64 {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	js.ServeMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q, want the Prometheus text format", ct)
+	}
+
+	samples := make(map[string]float64)
+	for line := range strings.Lines(rec.Body.String()) {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		value, err := strconv.ParseFloat(strings.TrimSpace(line[i+1:]), 64)
+		if err != nil {
+			t.Fatalf("bad sample %q: %v", line, err)
+		}
+		samples[line[:i]] = value
+	}
+	return samples
+}
+
+func expectSamples(t *testing.T, samples map[string]float64, want map[string]float64) {
+	t.Helper()
+
+	for name, value := range want {
+		if got, exists := samples[name]; !exists || got != value {
+			t.Errorf("%s = %v, want %v", name, got, value)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	js := NewJobServer(nil, testShards)
+	js.maxDeliveries = 2
+	js.deadLetter = "dead"
+	alice, bob := js.Connect(nil), js.Connect(nil)
+
+	for range 3 {
+		mustPutJob(t, js, "q", "job", 1)
+	}
+	mustPutDelayed(t, js, "q", 1, time.Now().Add(time.Hour))
+	retried := mustPutJob(t, js, "retried", "job", 1)
+	deleted := mustGetJob(t, js, alice, "q")
+	if err := js.Delete(deleted, alice); err != nil {
+		t.Fatal(err)
+	}
+	mustGetJob(t, js, alice, "q")
+	for range 2 {
+		mustGetJob(t, js, bob, "retried")
+		if err := js.Abort(retried, bob); err != nil {
+			t.Fatal(err)
+		}
+	}
+	startGet(t, js, bob, 0, "empty", "other")
+
+	expectSamples(t, scrape(t, js), map[string]float64{
+		`jobcenter_queue_jobs{queue="q",state="ready"}`:              1,
+		`jobcenter_queue_jobs{queue="q",state="assigned"}`:           1,
+		`jobcenter_queue_jobs{queue="q",state="delayed"}`:            1,
+		`jobcenter_queue_jobs{queue="retried",state="ready"}`:        0,
+		`jobcenter_queue_jobs{queue="dead",state="ready"}`:           1,
+		`jobcenter_jobs_put_total`:                                   5,
+		`jobcenter_jobs_assigned_total`:                              4,
+		`jobcenter_jobs_aborted_total`:                               2,
+		`jobcenter_jobs_deleted_total`:                               1,
+		`jobcenter_jobs_dead_lettered_total`:                         1,
+		`jobcenter_waiting_gets`:                                     1,
+		`jobcenter_clients`:                                          2,
+		`jobcenter_request_duration_seconds_count{request="put"}`:    5,
+		`jobcenter_request_duration_seconds_count{request="get"}`:    4,
+		`jobcenter_request_duration_seconds_count{request="abort"}`:  2,
+		`jobcenter_request_duration_seconds_count{request="delete"}`: 1,
+		`jobcenter_request_duration_seconds_count{request="peek"}`:   0,
+	})
+
+	// Disconnecting gives back the jobs held, and cancels blocked gets
+	js.Disconnect(alice)
+	bob.Hangup()
+	waitFor(t, "blocked get to give up", func() bool {
+		return scrape(t, js)[`jobcenter_waiting_gets`] == 0
+	})
+	expectSamples(t, scrape(t, js), map[string]float64{
+		`jobcenter_queue_jobs{queue="q",state="ready"}`:           2,
+		`jobcenter_jobs_aborted_total`:                            3,
+		`jobcenter_clients`:                                       1,
+		`jobcenter_request_duration_seconds_count{request="get"}`: 5,
+	})
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	js := NewJobServer(nil, testShards)
+	h := js.latency["get"]
+	for _, d := range []time.Duration{50 * time.Microsecond, time.Millisecond, 3 * time.Millisecond, time.Hour} {
+		h.observe(d)
+	}
+
+	expectSamples(t, scrape(t, js), map[string]float64{
+		`jobcenter_request_duration_seconds_bucket{request="get",le="0.0001"}`: 1,
+		`jobcenter_request_duration_seconds_bucket{request="get",le="0.001"}`:  2,
+		`jobcenter_request_duration_seconds_bucket{request="get",le="0.0025"}`: 2,
+		`jobcenter_request_duration_seconds_bucket{request="get",le="0.005"}`:  3,
+		`jobcenter_request_duration_seconds_bucket{request="get",le="60"}`:     3,
+		`jobcenter_request_duration_seconds_bucket{request="get",le="+Inf"}`:   4,
+		`jobcenter_request_duration_seconds_sum{request="get"}`:                3600.00405,
+		`jobcenter_request_duration_seconds_count{request="get"}`:              4,
+	})
+}
+
+func TestMetricsEscapeQueueNames(t *testing.T) {
+	js := NewJobServer(nil, testShards)
+	mustPutJob(t, js, "a \"quoted\"\\queue\n", "job", 1)
+
+	expectSamples(t, scrape(t, js), map[string]float64{
+		`jobcenter_queue_jobs{queue="a \"quoted\"\\queue\n",state="ready"}`: 1,
+	})
+}
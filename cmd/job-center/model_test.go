@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+// modelJob is a job as the reference model sees it.
+type modelJob struct {
+	queue      string
+	pri        uint32
+	owner      int // the client holding it, or -1
+	deliveries int
+}
+
+// model is a reference for what the job server should do: a flat set of
+// jobs, searched in full on every get.
+type model struct {
+	jobs          map[uint64]*modelJob
+	lastID        uint64
+	maxDeliveries int
+	deadLetter    string
+}
+
+func (m *model) put(queue string, pri uint32) uint64 {
+	m.lastID++
+	m.jobs[m.lastID] = &modelJob{queue: queue, pri: pri, owner: -1}
+	return m.lastID
+}
+
+// get assigns client the unassigned job in queues with the highest priority,
+// put first among equals.
+func (m *model) get(queues []string, client int) (uint64, bool) {
+	var best uint64
+	for id, job := range m.jobs {
+		if job.owner >= 0 || !slices.Contains(queues, job.queue) {
+			continue
+		}
+		if best == 0 || job.pri > m.jobs[best].pri || job.pri == m.jobs[best].pri && id < best {
+			best = id
+		}
+	}
+	if best == 0 {
+		return 0, false
+	}
+	m.jobs[best].owner = client
+	m.jobs[best].deliveries++
+	return best, true
+}
+
+func (m *model) abort(id uint64, client int) bool {
+	job, exists := m.jobs[id]
+	if !exists || job.owner != client {
+		return false
+	}
+	job.owner = -1
+	if m.maxDeliveries > 0 && job.deliveries >= m.maxDeliveries && job.queue != m.deadLetter {
+		job.queue = m.deadLetter
+		job.deliveries = 0
+	}
+	return true
+}
+
+func (m *model) delete(id uint64) bool {
+	_, exists := m.jobs[id]
+	delete(m.jobs, id)
+	return exists
+}
+
+func (m *model) disconnect(client int) {
+	for id, job := range m.jobs {
+		if job.owner == client {
+			m.abort(id, client)
+		}
+	}
+}
+
+// ready returns the ids of the unassigned jobs in each queue, sorted.
+func (m *model) ready() map[string][]uint64 {
+	ready := make(map[string][]uint64)
+	for _, id := range slices.Sorted(maps.Keys(m.jobs)) {
+		if job := m.jobs[id]; job.owner < 0 {
+			ready[job.queue] = append(ready[job.queue], id)
+		}
+	}
+	return ready
+}
+
+// held returns the ids of the jobs client holds, sorted.
+func (m *model) held(client int) []uint64 {
+	var held []uint64
+	for id, job := range m.jobs {
+		if job.owner == client {
+			held = append(held, id)
+		}
+	}
+	slices.Sort(held)
+	return held
+}
+
+// TestOperationsMatchModel runs random sequences of puts, gets, aborts,
+// deletes and disconnects against a server and the model, checking they give
+// the same results and end up holding the same jobs after every step.
+func TestOperationsMatchModel(t *testing.T) {
+	for seed := range uint64(200) {
+		checkAgainstModel(t, seed, 300)
+		if t.Failed() {
+			return
+		}
+	}
+}
+
+func checkAgainstModel(t *testing.T, seed uint64, steps int) {
+	t.Helper()
+
+	rng := rand.New(rand.NewPCG(seed, 0))
+	queues := []string{"a", "b", "q1", "q2", "dead"}
+	js := NewJobServer(nil, testShards)
+	m := &model{jobs: make(map[uint64]*modelJob), deadLetter: "dead"}
+	if seed%2 == 1 {
+		js.maxDeliveries, m.maxDeliveries = 2, 2
+	}
+	js.deadLetter = "dead"
+	clients := []*Client{js.Connect(nil), js.Connect(nil), js.Connect(nil)}
+
+	for step := range steps {
+		i := rng.IntN(len(clients))
+		c := clients[i]
+		fail := func(format string, args ...any) {
+			t.Helper()
+			t.Errorf("seed %d, step %d, client %d: %s", seed, step, i, fmt.Sprintf(format, args...))
+		}
+
+		// Aborts and deletes mostly name a job the client holds, but
+		// sometimes any id at all, including ones that don't exist
+		id := uint64(rng.IntN(int(m.lastID) + 2))
+		if held := m.held(i); len(held) > 0 && rng.IntN(2) == 0 {
+			id = held[rng.IntN(len(held))]
+		}
+
+		switch op := rng.IntN(20); {
+		case op < 6:
+			queue, pri := queues[rng.IntN(len(queues)-1)], rng.Uint32N(4)
+			got, err := js.Put(queue, "job", pri, time.Time{}, c)
+			if want := m.put(queue, pri); err != nil || got != want {
+				fail("put(%s, %d) = %d, %v, want %d", queue, pri, got, err, want)
+			}
+		case op < 12:
+			wanted := []string{queues[rng.IntN(len(queues))], queues[rng.IntN(len(queues))]}
+			want, ok := m.get(wanted, i)
+			job, _, err := js.Get(wanted, GetOptions{}, c)
+			switch {
+			case !ok && err != errNoJob:
+				fail("get(%v) = %+v, %v, want no job", wanted, job, err)
+			case ok && (err != nil || job.id != want):
+				fail("get(%v) = %+v, %v, want job %d", wanted, job, err, want)
+			}
+		case op < 15:
+			err := js.Abort(id, c)
+			if want := m.abort(id, i); (err == nil) != want {
+				fail("abort(%d) = %v, want success %v", id, err, want)
+			}
+		case op < 19:
+			err := js.Delete(id, c)
+			if want := m.delete(id); (err == nil) != want {
+				fail("delete(%d) = %v, want success %v", id, err, want)
+			}
+		default:
+			js.Disconnect(c)
+			m.disconnect(i)
+			clients[i] = js.Connect(nil)
+		}
+
+		if got, want := readyJobs(js), m.ready(); !reflect.DeepEqual(got, want) && !(len(got) == 0 && len(want) == 0) {
+			fail("ready jobs %v, want %v", got, want)
+		}
+		inflight := 0
+		for i, c := range clients {
+			held := slices.Sorted(maps.Keys(c.held))
+			if want := m.held(i); !slices.Equal(held, want) {
+				fail("client %d holds %v, want %v", i, held, want)
+			}
+			inflight += len(held)
+		}
+		if got := sumShards(js, func(s *shard) int { return len(s.inflight) }); got != inflight {
+			fail("%d jobs in flight, want %d", got, inflight)
+		}
+		if t.Failed() {
+			return
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"log"
+	"time"
+)
+
+// dueQueue is a min heap of delayed jobs by the time they fall due.
+type dueQueue []*JobItem
+
+func (dq dueQueue) Len() int {
+	return len(dq)
+}
+
+func (dq dueQueue) Less(i int, j int) bool {
+	return dq[i].notBefore.Before(dq[j].notBefore)
+}
+
+func (dq dueQueue) Swap(i int, j int) {
+	dq[i], dq[j] = dq[j], dq[i]
+	dq[i].dueIndex = i
+	dq[j].dueIndex = j
+}
+
+func (dq *dueQueue) Push(x any) {
+	item := x.(*JobItem)
+	item.dueIndex = len(*dq)
+	*dq = append(*dq, item)
+}
+
+func (dq *dueQueue) Pop() any {
+	old := *dq
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	item.dueIndex = -1
+	*dq = old[0 : n-1]
+	return item
+}
+
+// delay holds back a job that has just been put until job.notBefore, waking
+// the scheduler if it is now the first due in its shard s.
+func (js *JobServer) delay(s *shard, job *JobItem) {
+	job.state = "delayed"
+	heap.Push(&s.due, job)
+	if job.dueIndex == 0 {
+		select {
+		case js.rescheduled <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// promote makes every delayed job that is due by now ready, handing them to
+// waiting gets, and returns when the next one falls due, or the zero time if
+// there are none.
+func (js *JobServer) promote(now time.Time) time.Time {
+	if next := js.nextDue(); next.IsZero() || next.After(now) {
+		return next
+	}
+
+	// Make them all ready before handing any out, so gets see every job
+	// that fell due at once and take the best of them, whichever shards
+	// they're in
+	unlock := js.lockAll()
+	defer unlock()
+
+	var queues []string
+	var next time.Time
+	for _, s := range js.shards {
+		for len(s.due) > 0 && !s.due[0].notBefore.After(now) {
+			job := heap.Pop(&s.due).(*JobItem)
+			s.push(job)
+			log.Println("Job", job.id, "in queue", job.queue, "is due")
+			queues = append(queues, job.queue)
+		}
+		if len(s.due) > 0 && (next.IsZero() || s.due[0].notBefore.Before(next)) {
+			next = s.due[0].notBefore
+		}
+	}
+	for _, queue := range queues {
+		js.handoff(nil, queue)
+	}
+	return next
+}
+
+// nextDue returns when the first delayed job falls due, or the zero time if
+// there are none. It locks the shards one at a time, so is cheap when
+// nothing is due yet.
+func (js *JobServer) nextDue() time.Time {
+	var next time.Time
+	for _, s := range js.shards {
+		s.mu.Lock()
+		if len(s.due) > 0 && (next.IsZero() || s.due[0].notBefore.Before(next)) {
+			next = s.due[0].notBefore
+		}
+		s.mu.Unlock()
+	}
+	return next
+}
+
+// Schedule makes delayed jobs ready as they fall due, until ctx is done. It
+// sleeps until the next one is due rather than polling.
+func (js *JobServer) Schedule(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		case <-js.rescheduled:
+		}
+		if next := js.promote(time.Now()); !next.IsZero() {
+			timer.Reset(time.Until(next))
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func mustPutDelayed(t testing.TB, js *JobServer, queue string, pri uint32, notBefore time.Time) uint64 {
+	t.Helper()
+
+	c := js.Connect(nil)
+	defer js.Disconnect(c)
+	id, err := js.Put(queue, "delayed", pri, notBefore, c)
+	if err != nil {
+		t.Fatalf("Put(%s): %v", queue, err)
+	}
+	return id
+}
+
+func TestPutRequestDue(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tests := []struct {
+		delay     uint64
+		notBefore int64
+		want      time.Time
+	}{
+		{0, 0, time.Time{}},
+		{1500, 0, time.Unix(1001, 5e8)},
+		{0, 2000, time.Unix(2000, 0)},
+		{0, 10, time.Unix(10, 0)},
+		{5000, 1002, time.Unix(1005, 0)},
+		{1000, 1003, time.Unix(1003, 0)},
+	}
+	for _, tt := range tests {
+		req := PutRequest{Delay: tt.delay, NotBefore: tt.notBefore}
+		if got := req.due(now); !got.Equal(tt.want) {
+			t.Errorf("due(delay %d, not_before %d) = %v, want %v", tt.delay, tt.notBefore, got, tt.want)
+		}
+	}
+}
+
+func TestDelayedJobIsHiddenUntilDue(t *testing.T) {
+	js := NewJobServer(nil, testShards)
+	c := js.Connect(nil)
+	now := time.Now()
+
+	delayed := mustPutDelayed(t, js, "q", 10, now.Add(time.Hour))
+	ready := mustPutJob(t, js, "q", "ready", 1)
+	// A not_before in the past is no delay at all
+	past := mustPutDelayed(t, js, "q", 2, now.Add(-time.Hour))
+
+	if id := mustGetJob(t, js, c, "q"); id != past {
+		t.Errorf("first get = job %d, want %d", id, past)
+	}
+	if id := mustGetJob(t, js, c, "q"); id != ready {
+		t.Errorf("second get = job %d, want %d", id, ready)
+	}
+	if _, _, err := js.Get([]string{"q"}, GetOptions{}, c); err != errNoJob {
+		t.Errorf("get with only a delayed job left = %v, want %v", err, errNoJob)
+	}
+
+	if next := js.promote(now); !next.Equal(now.Add(time.Hour)) {
+		t.Errorf("promote before due = next %v, want %v", next, now.Add(time.Hour))
+	}
+	if next := js.promote(now.Add(2 * time.Hour)); !next.IsZero() {
+		t.Errorf("promote after due = next %v, want none", next)
+	}
+	if id := mustGetJob(t, js, c, "q"); id != delayed {
+		t.Errorf("get once due = job %d, want %d", id, delayed)
+	}
+}
+
+func TestJobsFallingDueTogetherKeepPriority(t *testing.T) {
+	js := NewJobServer(nil, testShards)
+	now := time.Now()
+
+	mustPutDelayed(t, js, "a", 1, now.Add(time.Minute))
+	b := mustPutDelayed(t, js, "b", 5, now.Add(time.Minute+time.Millisecond))
+	mustPutDelayed(t, js, "a", 3, now.Add(time.Minute+2*time.Millisecond))
+
+	// The waiter is on both queues, and the best job of those due goes to it
+	// even though another fell due first
+	waiting := startGet(t, js, js.Connect(nil), 0, "a", "b")
+	js.promote(now.Add(time.Hour))
+	expectJob(t, waiting, b)
+
+	c := js.Connect(nil)
+	var pris []uint32
+	for range 2 {
+		job, _, err := js.Get([]string{"a", "b"}, GetOptions{}, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pris = append(pris, job.pri)
+	}
+	if want := []uint32{3, 1}; !reflect.DeepEqual(pris, want) {
+		t.Errorf("got priorities %v, want %v", pris, want)
+	}
+}
+
+func TestScheduleWakesWaiterWhenDue(t *testing.T) {
+	js := NewJobServer(nil, testShards)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go js.Schedule(ctx)
+
+	waiting := startGet(t, js, js.Connect(nil), 0, "q")
+	start := time.Now()
+	mustPutDelayed(t, js, "q", 1, start.Add(time.Hour))
+	// Due sooner than the job the scheduler is already sleeping until
+	id := mustPutDelayed(t, js, "q", 1, start.Add(30*time.Millisecond))
+
+	expectJob(t, waiting, id)
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("job handed out after %v, before it was due", elapsed)
+	}
+}
+
+func TestDelayedJobsSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	js, journal := openJobServer(t, dir)
+	c := js.Connect(nil)
+	now := time.Now()
+
+	inAnHour := mustPutDelayed(t, js, "q", 1, now.Add(time.Hour))
+	inTwoHours := mustPutDelayed(t, js, "q", 1, now.Add(2*time.Hour))
+	deleted := mustPutDelayed(t, js, "q", 1, now.Add(time.Minute))
+	if err := js.Delete(deleted, c); err != nil {
+		t.Fatal(err)
+	}
+	if err := js.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	due := mustPutDelayed(t, js, "q", 1, now.Add(10*time.Millisecond))
+	journal.Close()
+
+	time.Sleep(20 * time.Millisecond)
+	js, _ = openJobServer(t, dir)
+	if got, want := readyJobs(js), map[string][]uint64{"q": {due}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ready jobs after restart %v, want %v", got, want)
+	}
+	if due := sumShards(js, func(s *shard) int { return len(s.due) }); due != 2 {
+		t.Errorf("%d jobs delayed after restart, want %d and %d", due, inAnHour, inTwoHours)
+	}
+	js.promote(now.Add(3 * time.Hour))
+	if got, want := readyJobs(js), map[string][]uint64{"q": {inAnHour, inTwoHours, due}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ready jobs once due %v, want %v", got, want)
+	}
+}
+
+func TestPutDelayField(t *testing.T) {
+	js := NewJobServer(nil, testShards)
+	conn, _ := serve(t, js)
+
+	conn.Write([]byte(`{"request":"put","queue":"q","job":1,"pri":1,"delay":60000}` + "\n" +
+		`{"request":"get","queues":["q"]}` + "\n"))
+	expectResponses(t, bufio.NewReader(conn),
+		map[string]any{"status": "ok", "id": 1.0},
+		map[string]any{"status": "no-job"},
+	)
+}
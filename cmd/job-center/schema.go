@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+var errInvalidJob = errors.New("job doesn't match its queue's schema")
+
+// Schema is a JSON Schema the jobs put in a queue must match. Only the
+// keywords in schemaKeywords are supported, and a schema using any other,
+// such as $ref, fails to load rather than going unenforced.
+type Schema struct {
+	schemaKeywords
+	never    bool // the false schema, which nothing matches
+	constant any  // Const, decoded
+	pattern  *regexp.Regexp
+}
+
+type schemaKeywords struct {
+	Type  schemaTypes     `json:"type"`
+	Enum  []any           `json:"enum"`
+	Const json.RawMessage `json:"const"`
+
+	Minimum          *float64 `json:"minimum"`
+	Maximum          *float64 `json:"maximum"`
+	ExclusiveMinimum *float64 `json:"exclusiveMinimum"`
+	ExclusiveMaximum *float64 `json:"exclusiveMaximum"`
+
+	MinLength *int   `json:"minLength"`
+	MaxLength *int   `json:"maxLength"`
+	Pattern   string `json:"pattern"` // RE2 syntax
+
+	Items    *Schema `json:"items"`
+	MinItems *int    `json:"minItems"`
+	MaxItems *int    `json:"maxItems"`
+
+	Properties           map[string]*Schema `json:"properties"`
+	Required             []string           `json:"required"`
+	AdditionalProperties *Schema            `json:"additionalProperties"`
+
+	AllOf []*Schema `json:"allOf"`
+	AnyOf []*Schema `json:"anyOf"`
+	OneOf []*Schema `json:"oneOf"`
+	Not   *Schema   `json:"not"`
+
+	// Annotations, which don't affect validation
+	Dialect     json.RawMessage `json:"$schema"`
+	ID          json.RawMessage `json:"$id"`
+	Comment     json.RawMessage `json:"$comment"`
+	Title       json.RawMessage `json:"title"`
+	Description json.RawMessage `json:"description"`
+	Default     json.RawMessage `json:"default"`
+	Examples    json.RawMessage `json:"examples"`
+}
+
+func (s *Schema) UnmarshalJSON(data []byte) error {
+	switch string(bytes.TrimSpace(data)) {
+	case "true":
+		return nil
+	case "false":
+		s.never = true
+		return nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&s.schemaKeywords); err != nil {
+		return err
+	}
+	if len(s.Const) > 0 {
+		if err := json.Unmarshal(s.Const, &s.constant); err != nil {
+			return err
+		}
+	}
+	if s.Pattern != "" {
+		pattern, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("bad pattern: %w", err)
+		}
+		s.pattern = pattern
+	}
+	return nil
+}
+
+// schemaTypes is the type keyword, either one type name or a list of them.
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*t = schemaTypes{name}
+	} else if err := json.Unmarshal(data, (*[]string)(t)); err != nil {
+		return err
+	}
+	for _, name := range *t {
+		switch name {
+		case "null", "boolean", "object", "array", "number", "integer", "string":
+		default:
+			return fmt.Errorf("unknown type %q", name)
+		}
+	}
+	return nil
+}
+
+// LoadSchemas reads the JSON file at path, an object mapping queue names to
+// the schemas jobs put in them must match.
+func LoadSchemas(path string) (map[string]*Schema, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+	schemas := make(map[string]*Schema, len(raw))
+	for queue, data := range raw {
+		var schema Schema
+		if err := json.Unmarshal(data, &schema); err != nil {
+			return nil, fmt.Errorf("bad schema for queue %q in %s: %w", queue, path, err)
+		}
+		schemas[queue] = &schema
+	}
+	return schemas, nil
+}
+
+// Validate returns an error saying where job, as decoded from JSON, first
+// fails to match s, or nil if it matches.
+func (s *Schema) Validate(job any) error {
+	return s.validate(job, "job")
+}
+
+func (s *Schema) validate(v any, path string) error {
+	if s.never {
+		return fmt.Errorf("%s is not allowed", path)
+	}
+	if len(s.Type) > 0 && !slices.ContainsFunc(s.Type, func(t string) bool { return hasType(v, t) }) {
+		return fmt.Errorf("%s is %s, want %s", path, typeOf(v), strings.Join(s.Type, " or "))
+	}
+	if s.Enum != nil && !slices.ContainsFunc(s.Enum, func(e any) bool { return reflect.DeepEqual(v, e) }) {
+		return fmt.Errorf("%s is not one of the allowed values", path)
+	}
+	if len(s.Const) > 0 && !reflect.DeepEqual(v, s.constant) {
+		return fmt.Errorf("%s is not %s", path, s.Const)
+	}
+
+	switch v := v.(type) {
+	case float64:
+		switch {
+		case s.Minimum != nil && v < *s.Minimum:
+			return fmt.Errorf("%s is %v, want at least %v", path, v, *s.Minimum)
+		case s.Maximum != nil && v > *s.Maximum:
+			return fmt.Errorf("%s is %v, want at most %v", path, v, *s.Maximum)
+		case s.ExclusiveMinimum != nil && v <= *s.ExclusiveMinimum:
+			return fmt.Errorf("%s is %v, want more than %v", path, v, *s.ExclusiveMinimum)
+		case s.ExclusiveMaximum != nil && v >= *s.ExclusiveMaximum:
+			return fmt.Errorf("%s is %v, want less than %v", path, v, *s.ExclusiveMaximum)
+		}
+	case string:
+		n := utf8.RuneCountInString(v)
+		switch {
+		case s.MinLength != nil && n < *s.MinLength:
+			return fmt.Errorf("%s is %d characters, want at least %d", path, n, *s.MinLength)
+		case s.MaxLength != nil && n > *s.MaxLength:
+			return fmt.Errorf("%s is %d characters, want at most %d", path, n, *s.MaxLength)
+		case s.pattern != nil && !s.pattern.MatchString(v):
+			return fmt.Errorf("%s doesn't match %s", path, s.Pattern)
+		}
+	case []any:
+		switch {
+		case s.MinItems != nil && len(v) < *s.MinItems:
+			return fmt.Errorf("%s has %d items, want at least %d", path, len(v), *s.MinItems)
+		case s.MaxItems != nil && len(v) > *s.MaxItems:
+			return fmt.Errorf("%s has %d items, want at most %d", path, len(v), *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				if err := s.Items.validate(item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]any:
+		for _, name := range s.Required {
+			if _, exists := v[name]; !exists {
+				return fmt.Errorf("%s.%s is required", path, name)
+			}
+		}
+		for _, name := range slices.Sorted(maps.Keys(v)) {
+			property, exists := s.Properties[name]
+			if !exists {
+				property = s.AdditionalProperties
+			}
+			if property == nil {
+				continue
+			}
+			if err := property.validate(v[name], path+"."+name); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, sub := range s.AllOf {
+		if err := sub.validate(v, path); err != nil {
+			return err
+		}
+	}
+	if s.AnyOf != nil && !slices.ContainsFunc(s.AnyOf, func(sub *Schema) bool { return sub.validate(v, path) == nil }) {
+		return fmt.Errorf("%s matches none of anyOf", path)
+	}
+	if s.OneOf != nil {
+		matches := 0
+		for _, sub := range s.OneOf {
+			if sub.validate(v, path) == nil {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return fmt.Errorf("%s matches %d of oneOf, want exactly 1", path, matches)
+		}
+	}
+	if s.Not != nil && s.Not.validate(v, path) == nil {
+		return fmt.Errorf("%s matches a schema it must not", path)
+	}
+	return nil
+}
+
+func hasType(v any, t string) bool {
+	if n, ok := v.(float64); ok && t == "integer" {
+		return n == math.Trunc(n)
+	}
+	return typeOf(v) == t
+}
+
+// typeOf returns the JSON Schema type of v, as decoded from JSON.
+func typeOf(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	default:
+		return "object"
+	}
+}
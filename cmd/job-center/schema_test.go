@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustSchema(t *testing.T, data string) *Schema {
+	t.Helper()
+
+	var schema Schema
+	if err := json.Unmarshal([]byte(data), &schema); err != nil {
+		t.Fatalf("bad schema %s: %v", data, err)
+	}
+	return &schema
+}
+
+func TestSchemaValidate(t *testing.T) {
+	email := `{
+		"type": "object",
+		"required": ["to", "subject"],
+		"properties": {
+			"to": {"type": "string", "pattern": "^[^@]+@[^@]+$"},
+			"subject": {"type": "string", "maxLength": 10},
+			"cc": {"type": "array", "items": {"type": "string"}, "maxItems": 2},
+			"attempts": {"type": "integer", "minimum": 1}
+		},
+		"additionalProperties": false
+	}`
+	tests := []struct {
+		schema, job string
+		want        string // the error, or "" if it matches
+	}{
+		{email, `{"to":"a@b","subject":"hi"}`, ""},
+		{email, `{"to":"a@b","subject":"hi","cc":["c@d"],"attempts":3}`, ""},
+		{email, `"a@b"`, "job is string, want object"},
+		{email, `{"to":"a@b"}`, "job.subject is required"},
+		{email, `{"to":1,"subject":"hi"}`, "job.to is number, want string"},
+		{email, `{"to":"nobody","subject":"hi"}`, "job.to doesn't match ^[^@]+@[^@]+$"},
+		{email, `{"to":"a@b","subject":"¡hola, qué tal!"}`, "job.subject is 15 characters, want at most 10"},
+		{email, `{"to":"a@b","subject":"hi","cc":["c@d",2]}`, "job.cc[1] is number, want string"},
+		{email, `{"to":"a@b","subject":"hi","cc":["a","b","c"]}`, "job.cc has 3 items, want at most 2"},
+		{email, `{"to":"a@b","subject":"hi","attempts":1.5}`, "job.attempts is number, want integer"},
+		{email, `{"to":"a@b","subject":"hi","attempts":0}`, "job.attempts is 0, want at least 1"},
+		{email, `{"to":"a@b","subject":"hi","bcc":"c@d"}`, "job.bcc is not allowed"},
+		{`true`, `null`, ""},
+		{`false`, `null`, "job is not allowed"},
+		{`{"type":["string","null"]}`, `null`, ""},
+		{`{"enum":["low","high",1]}`, `1`, ""},
+		{`{"enum":["low","high",1]}`, `"medium"`, "job is not one of the allowed values"},
+		{`{"const":{"v":1}}`, `{"v":2}`, `job is not {"v":1}`},
+		{`{"exclusiveMaximum":10}`, `10`, "job is 10, want less than 10"},
+		{`{"anyOf":[{"type":"string"},{"minimum":5}]}`, `6`, ""},
+		{`{"anyOf":[{"type":"string"},{"minimum":5}]}`, `4`, "job matches none of anyOf"},
+		{`{"oneOf":[{"type":"number"},{"minimum":5}]}`, `6`, "job matches 2 of oneOf, want exactly 1"},
+		{`{"not":{"type":"null"}}`, `null`, "job matches a schema it must not"},
+	}
+	for _, tt := range tests {
+		var job any
+		if err := json.Unmarshal([]byte(tt.job), &job); err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if err := mustSchema(t, tt.schema).Validate(job); err != nil {
+			got = err.Error()
+		}
+		if got != tt.want {
+			t.Errorf("Validate(%s) = %q, want %q", tt.job, got, tt.want)
+		}
+	}
+}
+
+func TestLoadSchemas(t *testing.T) {
+	dir := t.TempDir()
+	load := func(data string) (map[string]*Schema, error) {
+		path := filepath.Join(dir, "schemas.json")
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return LoadSchemas(path)
+	}
+
+	schemas, err := load(`{"q": {"$schema": "https://json-schema.org/draft/2020-12/schema", "title": "Q", "type": "object"}, "any": true}`)
+	if err != nil {
+		t.Fatalf("LoadSchemas: %v", err)
+	}
+	if len(schemas) != 2 || schemas["q"].Validate(1.0) == nil || schemas["any"].Validate(1.0) != nil {
+		t.Errorf("LoadSchemas = %v, want q requiring an object and any allowing anything", schemas)
+	}
+
+	// Schemas that wouldn't be enforced as written are refused
+	for _, data := range []string{
+		`{"q": {"$ref": "#/$defs/job"}}`,
+		`{"q": {"properties": {"n": {"type": "int"}}}}`,
+		`{"q": {"pattern": "("}}`,
+		`{"q": 1}`,
+		`[]`,
+	} {
+		if _, err := load(data); err == nil {
+			t.Errorf("LoadSchemas(%s) succeeded, want an error", data)
+		} else if data != `[]` && !strings.Contains(err.Error(), `queue "q"`) {
+			t.Errorf("LoadSchemas(%s) = %v, want it to name the queue", data, err)
+		}
+	}
+}
+
+func TestPutChecksSchema(t *testing.T) {
+	js := NewJobServer(nil, testShards)
+	js.schemas = map[string]*Schema{"q": mustSchema(t, `{"type":"object","required":["n"]}`)}
+	c := js.Connect(nil)
+
+	if _, err := js.Put("q", map[string]any{}, 1, time.Time{}, c); !errors.Is(err, errInvalidJob) {
+		t.Errorf("Put of a job without n = %v, want %v", err, errInvalidJob)
+	}
+	mustPutJob(t, js, "q", map[string]any{"n": 1.0}, 1)
+	mustPutJob(t, js, "other", "anything", 1)
+	if got := sumShards(js, func(s *shard) int { return len(s.jobs) }); got != 2 {
+		t.Errorf("%d jobs, want 2", got)
+	}
+
+	conn, _ := serve(t, js)
+	conn.Write([]byte(`{"request":"put","queue":"q","job":{"m":1},"pri":1}` + "\n"))
+	expectResponses(t, bufio.NewReader(conn), map[string]any{
+		"status": "error",
+		"error":  "job doesn't match its queue's schema: job.n is required",
+	})
+}
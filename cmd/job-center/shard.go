@@ -0,0 +1,179 @@
+package main
+
+import (
+	"container/heap"
+	"container/list"
+	"slices"
+	"sync"
+)
+
+// shard holds some of the queues, with their wait lists and jobs, and the
+// leases and delays of those jobs. Its lock guards all of that, including the
+// fields of the jobs, so operations on queues in different shards don't
+// contend. Shards are locked in index order, and before any Client.mu.
+type shard struct {
+	mu       sync.Mutex
+	queue    map[string]*PriorityQueue // queue name -> priority queue
+	jobs     map[uint64]*JobItem       // id -> job, in whichever of its queues
+	inflight map[uint64]*JobItem       // id -> assigned job, out of its queue
+	waiting  map[string]*list.List     // queue name -> gets blocked on it, oldest first
+	leases   leaseQueue                // leased jobs, soonest to expire first
+	due      dueQueue                  // delayed jobs, soonest due first
+}
+
+func newShard() *shard {
+	return &shard{
+		queue:    make(map[string]*PriorityQueue),
+		jobs:     make(map[uint64]*JobItem),
+		inflight: make(map[uint64]*JobItem),
+		waiting:  make(map[string]*list.List),
+	}
+}
+
+// push makes a job ready, adding it to its queue.
+func (s *shard) push(job *JobItem) {
+	pq, exists := s.queue[job.queue]
+	if !exists {
+		pq = &PriorityQueue{}
+		s.queue[job.queue] = pq
+	}
+	job.state = "ready"
+	heap.Push(pq, job)
+}
+
+// jobsIn returns every job in queue, whether ready, assigned or delayed.
+func (s *shard) jobsIn(queue string) []*JobItem {
+	var jobs []*JobItem
+	if pq, exists := s.queue[queue]; exists {
+		jobs = append(jobs, *pq...)
+	}
+	for _, job := range s.inflight {
+		if job.queue == queue {
+			jobs = append(jobs, job)
+		}
+	}
+	for _, job := range s.due {
+		if job.queue == queue {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs
+}
+
+// indexStripes is how many independently locked parts jobIndex is split
+// into.
+const indexStripes = 64
+
+// jobIndex maps job ids to the queues they are in, so a job can be found
+// without knowing its shard. It's striped by id, so operations in different
+// shards rarely contend on it.
+type jobIndex struct {
+	stripes [indexStripes]struct {
+		mu    sync.Mutex
+		queue map[uint64]string
+	}
+}
+
+func (x *jobIndex) load(id uint64) (string, bool) {
+	stripe := &x.stripes[id%indexStripes]
+	stripe.mu.Lock()
+	defer stripe.mu.Unlock()
+	queue, exists := stripe.queue[id]
+	return queue, exists
+}
+
+func (x *jobIndex) store(id uint64, queue string) {
+	stripe := &x.stripes[id%indexStripes]
+	stripe.mu.Lock()
+	defer stripe.mu.Unlock()
+	if stripe.queue == nil {
+		stripe.queue = make(map[uint64]string)
+	}
+	stripe.queue[id] = queue
+}
+
+func (x *jobIndex) delete(id uint64) {
+	stripe := &x.stripes[id%indexStripes]
+	stripe.mu.Lock()
+	defer stripe.mu.Unlock()
+	delete(stripe.queue, id)
+}
+
+// shardIndex returns the index of the shard holding queue, by its FNV-1a
+// hash.
+func (js *JobServer) shardIndex(queue string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(queue); i++ {
+		h ^= uint32(queue[i])
+		h *= 16777619
+	}
+	return int(h % uint32(len(js.shards)))
+}
+
+func (js *JobServer) shardOf(queue string) *shard {
+	return js.shards[js.shardIndex(queue)]
+}
+
+// lock locks the shards holding queues and returns a function that unlocks
+// them.
+func (js *JobServer) lock(queues ...string) func() {
+	if len(queues) == 1 {
+		s := js.shardOf(queues[0])
+		s.mu.Lock()
+		return s.mu.Unlock
+	}
+
+	indexes := make([]int, len(queues))
+	for i, queue := range queues {
+		indexes[i] = js.shardIndex(queue)
+	}
+	slices.Sort(indexes)
+	indexes = slices.Compact(indexes)
+	for _, i := range indexes {
+		js.shards[i].mu.Lock()
+	}
+	return func() {
+		for _, i := range indexes {
+			js.shards[i].mu.Unlock()
+		}
+	}
+}
+
+// lockAll locks every shard, for a consistent view of the whole server.
+func (js *JobServer) lockAll() func() {
+	for _, s := range js.shards {
+		s.mu.Lock()
+	}
+	return func() {
+		for _, s := range js.shards {
+			s.mu.Unlock()
+		}
+	}
+}
+
+// lockJob locks the shard holding job id, along with those holding queues,
+// and returns the job, or nil if there is none. The shards must be unlocked
+// either way.
+func (js *JobServer) lockJob(id uint64, queues ...string) (*JobItem, func()) {
+	for {
+		queue, exists := js.where.load(id)
+		if !exists {
+			return nil, func() {}
+		}
+		unlock := js.lock(append([]string{queue}, queues...)...)
+		if job := js.shardOf(queue).jobs[id]; job != nil {
+			return job, unlock
+		}
+		// Moved to the dead letter queue, or deleted, before it was locked
+		unlock()
+	}
+}
+
+// deadLetterQueues are the queues other than its own that requeue may move a
+// job to, whose shards must also be locked.
+func (js *JobServer) deadLetterQueues() []string {
+	if js.maxDeliveries > 0 {
+		return []string{js.deadLetter}
+	}
+	return nil
+}
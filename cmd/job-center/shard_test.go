@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGetTakesBestAcrossShards(t *testing.T) {
+	js := NewJobServer(nil, testShards)
+	c := js.Connect(nil)
+	if js.shardIndex("a") == js.shardIndex("b") {
+		t.Fatal("queues a and b share a shard")
+	}
+
+	mustPutJob(t, js, "a", "low", 1)
+	high := mustPutJob(t, js, "b", "high", 2)
+	if id := mustGetJob(t, js, c, "a", "b"); id != high {
+		t.Errorf("get on a and b = job %d, want %d", id, high)
+	}
+
+	// A waiter on both is handed a job from either
+	mustGetJob(t, js, c, "a")
+	waiting := startGet(t, js, js.Connect(nil), 0, "a", "b")
+	id := mustPutJob(t, js, "b", "job", 1)
+	expectJob(t, waiting, id)
+	if waiting := sumShards(js, func(s *shard) int { return len(s.waiting) }); waiting != 0 {
+		t.Errorf("wait lists left for %d queues, want none", waiting)
+	}
+}
+
+// TestConcurrentClients has clients put, get, abort and delete at once across
+// queues in every shard, checking that no job is lost or given out twice.
+func TestConcurrentClients(t *testing.T) {
+	js := NewJobServer(nil, testShards)
+	js.maxDeliveries = 3
+	js.deadLetter = "dead"
+	queues := []string{"a", "b", "q", "q1", "q2", "other"}
+
+	var puts, deletes atomic.Int64
+	var wg sync.WaitGroup
+	for range 32 {
+		wg.Go(func() {
+			c := js.Connect(nil)
+			defer js.Disconnect(c)
+			for range 200 {
+				if rand.N(2) == 0 {
+					if _, err := js.Put(queues[rand.N(len(queues))], "job", rand.N(uint32(10)), time.Time{}, c); err != nil {
+						t.Error(err)
+						return
+					}
+					puts.Add(1)
+				}
+				wanted := []string{queues[rand.N(len(queues))], queues[rand.N(len(queues))], "dead"}
+				job, _, err := js.Get(wanted, GetOptions{Wait: true, Timeout: time.Millisecond}, c)
+				if err == errNoJob {
+					continue
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if rand.N(2) == 0 {
+					err = js.Abort(job.id, c)
+				} else if err = js.Delete(job.id, c); err == nil {
+					deletes.Add(1)
+				}
+				if err != nil {
+					t.Errorf("job %d: %v", job.id, err)
+					return
+				}
+			}
+		})
+	}
+	wg.Wait()
+
+	ready := 0
+	for _, ids := range readyJobs(js) {
+		ready += len(ids)
+	}
+	if want := int(puts.Load() - deletes.Load()); ready != want {
+		t.Errorf("%d jobs ready, want %d put and not deleted", ready, want)
+	}
+	if jobs := sumShards(js, func(s *shard) int { return len(s.jobs) }); jobs != ready {
+		t.Errorf("%d jobs indexed, want %d", jobs, ready)
+	}
+	if waiting := sumShards(js, func(s *shard) int { return len(s.waiting) }); waiting != 0 {
+		t.Errorf("wait lists left for %d queues, want none", waiting)
+	}
+}
+
+// BenchmarkConcurrentClients has many clients putting, getting and deleting
+// jobs at once, each mostly in its own queue, with every queue in one shard
+// and spread across many.
+func BenchmarkConcurrentClients(b *testing.B) {
+	for _, clients := range []int{64, 256} {
+		for _, shards := range []int{1, 64} {
+			b.Run(fmt.Sprintf("clients=%d/shards=%d", clients, shards), func(b *testing.B) {
+				js := NewJobServer(nil, shards)
+				var next atomic.Int64
+				b.SetParallelism((clients + runtime.GOMAXPROCS(0) - 1) / runtime.GOMAXPROCS(0))
+				b.RunParallel(func(pb *testing.PB) {
+					i := next.Add(1)
+					c := js.Connect(nil)
+					defer js.Disconnect(c)
+					own, neighbour := fmt.Sprint("q", i), fmt.Sprint("q", i+1)
+					for pb.Next() {
+						if _, err := js.Put(own, "job", 1, time.Time{}, c); err != nil {
+							b.Error(err)
+							return
+						}
+						// The neighbour may have taken it
+						job, _, err := js.Get([]string{own, neighbour}, GetOptions{}, c)
+						if err == errNoJob {
+							continue
+						}
+						if err != nil {
+							b.Error(err)
+							return
+						}
+						if err := js.Delete(job.id, c); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				})
+			})
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// waiter is a get blocked until a job arrives in one of its queues. It sits
+// in the wait list of each of them, and is handed a job as soon as one
+// becomes ready in any. A waiter only exists while all its queues are empty
+// of ready jobs, so that job is also the best one it could have got.
+type waiter struct {
+	client *Client
+	queues []string
+	lease  time.Duration
+	elems  []*list.Element // its place in the wait list of each of queues
+
+	// Whoever claims it, a handoff in any of its queues or the get giving
+	// up, settles it. Its other wait list elements are left for the get to
+	// remove.
+	claimed atomic.Bool
+	ready   chan struct{} // closed once job and queue, or err, are set
+	job     *JobItem
+	queue   string
+	err     error
+}
+
+// wait adds a waiter for c on queues. Called with their shards locked.
+func (js *JobServer) wait(c *Client, queues []string, lease time.Duration) *waiter {
+	w := &waiter{
+		client: c,
+		queues: queues,
+		lease:  lease,
+		elems:  make([]*list.Element, len(queues)),
+		ready:  make(chan struct{}),
+	}
+	for i, queue := range queues {
+		s := js.shardOf(queue)
+		l, exists := s.waiting[queue]
+		if !exists {
+			l = list.New()
+			s.waiting[queue] = l
+		}
+		w.elems[i] = l.PushBack(w)
+	}
+	c.mu.Lock()
+	c.waiting[w] = struct{}{}
+	c.mu.Unlock()
+	return w
+}
+
+// unwait removes w from every wait list it is still in, locking each shard in
+// turn. Called with no shards locked.
+func (js *JobServer) unwait(w *waiter) {
+	for i, queue := range w.queues {
+		s := js.shardOf(queue)
+		s.mu.Lock()
+		if l, exists := s.waiting[queue]; exists {
+			l.Remove(w.elems[i])
+			if l.Len() == 0 {
+				delete(s.waiting, queue)
+			}
+		}
+		s.mu.Unlock()
+	}
+	w.client.mu.Lock()
+	delete(w.client.waiting, w)
+	w.client.mu.Unlock()
+}
+
+// handoff gives the ready jobs in queue, which have just become ready, to the
+// gets waiting on it, longest waiting first. Each takes the best job across
+// those of its queues in shard in, or across all of them if in is nil; with
+// only in locked, that is still the best it could have got, since ready jobs
+// in its other queues are being handed out under their own shard's lock.
+// Gets of clients that have gone are passed over; they remove themselves.
+// Called with the shard of queue locked, and every shard if in is nil.
+func (js *JobServer) handoff(in *shard, queue string) {
+	s := js.shardOf(queue)
+	l, exists := s.waiting[queue]
+	if !exists {
+		return
+	}
+	defer func() {
+		if l.Len() == 0 && s.waiting[queue] == l {
+			delete(s.waiting, queue)
+		}
+	}()
+
+	for e := l.Front(); e != nil; {
+		w, next := e.Value.(*waiter), e.Next()
+		if w.claimed.Load() {
+			l.Remove(e)
+			e = next
+			continue
+		}
+		if w.client.ctx.Err() != nil {
+			e = next
+			continue
+		}
+		job := js.best(w.queues, in)
+		if job == nil {
+			return
+		}
+		l.Remove(e)
+		e = next
+		if !w.claimed.CompareAndSwap(false, true) {
+			continue
+		}
+
+		if err := js.assign(job, w.client, w.lease); err != nil {
+			w.err = err
+			close(w.ready)
+			if errors.Is(err, errDisconnected) {
+				continue
+			}
+			return
+		}
+		w.job, w.queue = job, job.queue
+		close(w.ready)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"testing"
+	"time"
+)
+
+type getResult struct {
+	job *JobItem
+	err error
+}
+
+// startGet runs a waiting get for c in the background, returning once it is
+// blocked.
+func startGet(t testing.TB, js *JobServer, c *Client, timeout time.Duration, queues ...string) chan getResult {
+	t.Helper()
+
+	result := make(chan getResult, 1)
+	go func() {
+		job, _, err := js.Get(queues, GetOptions{Wait: true, Timeout: timeout}, c)
+		result <- getResult{job, err}
+	}()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		c.mu.Lock()
+		blocked := len(c.waiting) == 1
+		c.mu.Unlock()
+		if blocked {
+			return result
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("get on %v never blocked", queues)
+		}
+	}
+}
+
+func expectJob(t *testing.T, result chan getResult, id uint64) {
+	t.Helper()
+
+	select {
+	case r := <-result:
+		if r.err != nil || r.job.id != id {
+			t.Errorf("get = %+v, %v, want job %d", r.job, r.err, id)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("get still waiting, want job %d", id)
+	}
+}
+
+func expectStillWaiting(t *testing.T, result chan getResult) {
+	t.Helper()
+
+	select {
+	case r := <-result:
+		t.Errorf("get = %+v, %v, want it still waiting", r.job, r.err)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestJobsGoToEligibleWaitersInTurn(t *testing.T) {
+	js := NewJobServer(nil, testShards)
+	a := startGet(t, js, js.Connect(nil), 0, "q1")
+	b := startGet(t, js, js.Connect(nil), 0, "q2")
+	c := startGet(t, js, js.Connect(nil), 0, "q2", "q1")
+
+	id := mustPutJob(t, js, "q1", "one", 1)
+	expectJob(t, a, id)
+	expectStillWaiting(t, b)
+	expectStillWaiting(t, c)
+
+	id = mustPutJob(t, js, "q1", "two", 1)
+	expectJob(t, c, id)
+	expectStillWaiting(t, b)
+
+	id = mustPutJob(t, js, "q2", "three", 1)
+	expectJob(t, b, id)
+	if waiting := sumShards(js, func(s *shard) int { return len(s.waiting) }); waiting != 0 {
+		t.Errorf("wait lists left for %d queues, want none", waiting)
+	}
+}
+
+func TestAbortHandsJobToWaiter(t *testing.T) {
+	js := NewJobServer(nil, testShards)
+	alice, bob := js.Connect(nil), js.Connect(nil)
+
+	id := mustPutJob(t, js, "q", "job", 1)
+	mustGetJob(t, js, alice, "q")
+	waiting := startGet(t, js, bob, 0, "q")
+	if err := js.Abort(id, alice); err != nil {
+		t.Fatal(err)
+	}
+	expectJob(t, waiting, id)
+	if _, held := bob.held[id]; !held {
+		t.Errorf("bob does not hold job %d", id)
+	}
+}
+
+func TestGetTimesOut(t *testing.T) {
+	js := NewJobServer(nil, testShards)
+	c := js.Connect(nil)
+
+	start := time.Now()
+	job, _, err := js.Get([]string{"q"}, GetOptions{Wait: true, Timeout: 20 * time.Millisecond}, c)
+	if err != errNoJob {
+		t.Errorf("Get = %+v, %v, want %v", job, err, errNoJob)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("Get gave up after %v, want at least 20ms", elapsed)
+	}
+	if sumShards(js, func(s *shard) int { return len(s.waiting) }) != 0 || len(c.waiting) != 0 {
+		t.Errorf("timed out get still waiting")
+	}
+
+	// A job that is already there is returned straight away
+	id := mustPutJob(t, js, "q", "job", 1)
+	if job, _, err := js.Get([]string{"q"}, GetOptions{Wait: true, Timeout: time.Nanosecond}, c); err != nil || job.id != id {
+		t.Errorf("Get = %+v, %v, want job %d", job, err, id)
+	}
+}
+
+func TestHangupCancelsWaitingGet(t *testing.T) {
+	js := NewJobServer(nil, testShards)
+	c := js.Connect(nil)
+
+	result := startGet(t, js, c, 0, "q")
+	c.Hangup()
+	select {
+	case r := <-result:
+		if r.err != errDisconnected {
+			t.Errorf("get = %+v, %v, want %v", r.job, r.err, errDisconnected)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("get still waiting after hangup")
+	}
+	if _, _, err := js.Get([]string{"q"}, GetOptions{Wait: true}, c); err != errDisconnected {
+		t.Errorf("get after hangup = %v, want %v", err, errDisconnected)
+	}
+
+	id := mustPutJob(t, js, "q", "job", 1)
+	if got := readyJobs(js)["q"]; len(got) != 1 || got[0] != id {
+		t.Errorf("ready jobs %v, want [%d]", got, id)
+	}
+}
+
+func TestGetTimeoutField(t *testing.T) {
+	js := NewJobServer(nil, testShards)
+	conn, _ := serve(t, js)
+
+	conn.Write([]byte(`{"request":"get","queues":["q"],"wait":true,"timeout":10}` + "\n"))
+	expectResponses(t, bufio.NewReader(conn), map[string]any{"status": "no-job"})
+}
+
+// BenchmarkHandoff passes jobs from a producer to a waiting consumer while
+// many other clients wait on queues that never see a job. They should cost
+// nothing, since only waiters on a job's own queue are woken.
+func BenchmarkHandoff(b *testing.B) {
+	for _, idle := range []int{0, 1000} {
+		b.Run(fmt.Sprint("idle=", idle), func(b *testing.B) {
+			js := NewJobServer(nil, testShards)
+			for i := range idle {
+				c := js.Connect(nil)
+				startGet(b, js, c, 0, fmt.Sprint("idle-", i))
+				b.Cleanup(c.Hangup)
+			}
+			producer, consumer := js.Connect(nil), js.Connect(nil)
+
+			for b.Loop() {
+				result := make(chan getResult, 1)
+				go func() {
+					job, _, err := js.Get([]string{"work"}, GetOptions{Wait: true}, consumer)
+					result <- getResult{job, err}
+				}()
+				if _, err := js.Put("work", "job", 1, time.Time{}, producer); err != nil {
+					b.Fatal(err)
+				}
+				r := <-result
+				if r.err != nil {
+					b.Fatal(r.err)
+				}
+				if err := js.Delete(r.job.id, consumer); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -1,27 +1,23 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"flag"
-	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
 	"os/signal"
-	"strconv"
 	"strings"
 	"syscall"
 
 	"github.com/saurabh/protohackers/internal/logger"
+	"github.com/saurabh/protohackers/internal/lrcp"
 )
 
 var port = flag.String("port", "50001", "Port to listen on")
 
-type Session struct {
-	Id  int32
-	Pos int32
-}
-
 func main() {
 	flag.Parse()
 
@@ -32,13 +28,13 @@ func main() {
 	}
 	defer logFile.Close()
 
-	conn, err := net.ListenPacket("udp", ":"+*port)
+	ln, err := lrcp.Listen("udp", ":"+*port)
 	if err != nil {
 		panic(err)
 	}
-	defer conn.Close()
+	defer ln.Close()
 
-	log.Println("Listening for UDP packets on port " + *port)
+	log.Println("Listening for LRCP sessions on UDP port " + *port)
 
 	// Setup context for graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
@@ -52,86 +48,53 @@ func main() {
 		<-sigChan
 		log.Println("Shutting down gracefully...")
 		cancel()
-		conn.Close()
+		ln.Close()
 	}()
 
-	sessions := make(map[int32]Session)
-
-	buffer := make([]byte, 1024)
 	for {
-		n, addr, err := conn.ReadFrom(buffer)
+		conn, err := ln.Accept()
 		if err != nil {
 			select {
 			case <-ctx.Done():
 				log.Println("Server stopped")
 				return
 			default:
-				log.Println("Read error:", err)
+				log.Println("Accept error:", err)
 				continue
 			}
 		}
-		strbuf := string(buffer[:n])
-		log.Println("Received request:", strbuf)
-		if strbuf[0] != '/' || strbuf[n-1] != '/' {
-			log.Println("Invalid request not starting or ending with /:", strbuf)
-			continue
-		}
-
-		parts := strings.Split(strbuf, "/")
-		if len(parts) < 2 {
-			log.Println("Invalid request not enough parts:", strbuf)
-			continue
-		}
-		msgType := parts[1]
-
-		switch msgType {
-		case "connect":
-			sid, err := strconv.Atoi(parts[2])
-			if err != nil || sid < 0 {
-				log.Println("Invalid sessionId:", parts[2], err)
-				continue
-			}
-			s := int32(sid)
-			_, exists := sessions[s]
-			if !exists {
-				sessions[s] = Session{Id: s, Pos: 0}
-			}
-			response := fmt.Sprintf("/ack/%d/%d/", s, sessions[s].Pos)
-			conn.WriteTo([]byte(response), addr)
+		go handleConnection(conn)
+	}
+}
 
-		case "data":
-			sid, err := strconv.Atoi(parts[2])
-			if err != nil || sid < 0 {
-				log.Println("Invalid sessionId:", parts[2], err)
-				continue
-			}
-			s := int32(sid)
+func handleConnection(conn net.Conn) {
+	log.Println("New session from", conn.RemoteAddr())
+	defer conn.Close()
 
-			session, exists := sessions[s]
-			if !exists {
-				log.Println("Session not found:", s)
-				response := fmt.Sprintf("/close/%d/", s)
-				conn.WriteTo([]byte(response), addr)
-				continue
-			}
-			// Example:/data/1234567/0/hello/
-			pos, err := strconv.Atoi(parts[3])
-			if err != nil || pos < 0 {
-				log.Println("Invalid increment:", parts[3], err)
-				continue
-			}
-			p := int32(pos)
-			if p != session.Pos {
-				response := fmt.Sprintf("/ack/%d/%d/", s, session.Pos)
-				conn.WriteTo([]byte(response), addr)
-				continue
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if err != io.EOF {
+				log.Println("Read error:", err)
 			}
+			log.Println("Session closed from", conn.RemoteAddr())
+			return
+		}
+		line = strings.TrimSuffix(line, "\n")
+		log.Println("Received line:", line)
 
-		case "close":
-			log.Println("Close request:", msgType)
-		default:
-			log.Println("Invalid request:", msgType)
+		if _, err := io.WriteString(conn, reverse(line)+"\n"); err != nil {
+			log.Println("Write error:", err)
+			return
 		}
+	}
+}
 
+func reverse(s string) string {
+	b := []byte(s)
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
 	}
+	return string(b)
 }
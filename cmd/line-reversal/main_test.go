@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/saurabh/protohackers/internal/lrcp"
+	"github.com/saurabh/protohackers/internal/netsim"
+)
+
+// Short timers keep lossy runs fast; expiry stays well above any test.
+var testLRCP = &lrcp.Config{
+	RetransmitTimeout: 50 * time.Millisecond,
+	SessionExpiry:     20 * time.Second,
+}
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// startServer runs the line-reversal handler over LRCP on a lossy loopback
+// socket and returns its address.
+func startServer(t *testing.T, cfg netsim.Config) (net.Addr, *netsim.PacketConn) {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	lossy := netsim.Wrap(pc, cfg)
+	ln := lrcp.NewListener(lossy, testLRCP)
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handleConnection(conn)
+		}
+	}()
+	return ln.Addr(), lossy
+}
+
+func dialLossy(t *testing.T, addr net.Addr, cfg netsim.Config) (net.Conn, *netsim.PacketConn) {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	lossy := netsim.Wrap(pc, cfg)
+	conn, err := lrcp.NewClient(lossy, addr, testLRCP)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, lossy
+}
+
+// randomLines builds lines that together span several kilobytes and include
+// the characters LRCP has to escape.
+func randomLines(rng *rand.Rand, total int) []string {
+	const alphabet = "abcdefghijklmnopqrstuvwxyz ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789/\\.,!"
+	var lines []string
+	size := 0
+	for size < total {
+		n := 1 + rng.IntN(300)
+		var sb strings.Builder
+		for range n {
+			sb.WriteByte(alphabet[rng.IntN(len(alphabet))])
+		}
+		lines = append(lines, sb.String())
+		size += n + 1
+	}
+	return lines
+}
+
+// exchange writes lines on conn and checks that each reversed line comes back
+// exactly once and in order.
+func exchange(t *testing.T, conn net.Conn, lines []string) {
+	t.Helper()
+
+	errc := make(chan error, 1)
+	go func() {
+		var sb strings.Builder
+		for _, line := range lines {
+			sb.WriteString(line + "\n")
+		}
+		// Write in uneven chunks so lines straddle data messages
+		data := sb.String()
+		for len(data) > 0 {
+			n := min(len(data), 1+rand.IntN(1500))
+			if _, err := io.WriteString(conn, data[:n]); err != nil {
+				errc <- err
+				return
+			}
+			data = data[n:]
+		}
+		errc <- nil
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(20 * time.Second))
+	reader := bufio.NewReader(conn)
+	for i, line := range lines {
+		got, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("line %d: read error: %v", i, err)
+		}
+		if want := reverse(line) + "\n"; got != want {
+			t.Fatalf("line %d = %q, want %q", i, got, want)
+		}
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+
+	// Nothing may arrive beyond the expected lines
+	conn.SetReadDeadline(time.Now().Add(10 * testLRCP.RetransmitTimeout))
+	if extra, err := reader.ReadString('\n'); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("unexpected data after last line: %q (err %v)", extra, err)
+	}
+}
+
+func TestLineReversalOverLossyNetwork(t *testing.T) {
+	tests := []struct {
+		name string
+		net  netsim.Config
+	}{
+		{
+			name: "clean",
+			net:  netsim.Config{},
+		},
+		{
+			name: "drop",
+			net:  netsim.Config{DropRate: 0.25},
+		},
+		{
+			name: "duplicate",
+			net:  netsim.Config{DuplicateRate: 0.3},
+		},
+		{
+			name: "reorder",
+			net:  netsim.Config{ReorderWindow: 8},
+		},
+		{
+			name: "delay",
+			net:  netsim.Config{Delay: 20 * time.Millisecond},
+		},
+		{
+			name: "everything",
+			net: netsim.Config{
+				DropRate:      0.2,
+				DuplicateRate: 0.2,
+				ReorderWindow: 6,
+				Delay:         5 * time.Millisecond,
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			serverNet := tt.net
+			serverNet.Seed = uint64(2*i + 1)
+			clientNet := tt.net
+			clientNet.Seed = uint64(2*i + 2)
+
+			addr, serverPC := startServer(t, serverNet)
+			conn, clientPC := dialLossy(t, addr, clientNet)
+
+			rng := rand.New(rand.NewPCG(uint64(i), 42))
+			exchange(t, conn, randomLines(rng, 16*1024))
+
+			if tt.net.DropRate > 0 && serverPC.Stats().Dropped+clientPC.Stats().Dropped == 0 {
+				t.Error("no datagrams were dropped")
+			}
+			if tt.net.DuplicateRate > 0 && serverPC.Stats().Duplicated+clientPC.Stats().Duplicated == 0 {
+				t.Error("no datagrams were duplicated")
+			}
+		})
+	}
+}
+
+func TestConcurrentSessionsOverLossyNetwork(t *testing.T) {
+	cfg := netsim.Config{DropRate: 0.1, DuplicateRate: 0.1, ReorderWindow: 4, Seed: 7}
+	addr, _ := startServer(t, cfg)
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t.Run(fmt.Sprintf("session-%d", i), func(t *testing.T) {
+				clientNet := cfg
+				clientNet.Seed = uint64(100 + i)
+				conn, _ := dialLossy(t, addr, clientNet)
+
+				rng := rand.New(rand.NewPCG(uint64(i), 7))
+				exchange(t, conn, randomLines(rng, 4*1024))
+			})
+		}()
+	}
+	wg.Wait()
+}
+
+// dropSecondData is a PacketConn that loses the second /data/ message written
+// through it.
+type dropSecondData struct {
+	net.PacketConn
+	data atomic.Int32
+}
+
+func (c *dropSecondData) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if bytes.HasPrefix(p, []byte("/data/")) && c.data.Add(1) == 2 {
+		return len(p), nil
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+// TestResendDuringSteadyWrites loses one data message while the client keeps
+// writing, which must not put off resending it until the writes stop.
+func TestResendDuringSteadyWrites(t *testing.T) {
+	addr, _ := startServer(t, netsim.Config{})
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	cfg := &lrcp.Config{RetransmitTimeout: 300 * time.Millisecond, SessionExpiry: 20 * time.Second}
+	conn, err := lrcp.NewClient(&dropSecondData{PacketConn: pc}, addr, cfg)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	// A line every 20ms for 3s, each in its own data message
+	start := time.Now()
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		for i := range 150 {
+			select {
+			case <-done:
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+			fmt.Fprintf(conn, "line %d\n", i)
+		}
+	})
+	defer wg.Wait()
+	defer close(done)
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(conn)
+	for i := range 2 {
+		got, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("line %d: read error: %v", i, err)
+		}
+		if want := reverse(fmt.Sprint("line ", i)) + "\n"; got != want {
+			t.Fatalf("line %d = %q, want %q", i, got, want)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("lost line arrived after %v, want it resent while writes continue", elapsed)
+	}
+}
+
+func TestReverse(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"", ""},
+		{"a", "a"},
+		{"hello", "olleh"},
+		{"Hello, world!", "!dlrow ,olleH"},
+		{`fo/\o`, `o\/of`},
+	}
+
+	for _, tt := range tests {
+		if got := reverse(tt.input); got != tt.expected {
+			t.Errorf("reverse(%q) = %q, want %q", tt.input, got, tt.expected)
+		}
+	}
+}
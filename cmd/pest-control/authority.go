@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/saurabh/protohackers/internal/pestproto"
+)
+
+type policy struct {
+	id     uint32
+	action pestproto.Action
+}
+
+// Authority is the connection to the Authority Server for one site, along
+// with the target populations it returned and the policies we have created.
+type Authority struct {
+	site     uint32
+	conn     net.Conn
+	enc      *pestproto.Encoder
+	dec      *pestproto.Decoder
+	targets  []pestproto.PopulationTarget
+	policies map[string]policy // species -> active policy
+	mu       sync.Mutex        // serializes visits to the site
+}
+
+// Authorities keeps one Authority connection per site.
+type Authorities struct {
+	addr  string
+	sites map[uint32]*authoritySlot
+	mu    sync.Mutex
+}
+
+// authoritySlot holds a site's Authority once dialled. Its lock is held while
+// dialling, so visits to the same site wait for one connection while other
+// sites carry on.
+type authoritySlot struct {
+	a  *Authority
+	mu sync.Mutex
+}
+
+func NewAuthorities(addr string) *Authorities {
+	return &Authorities{
+		addr:  addr,
+		sites: make(map[uint32]*authoritySlot),
+	}
+}
+
+// slot returns the slot for site, creating it if needed.
+func (as *Authorities) slot(site uint32) *authoritySlot {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	slot, ok := as.sites[site]
+	if !ok {
+		slot = &authoritySlot{}
+		as.sites[site] = slot
+	}
+	return slot
+}
+
+// Get returns the Authority for site, dialling it on first use.
+func (as *Authorities) Get(site uint32) (*Authority, error) {
+	slot := as.slot(site)
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+
+	if slot.a != nil {
+		return slot.a, nil
+	}
+	a, err := dialAuthority(as.addr, site)
+	if err != nil {
+		return nil, err
+	}
+	slot.a = a
+	return a, nil
+}
+
+// Drop forgets a site's Authority after its connection failed, so the next
+// visit dials a fresh one. Policies created on the old connection are lost
+// with it.
+func (as *Authorities) Drop(a *Authority) {
+	slot := as.slot(a.site)
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+
+	if slot.a == a {
+		slot.a = nil
+	}
+	a.conn.Close()
+}
+
+func dialAuthority(addr string, site uint32) (*Authority, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial authority: %w", err)
+	}
+
+	a := &Authority{
+		site:     site,
+		conn:     conn,
+		enc:      pestproto.NewEncoder(conn),
+		dec:      pestproto.NewDecoder(conn),
+		policies: make(map[string]policy),
+	}
+
+	if err := a.enc.Encode(pestproto.Hello{Protocol: pestproto.Protocol, Version: pestproto.Version}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	msg, err := a.dec.Decode()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("authority hello: %w", err)
+	}
+	if err := checkHello(msg); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("authority hello: %w", err)
+	}
+
+	reply, err := a.call(pestproto.DialAuthority{Site: site})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tp, ok := reply.(pestproto.TargetPopulations)
+	if !ok || tp.Site != site {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected reply to DialAuthority: %+v", reply)
+	}
+	a.targets = tp.Populations
+
+	log.Printf("Connected to authority for site %d with %d targets", site, len(a.targets))
+	return a, nil
+}
+
+// call sends a request and waits for its reply, turning an Error reply into a
+// Go error.
+func (a *Authority) call(req pestproto.Message) (pestproto.Message, error) {
+	if err := a.enc.Encode(req); err != nil {
+		return nil, err
+	}
+	reply, err := a.dec.Decode()
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := reply.(pestproto.Error); ok {
+		return nil, fmt.Errorf("authority error: %s", e.Message)
+	}
+	return reply, nil
+}
+
+func (a *Authority) createPolicy(species string, action pestproto.Action) error {
+	reply, err := a.call(pestproto.CreatePolicy{Species: species, Action: action})
+	if err != nil {
+		return err
+	}
+	result, ok := reply.(pestproto.PolicyResult)
+	if !ok {
+		return fmt.Errorf("unexpected reply to CreatePolicy: %+v", reply)
+	}
+	a.policies[species] = policy{id: result.Policy, action: action}
+	log.Printf("Site %d: created %s policy %d for %s", a.site, action, result.Policy, species)
+	return nil
+}
+
+func (a *Authority) deletePolicy(species string) error {
+	p := a.policies[species]
+	reply, err := a.call(pestproto.DeletePolicy{Policy: p.id})
+	if err != nil {
+		return err
+	}
+	if _, ok := reply.(pestproto.OK); !ok {
+		return fmt.Errorf("unexpected reply to DeletePolicy: %+v", reply)
+	}
+	delete(a.policies, species)
+	log.Printf("Site %d: deleted %s policy %d for %s", a.site, p.action, p.id, species)
+	return nil
+}
+
+// Reconcile creates and deletes policies so that every species with a target
+// range has the policy its observed count calls for: cull above the range,
+// conserve below it and none inside it. Species that were not counted have a
+// count of zero.
+func (a *Authority) Reconcile(counts map[string]uint32) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, target := range a.targets {
+		count := counts[target.Species]
+
+		var want pestproto.Action
+		switch {
+		case count < target.Min:
+			want = pestproto.Conserve
+		case count > target.Max:
+			want = pestproto.Cull
+		}
+
+		existing, has := a.policies[target.Species]
+		if has && existing.action == want {
+			continue
+		}
+		if has {
+			if err := a.deletePolicy(target.Species); err != nil {
+				return err
+			}
+		}
+		if want != 0 {
+			if err := a.createPolicy(target.Species, want); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func checkHello(msg pestproto.Message) error {
+	hello, ok := msg.(pestproto.Hello)
+	if !ok {
+		return fmt.Errorf("expected Hello, got %T", msg)
+	}
+	if hello.Protocol != pestproto.Protocol || hello.Version != pestproto.Version {
+		return fmt.Errorf("bad hello: protocol %q version %d", hello.Protocol, hello.Version)
+	}
+	return nil
+}
+
+func authorityAddr() string {
+	return net.JoinHostPort(*authURL, strconv.Itoa(*authPort))
+}
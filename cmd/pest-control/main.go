@@ -1,10 +1,10 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
@@ -12,6 +12,7 @@ import (
 	"syscall"
 
 	"github.com/saurabh/protohackers/internal/logger"
+	"github.com/saurabh/protohackers/internal/pestproto"
 )
 
 var port = flag.String("port", "50001", "Port to listen on")
@@ -23,7 +24,7 @@ func main() {
 	flag.Parse()
 
 	// Setup logging to logs directory
-	logFile, err := logger.Setup("insecure-sockets-layer")
+	logFile, err := logger.Setup("pest-control")
 	if err != nil {
 		panic(err)
 	}
@@ -52,6 +53,8 @@ func main() {
 		ln.Close()
 	}()
 
+	authorities := NewAuthorities(authorityAddr())
+
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
@@ -64,21 +67,88 @@ func main() {
 				continue
 			}
 		}
-		go handleConnection(conn)
+		go handleConnection(conn, authorities)
 	}
 }
 
-func handleConnection(conn net.Conn) {
+func handleConnection(conn net.Conn, authorities *Authorities) {
 	addr := conn.RemoteAddr().String()
 	clog := log.New(log.Writer(), fmt.Sprintf("[%s] ", addr), log.Flags())
 
 	clog.Println("New connection")
 	defer conn.Close()
+	defer clog.Println("Connection closed")
+
+	enc := pestproto.NewEncoder(conn)
+	dec := pestproto.NewDecoder(conn)
+
+	sendError := func(err error) {
+		clog.Println("Error:", err)
+		if encErr := enc.Encode(pestproto.Error{Message: err.Error()}); encErr != nil {
+			clog.Println("Failed to send error:", encErr)
+		}
+	}
+
+	if err := enc.Encode(pestproto.Hello{Protocol: pestproto.Protocol, Version: pestproto.Version}); err != nil {
+		clog.Println("Write error:", err)
+		return
+	}
+
+	msg, err := dec.Decode()
+	if err != nil {
+		if err != io.EOF {
+			sendError(err)
+		}
+		return
+	}
+	if err := checkHello(msg); err != nil {
+		sendError(err)
+		return
+	}
+
+	for {
+		msg, err := dec.Decode()
+		if err != nil {
+			if err != io.EOF {
+				sendError(err)
+			}
+			return
+		}
 
-	reader := bufio.NewReader(conn)
-	writer := bufio.NewWriter(conn)
+		visit, ok := msg.(pestproto.SiteVisit)
+		if !ok {
+			sendError(fmt.Errorf("unexpected message %T", msg))
+			return
+		}
+		clog.Printf("Site visit to %d: %+v", visit.Site, visit.Populations)
+
+		counts, err := visitCounts(visit)
+		if err != nil {
+			sendError(err)
+			return
+		}
 
-	_ = reader
-	_ = writer
+		a, err := authorities.Get(visit.Site)
+		if err != nil {
+			clog.Println("Authority error:", err)
+			continue
+		}
+		if err := a.Reconcile(counts); err != nil {
+			clog.Println("Reconcile error:", err)
+			authorities.Drop(a)
+		}
+	}
+}
 
+// visitCounts collapses a visit into per-species counts. A species may be
+// listed more than once only if every entry has the same count.
+func visitCounts(visit pestproto.SiteVisit) (map[string]uint32, error) {
+	counts := make(map[string]uint32, len(visit.Populations))
+	for _, p := range visit.Populations {
+		if prev, seen := counts[p.Species]; seen && prev != p.Count {
+			return nil, fmt.Errorf("conflicting counts for %s", p.Species)
+		}
+		counts[p.Species] = p.Count
+	}
+	return counts, nil
 }
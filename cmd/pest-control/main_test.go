@@ -0,0 +1,354 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/saurabh/protohackers/internal/fakeauthority"
+	"github.com/saurabh/protohackers/internal/pestproto"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+var testTargets = map[uint32][]pestproto.PopulationTarget{
+	12345: {
+		{Species: "dog", Min: 1, Max: 3},
+		{Species: "rat", Min: 0, Max: 10},
+	},
+	54321: {
+		{Species: "cat", Min: 2, Max: 4},
+	},
+}
+
+// startServers runs a fake authority and a pest-control server pointed at it
+// on ephemeral ports.
+func startServers(t *testing.T) (*fakeauthority.Server, string) {
+	t.Helper()
+
+	auth := fakeauthority.New(testTargets)
+	if err := auth.Listen("127.0.0.1:0"); err != nil {
+		t.Fatalf("fake authority: %v", err)
+	}
+	t.Cleanup(func() { auth.Close() })
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	authorities := NewAuthorities(auth.Addr())
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handleConnection(conn, authorities)
+		}
+	}()
+	return auth, ln.Addr().String()
+}
+
+type client struct {
+	conn net.Conn
+	enc  *pestproto.Encoder
+	dec  *pestproto.Decoder
+}
+
+// dial connects to pest-control and completes the Hello exchange.
+func dial(t *testing.T, addr string) *client {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	c := &client{conn: conn, enc: pestproto.NewEncoder(conn), dec: pestproto.NewDecoder(conn)}
+	msg, err := c.dec.Decode()
+	if err != nil {
+		t.Fatalf("reading server hello: %v", err)
+	}
+	if err := checkHello(msg); err != nil {
+		t.Fatalf("server hello: %v", err)
+	}
+	c.send(t, pestproto.Hello{Protocol: pestproto.Protocol, Version: pestproto.Version})
+	return c
+}
+
+func (c *client) send(t *testing.T, m pestproto.Message) {
+	t.Helper()
+	if err := c.enc.Encode(m); err != nil {
+		t.Fatalf("Encode(%+v): %v", m, err)
+	}
+}
+
+func (c *client) expectError(t *testing.T) {
+	t.Helper()
+	msg, err := c.dec.Decode()
+	if err != nil {
+		t.Fatalf("expected Error message, got read error: %v", err)
+	}
+	if _, ok := msg.(pestproto.Error); !ok {
+		t.Fatalf("expected Error message, got %+v", msg)
+	}
+}
+
+func visit(site uint32, counts ...any) pestproto.SiteVisit {
+	v := pestproto.SiteVisit{Site: site, Populations: []pestproto.PopulationCount{}}
+	for i := 0; i < len(counts); i += 2 {
+		v.Populations = append(v.Populations, pestproto.PopulationCount{
+			Species: counts[i].(string),
+			Count:   uint32(counts[i+1].(int)),
+		})
+	}
+	return v
+}
+
+type want struct {
+	species string
+	action  pestproto.Action
+}
+
+// waitForPolicies polls the fake authority until site has exactly the wanted
+// policies. Site visits are not acknowledged, so there is nothing else to
+// wait on.
+func waitForPolicies(t *testing.T, auth *fakeauthority.Server, site uint32, wants ...want) {
+	t.Helper()
+
+	if wants == nil {
+		wants = []want{}
+	}
+	var got []want
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		got = []want{}
+		for _, p := range auth.Policies(site) {
+			got = append(got, want{p.Species, p.Action})
+		}
+		if reflect.DeepEqual(got, wants) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("site %d policies = %v, want %v", site, got, wants)
+}
+
+func TestSiteVisitCreatesPolicies(t *testing.T) {
+	auth, addr := startServers(t)
+	c := dial(t, addr)
+
+	// dog below range, rat above range, fox has no target
+	c.send(t, visit(12345, "rat", 11, "fox", 100))
+	waitForPolicies(t, auth, 12345,
+		want{"dog", pestproto.Conserve},
+		want{"rat", pestproto.Cull},
+	)
+}
+
+func TestSiteVisitReconcilesPolicies(t *testing.T) {
+	auth, addr := startServers(t)
+	c := dial(t, addr)
+
+	c.send(t, visit(12345, "dog", 5, "rat", 3))
+	waitForPolicies(t, auth, 12345, want{"dog", pestproto.Cull})
+
+	// dog flips from cull to conserve
+	c.send(t, visit(12345, "dog", 0, "rat", 3))
+	waitForPolicies(t, auth, 12345, want{"dog", pestproto.Conserve})
+
+	// Everything back in range removes every policy
+	c.send(t, visit(12345, "dog", 2, "rat", 10))
+	waitForPolicies(t, auth, 12345)
+
+	var got []fakeauthority.Request
+	for _, r := range auth.Requests() {
+		r.Policy.ID = 0
+		got = append(got, r)
+	}
+	expected := []fakeauthority.Request{
+		{Site: 12345, Policy: fakeauthority.Policy{Species: "dog", Action: pestproto.Cull}},
+		{Site: 12345, Delete: true, Policy: fakeauthority.Policy{Species: "dog", Action: pestproto.Cull}},
+		{Site: 12345, Policy: fakeauthority.Policy{Species: "dog", Action: pestproto.Conserve}},
+		{Site: 12345, Delete: true, Policy: fakeauthority.Policy{Species: "dog", Action: pestproto.Conserve}},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("requests = %+v, want %+v", got, expected)
+	}
+}
+
+func TestSiteVisitUnchangedPolicyIsKept(t *testing.T) {
+	auth, addr := startServers(t)
+	c := dial(t, addr)
+
+	c.send(t, visit(54321, "cat", 9))
+	waitForPolicies(t, auth, 54321, want{"cat", pestproto.Cull})
+
+	// Still above the range, so the cull policy should be left alone
+	c.send(t, visit(54321, "cat", 7))
+	c.send(t, visit(54321, "cat", 8))
+	time.Sleep(50 * time.Millisecond)
+	if n := len(auth.Requests()); n != 1 {
+		t.Errorf("got %d policy requests, want 1: %+v", n, auth.Requests())
+	}
+}
+
+func TestOneAuthorityConnectionPerSite(t *testing.T) {
+	auth, addr := startServers(t)
+
+	clients := make([]*client, 10)
+	for i := range clients {
+		clients[i] = dial(t, addr)
+	}
+
+	var wg sync.WaitGroup
+	for i, c := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, v := range []pestproto.SiteVisit{
+				visit(12345, "dog", 2, "rat", 20+i),
+				visit(54321, "cat", 3),
+			} {
+				if err := c.enc.Encode(v); err != nil {
+					t.Errorf("Encode(%+v): %v", v, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	waitForPolicies(t, auth, 12345, want{"rat", pestproto.Cull})
+	waitForPolicies(t, auth, 54321)
+	if n := auth.Connections(12345); n != 1 {
+		t.Errorf("site 12345 dialled %d times, want 1", n)
+	}
+	if n := auth.Connections(54321); n != 1 {
+		t.Errorf("site 54321 dialled %d times, want 1", n)
+	}
+}
+
+func TestConflictingCounts(t *testing.T) {
+	auth, addr := startServers(t)
+	c := dial(t, addr)
+
+	c.send(t, visit(12345, "dog", 1, "dog", 2))
+	c.expectError(t)
+
+	// Repeating a species with the same count is fine
+	c2 := dial(t, addr)
+	c2.send(t, visit(12345, "dog", 5, "dog", 5, "rat", 1))
+	waitForPolicies(t, auth, 12345, want{"dog", pestproto.Cull})
+}
+
+func TestInvalidMessages(t *testing.T) {
+	_, addr := startServers(t)
+
+	tests := []struct {
+		name  string
+		frame []byte
+	}{
+		{"bad checksum", []byte{0x52, 0x00, 0x00, 0x00, 0x06, 0xa9}},
+		{"length mismatch", []byte{0x53, 0x00, 0x00, 0x00, 0x0b, 0x00, 0x00, 0x30, 0x39, 0x00, 0x39}},
+		{"unknown type", []byte{0x59, 0x00, 0x00, 0x00, 0x06, 0xa1}},
+		{"ok from client", []byte{0x52, 0x00, 0x00, 0x00, 0x06, 0xa8}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := dial(t, addr)
+			if _, err := c.conn.Write(tt.frame); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			c.expectError(t)
+		})
+	}
+}
+
+func TestBadHello(t *testing.T) {
+	_, addr := startServers(t)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	c := &client{conn: conn, enc: pestproto.NewEncoder(conn), dec: pestproto.NewDecoder(conn)}
+	if _, err := c.dec.Decode(); err != nil {
+		t.Fatalf("reading server hello: %v", err)
+	}
+	c.send(t, pestproto.Hello{Protocol: "pestcontrol", Version: 2})
+	c.expectError(t)
+}
+
+func TestSlowAuthorityDoesNotBlockOtherSites(t *testing.T) {
+	// An authority server that answers at once for every site but one, which
+	// waits until released
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	const slowSite = 1
+	stalled, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				enc, dec := pestproto.NewEncoder(conn), pestproto.NewDecoder(conn)
+				if _, err := dec.Decode(); err != nil {
+					return
+				}
+				enc.Encode(pestproto.Hello{Protocol: pestproto.Protocol, Version: pestproto.Version})
+				msg, err := dec.Decode()
+				dial, ok := msg.(pestproto.DialAuthority)
+				if err != nil || !ok {
+					return
+				}
+				if dial.Site == slowSite {
+					close(stalled)
+					<-release
+				}
+				enc.Encode(pestproto.TargetPopulations{Site: dial.Site, Populations: []pestproto.PopulationTarget{}})
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+
+	authorities := NewAuthorities(ln.Addr().String())
+	go authorities.Get(slowSite)
+	<-stalled
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := authorities.Get(2)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Get(2) = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Get(2) waited for the authority of another site")
+	}
+}
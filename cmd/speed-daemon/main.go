@@ -1,11 +1,12 @@
 package main
 
 import (
-	"bufio"
 	"context"
-	"encoding/binary"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"math"
 	"net"
 	"os"
 	"os/signal"
@@ -14,15 +15,12 @@ import (
 	"time"
 
 	"github.com/saurabh/protohackers/internal/logger"
+	"github.com/saurabh/protohackers/internal/speedproto"
 )
 
 var port = flag.String("port", "50001", "Port to listen on")
 
-var clients = make(map[net.Conn]string)
-var clientsMu sync.RWMutex
-
-var heartbeats = make(map[net.Conn]time.Time)
-var heartbeatsMu sync.RWMutex
+var tracker = NewSpeedTracker()
 
 type Camera struct {
 	road  uint16
@@ -35,105 +33,192 @@ type Dispatcher struct {
 	roads    []uint16
 }
 
-func handlePlate(conn net.Conn) {
+// Observation is a single sighting of a plate by a camera on a road
+type Observation struct {
+	mile      uint16
+	timestamp uint32
+}
 
+// SpeedTracker stores plate observations per road, issues tickets for
+// speeding cars and routes them to a dispatcher responsible for the road.
+type SpeedTracker struct {
+	observations map[uint16]map[string][]Observation // road -> plate -> observations
+	limits       map[uint16]uint16                   // road -> speed limit
+	ticketDays   map[string]map[uint32]bool          // plate -> days already ticketed
+	dispatchers  map[uint16][]*Session               // road -> dispatchers for that road
+	pending      map[uint16][]speedproto.Ticket      // road -> tickets waiting for a dispatcher
+	mu           sync.Mutex
 }
 
-func handleWantHeartbeat(conn net.Conn) {
-	if _, exists := heartbeats[conn]; exists {
-		sendError(conn, "already sent a heartbeat")
-		return
+func NewSpeedTracker() *SpeedTracker {
+	return &SpeedTracker{
+		observations: make(map[uint16]map[string][]Observation),
+		limits:       make(map[uint16]uint16),
+		ticketDays:   make(map[string]map[uint32]bool),
+		dispatchers:  make(map[uint16][]*Session),
+		pending:      make(map[uint16][]speedproto.Ticket),
 	}
+}
 
-	heartbeatsMu.Lock()
-	heartbeats[conn] = time.Now()
-	heartbeatsMu.Unlock()
+// AddObservation records a plate seen by a camera and checks it against every
+// earlier observation of the same plate on the same road.
+func (st *SpeedTracker) AddObservation(cam *Camera, plate string, timestamp uint32) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
 
-	data := make([]byte, 4)
-	conn.Read(data)
-	beat := binary.BigEndian.Uint32(data)
-	ticker := time.NewTicker(time.Duration(beat) * time.Second / 10)
-	defer ticker.Stop()
-	go func() {
-		for range ticker.C {
-			err := sendHeartbeat(conn)
-			if err != nil {
-				log.Printf("failed to send heartbeat to %s: %v", conn.RemoteAddr(), err)
-				return
-			}
-		}
-	}()
-}
+	st.limits[cam.road] = cam.limit
 
-func sendHeartbeat(conn net.Conn) error {
-	_, err := conn.Write([]byte{0x41})
-	if err != nil {
-		log.Printf("failed to send heartbeat to %s: %v", conn.RemoteAddr(), err)
-		return err
+	plates, ok := st.observations[cam.road]
+	if !ok {
+		plates = make(map[string][]Observation)
+		st.observations[cam.road] = plates
 	}
-	return nil
+
+	obs := Observation{mile: cam.mile, timestamp: timestamp}
+	for _, prev := range plates[plate] {
+		st.checkSpeed(cam.road, plate, prev, obs)
+	}
+	plates[plate] = append(plates[plate], obs)
 }
 
-func handleIAmCamera(conn net.Conn) {
-	if client, exists := clients[conn]; exists {
-		sendError(conn, "already registered as a "+client)
-	} else {
-		clientsMu.Lock()
-		clients[conn] = "camera"
-		clientsMu.Unlock()
+// checkSpeed issues a ticket if the average speed between two observations is
+// at least 0.5 mph over the limit and the plate has not been ticketed on any
+// of the days the two observations span.
+func (st *SpeedTracker) checkSpeed(road uint16, plate string, a, b Observation) {
+	if a.timestamp == b.timestamp {
+		return
+	}
+	if a.timestamp > b.timestamp {
+		a, b = b, a
+	}
+
+	distance := math.Abs(float64(b.mile) - float64(a.mile))
+	elapsed := float64(b.timestamp - a.timestamp)
+	speed := distance * 3600 / elapsed
+	if speed < float64(st.limits[road])+0.5 {
+		return
+	}
+
+	firstDay := a.timestamp / 86400
+	lastDay := b.timestamp / 86400
+	days, ok := st.ticketDays[plate]
+	if !ok {
+		days = make(map[uint32]bool)
+		st.ticketDays[plate] = days
+	}
+	for day := firstDay; day <= lastDay; day++ {
+		if days[day] {
+			return
+		}
+	}
+	for day := firstDay; day <= lastDay; day++ {
+		days[day] = true
+	}
+
+	ticket := speedproto.Ticket{
+		Plate:      plate,
+		Road:       road,
+		Mile1:      a.mile,
+		Timestamp1: a.timestamp,
+		Mile2:      b.mile,
+		Timestamp2: b.timestamp,
+		Speed:      uint16(math.Round(speed * 100)),
 	}
+	log.Printf("Ticket for %s on road %d: %.2f mph (limit %d)", plate, road, speed, st.limits[road])
+	st.dispatch(ticket)
 }
 
-func handleIAmDispatcher(conn net.Conn) {
-	if client, exists := clients[conn]; exists {
-		sendError(conn, "already registered as a "+client)
-	} else {
-		clientsMu.Lock()
-		clients[conn] = "dispatcher"
-		clientsMu.Unlock()
+// dispatch sends a ticket to a dispatcher for its road, or queues it until
+// one connects. Caller must hold st.mu.
+func (st *SpeedTracker) dispatch(ticket speedproto.Ticket) {
+	for _, s := range st.dispatchers[ticket.Road] {
+		if err := s.SendMessage(ticket); err == nil {
+			return
+		}
 	}
+	st.pending[ticket.Road] = append(st.pending[ticket.Road], ticket)
 }
 
-func sendError(conn net.Conn, msg string) error {
-	// 1. Safety check for the protocol limit (u8 length)
-	if len(msg) > 255 {
-		msg = msg[:255] // Or return an error
+// AddDispatcher registers a dispatcher for its roads and flushes any tickets
+// that were queued for them.
+func (st *SpeedTracker) AddDispatcher(s *Session, d *Dispatcher) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for _, road := range d.roads {
+		st.dispatchers[road] = append(st.dispatchers[road], s)
+
+		queued := st.pending[road]
+		delete(st.pending, road)
+		for _, ticket := range queued {
+			st.dispatch(ticket)
+		}
 	}
+}
 
-	// 2. Pre-allocate exactly what we need
-	msgBytes := []byte(msg)
-	packet := make([]byte, 0, 2+len(msgBytes))
+func (st *SpeedTracker) RemoveDispatcher(s *Session) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
 
-	// 3. Use append to make it more readable
-	packet = append(packet, 0x10)                // Type Tag
-	packet = append(packet, byte(len(msgBytes))) // String Length
-	packet = append(packet, msgBytes...)         // String Content
+	for road, sessions := range st.dispatchers {
+		for i, other := range sessions {
+			if other == s {
+				st.dispatchers[road] = append(sessions[:i], sessions[i+1:]...)
+				break
+			}
+		}
+		if len(st.dispatchers[road]) == 0 {
+			delete(st.dispatchers, road)
+		}
+	}
+}
 
-	// 4. Handle the write error
-	_, err := conn.Write(packet)
-	if err != nil {
-		log.Printf("failed to send error to %s: %v", conn.RemoteAddr(), err)
-		return err
+func handlePlate(s *Session, m speedproto.Plate) error {
+	if s.role != "camera" {
+		s.SendError("not a camera")
+		return fmt.Errorf("plate from non-camera client")
 	}
 
-	err = conn.Close()
-	if err != nil {
-		log.Printf("failed to close connection to %s: %v", conn.RemoteAddr(), err)
-		return err
+	log.Printf("Plate %s at %d on road %d mile %d", m.Plate, m.Timestamp, s.camera.road, s.camera.mile)
+	tracker.AddObservation(s.camera, m.Plate, m.Timestamp)
+	return nil
+}
+
+func handleWantHeartbeat(s *Session, m speedproto.WantHeartbeat) error {
+	if s.wantHeartbeat {
+		s.SendError("already sent a heartbeat")
+		return fmt.Errorf("duplicate heartbeat request")
 	}
+	s.wantHeartbeat = true
 
-	clientsMu.Lock()
-	delete(clients, conn)
-	clientsMu.Unlock()
+	// Interval is in deciseconds
+	s.StartHeartbeat(time.Duration(m.Interval) * time.Second / 10)
+	return nil
+}
 
-	heartbeatsMu.Lock()
-	delete(heartbeats, conn)
-	heartbeatsMu.Unlock()
+func handleIAmCamera(s *Session, m speedproto.IAmCamera) error {
+	if s.role != "" {
+		s.SendError("already registered as a " + s.role)
+		return fmt.Errorf("client already registered")
+	}
+	s.role = "camera"
+	s.camera = &Camera{road: m.Road, mile: m.Mile, limit: m.Limit}
 
+	log.Printf("Camera on road %d at mile %d (limit %d)", m.Road, m.Mile, m.Limit)
 	return nil
 }
 
-func sendTicket(conn net.Conn) {
+func handleIAmDispatcher(s *Session, m speedproto.IAmDispatcher) error {
+	if s.role != "" {
+		s.SendError("already registered as a " + s.role)
+		return fmt.Errorf("client already registered")
+	}
+	s.role = "dispatcher"
+	s.dispatcher = &Dispatcher{numRoads: uint8(len(m.Roads)), roads: m.Roads}
+
+	log.Printf("Dispatcher for roads %v", m.Roads)
+	tracker.AddDispatcher(s, s.dispatcher)
+	return nil
 }
 
 func main() {
@@ -187,86 +272,44 @@ func main() {
 
 func handleConnection(conn net.Conn) {
 	log.Println("New connection from", conn.RemoteAddr())
-	defer conn.Close()
 
-	reader := bufio.NewReader(conn)
+	s := NewSession(conn)
+	go s.writeLoop()
+
+	defer func() {
+		tracker.RemoveDispatcher(s)
+		s.Close()
+		<-s.Done()
+		log.Println("Connection closed from", conn.RemoteAddr())
+	}()
+
+	dec := speedproto.NewDecoder(conn)
 	for {
-		msg, err := reader.ReadByte()
+		msg, err := dec.Decode()
 		if err != nil {
+			if errors.Is(err, speedproto.ErrUnknownType) || errors.Is(err, speedproto.ErrTruncated) {
+				s.SendError("illegal msg")
+			}
 			log.Println("Read error:", err)
 			return
 		}
-		log.Println("Received message:", msg)
-		switch msg {
-		case 0x20:
-			handlePlate(conn)
-		case 0x40:
-			handleWantHeartbeat(conn)
-		case 0x80:
-			handleIAmCamera(conn)
-		case 0x81:
-			handleIAmDispatcher(conn)
+		log.Printf("Received message: %T %+v", msg, msg)
+		switch m := msg.(type) {
+		case speedproto.Plate:
+			err = handlePlate(s, m)
+		case speedproto.WantHeartbeat:
+			err = handleWantHeartbeat(s, m)
+		case speedproto.IAmCamera:
+			err = handleIAmCamera(s, m)
+		case speedproto.IAmDispatcher:
+			err = handleIAmDispatcher(s, m)
 		default:
-			sendError(conn, "incorrect message type")
-			conn.Close()
+			s.SendError("illegal msg")
+			return
+		}
+		if err != nil {
+			log.Println("Handler error:", err)
 			return
 		}
 	}
 }
-
-/*
-Number message format:
-Type | Hex data    | Value
--------------------------------
-u8   |          20 |         32
-u8   |          e3 |        227
-u16  |       00 20 |         32
-u16  |       12 45 |       4677
-u16  |       a8 23 |      43043
-u32  | 00 00 00 20 |         32
-u32  | 00 00 12 45 |       4677
-u32  | a6 a9 b5 67 | 2796139879
-
-
-String message format:
-Type | Hex data                   | Value
-----------------------------------------------
-str  | 00                         | ""
-str  | 03 66 6f 6f                | "foo"
-str  | 08 45 6C 62 65 72 65 74 68 | "Elbereth"
-
-
-0x10: Error (Server->Client)
-
-Fields:
-
-    msg: str
-
-Hexadecimal:                            Decoded:
-10                                      Error{
-03 62 61 64                                 msg: "bad"
-                                        }
-
-10                                      Error{
-0b 69 6c 6c 65 67 61 6c 20 6d 73 67         msg: "illegal msg"
-                                        }
-
-0x20: Plate (Client->Server)
-
-Fields:
-
-    plate: str
-    timestamp: u32
-
-Hexadecimal:                Decoded:
-20                          Plate{
-04 55 4e 31 58                  plate: "UN1X",
-00 00 03 e8                     timestamp: 1000
-                            }
-
-20                          Plate{
-07 52 45 30 35 42 4b 47         plate: "RE05BKG",
-00 01 e2 40                     timestamp: 123456
-                            }
-
-*/
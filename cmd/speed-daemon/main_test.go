@@ -0,0 +1,168 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/saurabh/protohackers/internal/speedproto"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// sighting is a plate seen by a camera at a mile on road 1, limit 60.
+type sighting struct {
+	plate     string
+	mile      uint16
+	timestamp uint32
+}
+
+// queuedTickets returns the tickets queued on a session whose writer isn't
+// running.
+func queuedTickets(t *testing.T, s *Session) []speedproto.Ticket {
+	t.Helper()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var tickets []speedproto.Ticket
+	for _, packet := range s.queue {
+		m, err := speedproto.Unmarshal(packet)
+		if err != nil {
+			t.Fatalf("bad packet %x: %v", packet, err)
+		}
+		tickets = append(tickets, m.(speedproto.Ticket))
+	}
+	return tickets
+}
+
+// observe records sightings with a tracker and returns the tickets a
+// dispatcher for road 1 is sent.
+func observe(t *testing.T, sightings []sighting) []speedproto.Ticket {
+	t.Helper()
+
+	st := NewSpeedTracker()
+	s := NewSession(nil)
+	st.AddDispatcher(s, &Dispatcher{numRoads: 1, roads: []uint16{1}})
+	for _, seen := range sightings {
+		st.AddObservation(&Camera{road: 1, mile: seen.mile, limit: 60}, seen.plate, seen.timestamp)
+	}
+	return queuedTickets(t, s)
+}
+
+func TestSpeedCheck(t *testing.T) {
+	tests := []struct {
+		name      string
+		sightings []sighting
+		want      []speedproto.Ticket
+	}{
+		{
+			name:      "at the limit",
+			sightings: []sighting{{"A", 0, 0}, {"A", 60, 3600}},
+		},
+		{
+			name:      "under half a mph over",
+			sightings: []sighting{{"A", 0, 0}, {"A", 151, 9000}}, // 60.4 mph
+		},
+		{
+			name:      "half a mph over",
+			sightings: []sighting{{"A", 0, 0}, {"A", 121, 7200}},
+			want:      []speedproto.Ticket{{Plate: "A", Road: 1, Mile1: 0, Timestamp1: 0, Mile2: 121, Timestamp2: 7200, Speed: 6050}},
+		},
+		{
+			name:      "seen out of order, driving back down the road",
+			sightings: []sighting{{"A", 8, 45}, {"A", 9, 0}},
+			want:      []speedproto.Ticket{{Plate: "A", Road: 1, Mile1: 9, Timestamp1: 0, Mile2: 8, Timestamp2: 45, Speed: 8000}},
+		},
+		{
+			name:      "other plates don't count",
+			sightings: []sighting{{"A", 8, 0}, {"B", 9, 45}},
+		},
+		{
+			name:      "same time",
+			sightings: []sighting{{"A", 8, 0}, {"A", 9, 0}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := observe(t, tt.sightings); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("tickets %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOneTicketPerDay(t *testing.T) {
+	const day = 86400
+	tests := []struct {
+		name      string
+		sightings []sighting
+		want      []uint32 // the first timestamp of each ticket
+	}{
+		{
+			name:      "twice in a day",
+			sightings: []sighting{{"A", 0, 0}, {"A", 10, 300}, {"A", 20, 600}},
+			want:      []uint32{0},
+		},
+		{
+			name:      "on separate days",
+			sightings: []sighting{{"A", 0, 0}, {"A", 10, 300}, {"A", 0, 2 * day}, {"A", 10, 2*day + 300}},
+			want:      []uint32{0, 2 * day},
+		},
+		{
+			name:      "spanning a day already ticketed",
+			sightings: []sighting{{"A", 20, day + 300}, {"A", 30, day + 600}, {"A", 0, day - 150}},
+			want:      []uint32{day + 300},
+		},
+		{
+			name:      "spanning midnight blocks both days",
+			sightings: []sighting{{"A", 0, day - 150}, {"A", 10, day + 150}, {"A", 20, day + 450}, {"A", 20, 3 * day}, {"A", 30, 3*day + 300}},
+			want:      []uint32{day - 150, 3 * day},
+		},
+		{
+			name:      "other plates are ticketed separately",
+			sightings: []sighting{{"A", 0, 0}, {"A", 10, 300}, {"B", 0, 0}, {"B", 10, 300}},
+			want:      []uint32{0, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []uint32
+			for _, ticket := range observe(t, tt.sightings) {
+				got = append(got, ticket.Timestamp1)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("tickets from %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPendingTicketsGoToNewDispatcher(t *testing.T) {
+	st := NewSpeedTracker()
+	for _, road := range []uint16{1, 2} {
+		st.AddObservation(&Camera{road: road, mile: 0, limit: 60}, "A", uint32(road)*86400)
+		st.AddObservation(&Camera{road: road, mile: 10, limit: 60}, "A", uint32(road)*86400+300)
+	}
+
+	// A dispatcher that has gone doesn't take them
+	gone := NewSession(nil)
+	gone.Close()
+	st.AddDispatcher(gone, &Dispatcher{numRoads: 1, roads: []uint16{1}})
+	if len(st.pending[1]) != 1 || len(st.pending[2]) != 1 {
+		t.Fatalf("pending %v, want a ticket for each of roads 1 and 2", st.pending)
+	}
+
+	s := NewSession(nil)
+	st.AddDispatcher(s, &Dispatcher{numRoads: 1, roads: []uint16{1}})
+	if tickets := queuedTickets(t, s); len(tickets) != 1 || tickets[0].Road != 1 {
+		t.Errorf("dispatcher for road 1 sent %+v, want the road 1 ticket", tickets)
+	}
+	if _, exists := st.pending[1]; exists || len(st.pending[2]) != 1 {
+		t.Errorf("pending %v, want just the road 2 ticket", st.pending)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/saurabh/protohackers/internal/speedproto"
+)
+
+var errSessionClosed = errors.New("session closed")
+
+var heartbeatPacket, _ = speedproto.Marshal(speedproto.Heartbeat{})
+
+// writeTimeout bounds a single write so a client that stops reading cannot
+// wedge its writer goroutine forever.
+const writeTimeout = 10 * time.Second
+
+// Session owns the state of a single client connection. The role and
+// heartbeat fields are only touched by the goroutine reading from the
+// connection; all writes go through a single writer goroutine so heartbeats,
+// tickets and errors never interleave on the wire.
+type Session struct {
+	conn          net.Conn
+	role          string // "", "camera" or "dispatcher"
+	camera        *Camera
+	dispatcher    *Dispatcher
+	wantHeartbeat bool
+
+	mu        sync.Mutex
+	queue     [][]byte
+	closing   bool
+	wake      chan struct{}
+	heartbeat chan time.Duration
+	done      chan struct{}
+}
+
+func NewSession(conn net.Conn) *Session {
+	return &Session{
+		conn:      conn,
+		wake:      make(chan struct{}, 1),
+		heartbeat: make(chan time.Duration, 1),
+		done:      make(chan struct{}),
+	}
+}
+
+// Send queues a packet for the writer goroutine. It never blocks, so it is
+// safe to call while holding other locks.
+func (s *Session) Send(packet []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closing {
+		return errSessionClosed
+	}
+	s.queue = append(s.queue, packet)
+	s.signal()
+	return nil
+}
+
+// SendMessage encodes m and queues it for the writer goroutine.
+func (s *Session) SendMessage(m speedproto.Message) error {
+	packet, err := speedproto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return s.Send(packet)
+}
+
+// SendError queues an Error message and closes the session once it has been
+// written.
+func (s *Session) SendError(msg string) {
+	if len(msg) > speedproto.MaxStringLen {
+		msg = msg[:speedproto.MaxStringLen]
+	}
+	if err := s.SendMessage(speedproto.Error{Msg: msg}); err == nil {
+		s.Close()
+	}
+}
+
+// StartHeartbeat asks the writer goroutine to emit a Heartbeat every interval.
+// A zero interval disables heartbeats.
+func (s *Session) StartHeartbeat(interval time.Duration) {
+	s.heartbeat <- interval
+}
+
+// Close stops accepting new packets. The writer flushes whatever is already
+// queued and then closes the connection.
+func (s *Session) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closing = true
+	s.signal()
+}
+
+// Done is closed once the writer has exited and the connection is closed.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// signal wakes the writer. Caller must hold s.mu.
+func (s *Session) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Session) write(packet []byte) error {
+	s.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := s.conn.Write(packet)
+	return err
+}
+
+// writeLoop is the only goroutine that writes to or closes the connection.
+func (s *Session) writeLoop() {
+	defer close(s.done)
+	defer s.conn.Close()
+
+	var ticker *time.Ticker
+	var tick <-chan time.Time
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
+
+	for {
+		select {
+		case interval := <-s.heartbeat:
+			if interval > 0 {
+				ticker = time.NewTicker(interval)
+				tick = ticker.C
+			}
+
+		case <-tick:
+			if err := s.write(heartbeatPacket); err != nil {
+				log.Printf("failed to send heartbeat to %s: %v", s.conn.RemoteAddr(), err)
+				s.Close()
+				return
+			}
+
+		case <-s.wake:
+			s.mu.Lock()
+			queue := s.queue
+			s.queue = nil
+			closing := s.closing
+			s.mu.Unlock()
+
+			for _, packet := range queue {
+				if err := s.write(packet); err != nil {
+					log.Printf("failed to write to %s: %v", s.conn.RemoteAddr(), err)
+					s.Close()
+					return
+				}
+			}
+			if closing {
+				return
+			}
+		}
+	}
+}
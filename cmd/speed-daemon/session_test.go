@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/saurabh/protohackers/internal/speedproto"
+)
+
+// startSession runs a Session's writer on one end of a pipe and returns it
+// with the other end.
+func startSession(t *testing.T) (*Session, net.Conn) {
+	t.Helper()
+
+	server, client := net.Pipe()
+	s := NewSession(server)
+	go s.writeLoop()
+	t.Cleanup(func() {
+		client.Close()
+		s.Close()
+		<-s.Done()
+	})
+	return s, client
+}
+
+func expectMessage(t *testing.T, dec *speedproto.Decoder, want speedproto.Message) {
+	t.Helper()
+
+	got, err := dec.Decode()
+	if err != nil {
+		t.Fatalf("reading %T: %v", want, err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %#v, want %#v", got, want)
+	}
+}
+
+// expectClosed waits for s's writer to exit, and checks it no longer takes
+// messages.
+func expectClosed(t *testing.T, s *Session) {
+	t.Helper()
+
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Fatal("session still open")
+	}
+	if err := s.SendMessage(speedproto.Heartbeat{}); err != errSessionClosed {
+		t.Errorf("SendMessage after close = %v, want %v", err, errSessionClosed)
+	}
+}
+
+func TestSessionWritesInOrder(t *testing.T) {
+	s, client := startSession(t)
+
+	var want []speedproto.Message
+	for i := range 20 {
+		m := speedproto.Ticket{Plate: "UN1X", Road: uint16(i), Mile1: 8, Timestamp1: 0, Mile2: 9, Timestamp2: 45, Speed: 8000}
+		if err := s.SendMessage(m); err != nil {
+			t.Fatalf("SendMessage: %v", err)
+		}
+		want = append(want, m)
+	}
+	s.SendError("bad")
+	want = append(want, speedproto.Error{Msg: "bad"})
+
+	dec := speedproto.NewDecoder(client)
+	for _, m := range want {
+		expectMessage(t, dec, m)
+	}
+
+	// The error closes the session once it's written
+	if _, err := dec.Decode(); err != io.EOF {
+		t.Errorf("read after error = %v, want EOF", err)
+	}
+	expectClosed(t, s)
+}
+
+func TestSessionHeartbeat(t *testing.T) {
+	s, client := startSession(t)
+	s.StartHeartbeat(10 * time.Millisecond)
+
+	dec := speedproto.NewDecoder(client)
+	for range 3 {
+		expectMessage(t, dec, speedproto.Heartbeat{})
+	}
+	s.SendMessage(speedproto.Error{Msg: "between"})
+	for {
+		m, err := dec.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m == (speedproto.Error{Msg: "between"}) {
+			break
+		}
+		if m != (speedproto.Heartbeat{}) {
+			t.Fatalf("got %#v, want heartbeats and then the error", m)
+		}
+	}
+}
+
+func TestSessionClosesAfterWriteError(t *testing.T) {
+	t.Run("heartbeat", func(t *testing.T) {
+		s, client := startSession(t)
+		client.Close()
+		s.StartHeartbeat(time.Millisecond)
+		expectClosed(t, s)
+	})
+
+	t.Run("message", func(t *testing.T) {
+		s, client := startSession(t)
+		client.Close()
+		s.SendMessage(speedproto.Heartbeat{})
+		expectClosed(t, s)
+	})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/maphash"
+)
+
+// A delta rebuilds a target from a base with two kinds of instruction:
+//
+//	opCopy   uvarint offset, uvarint length  copy length bytes of base
+//	opInsert uvarint length, bytes           insert literal bytes
+const (
+	opCopy   byte = 0x01
+	opInsert byte = 0x02
+)
+
+// deltaBlock is the granularity at which base content is indexed. Matches
+// shorter than this are emitted as literals.
+const deltaBlock = 16
+
+var errBadDelta = errors.New("malformed delta")
+
+// makeDelta encodes target as a sequence of copies from base and literal
+// inserts. Matching indexes every deltaBlock-aligned block of base, then
+// extends each hit in target as far as it goes in both directions, so small
+// edits anywhere in a file cost little more than the edited bytes.
+func makeDelta(base, target []byte) []byte {
+	seed := maphash.MakeSeed()
+	index := make(map[uint64]int, len(base)/deltaBlock)
+	for off := 0; off+deltaBlock <= len(base); off += deltaBlock {
+		h := maphash.Bytes(seed, base[off:off+deltaBlock])
+		if _, ok := index[h]; !ok {
+			index[h] = off
+		}
+	}
+
+	var out []byte
+	literal := 0 // start of pending literal bytes in target
+
+	flush := func(end int) {
+		if end > literal {
+			out = append(out, opInsert)
+			out = binary.AppendUvarint(out, uint64(end-literal))
+			out = append(out, target[literal:end]...)
+		}
+	}
+
+	i := 0
+	for i+deltaBlock <= len(target) {
+		off, ok := index[maphash.Bytes(seed, target[i:i+deltaBlock])]
+		if !ok || string(base[off:off+deltaBlock]) != string(target[i:i+deltaBlock]) {
+			i++
+			continue
+		}
+
+		// Extend the match backwards into the pending literal
+		start, bstart := i, off
+		for start > literal && bstart > 0 && target[start-1] == base[bstart-1] {
+			start--
+			bstart--
+		}
+		// ... and forwards as far as both sides agree
+		end, bend := i+deltaBlock, off+deltaBlock
+		for end < len(target) && bend < len(base) && target[end] == base[bend] {
+			end++
+			bend++
+		}
+
+		flush(start)
+		out = append(out, opCopy)
+		out = binary.AppendUvarint(out, uint64(bstart))
+		out = binary.AppendUvarint(out, uint64(end-start))
+		i, literal = end, end
+	}
+	flush(len(target))
+	return out
+}
+
+// applyDelta rebuilds the target a delta was made from.
+func applyDelta(base, delta []byte) ([]byte, error) {
+	var out []byte
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+
+		switch op {
+		case opCopy:
+			off, n := binary.Uvarint(delta)
+			if n <= 0 {
+				return nil, errBadDelta
+			}
+			delta = delta[n:]
+			length, n := binary.Uvarint(delta)
+			if n <= 0 {
+				return nil, errBadDelta
+			}
+			delta = delta[n:]
+			if off > uint64(len(base)) || length > uint64(len(base))-off {
+				return nil, errBadDelta
+			}
+			out = append(out, base[off:off+length]...)
+
+		case opInsert:
+			length, n := binary.Uvarint(delta)
+			if n <= 0 {
+				return nil, errBadDelta
+			}
+			delta = delta[n:]
+			if length > uint64(len(delta)) {
+				return nil, errBadDelta
+			}
+			out = append(out, delta[:length]...)
+			delta = delta[length:]
+
+		default:
+			return nil, errBadDelta
+		}
+	}
+	return out, nil
+}
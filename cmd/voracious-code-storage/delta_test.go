@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// editHistory returns revisions of a source file of the given number of
+// lines, each differing from the last by a few line edits.
+func editHistory(seed uint64, lines, revisions int) [][]byte {
+	rng := rand.New(rand.NewPCG(seed, seed))
+
+	line := func() string {
+		return fmt.Sprintf("\tx%d := compute(%d, %q) // step %d", rng.IntN(1000), rng.IntN(1<<20), strconv.Itoa(rng.Int()), rng.IntN(100))
+	}
+	file := make([]string, lines)
+	for i := range file {
+		file[i] = line()
+	}
+
+	history := make([][]byte, 0, revisions)
+	for range revisions {
+		for range 1 + rng.IntN(3) {
+			i := rng.IntN(len(file))
+			switch rng.IntN(3) {
+			case 0:
+				file[i] = line()
+			case 1:
+				file = append(file[:i], append([]string{line()}, file[i:]...)...)
+			case 2:
+				if len(file) > 1 {
+					file = append(file[:i], file[i+1:]...)
+				}
+			}
+		}
+		history = append(history, []byte(strings.Join(file, "\n")+"\n"))
+	}
+	return history
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	tests := []struct {
+		name         string
+		base, target string
+	}{
+		{"empty", "", ""},
+		{"from empty", "", "hello world\n"},
+		{"to empty", "hello world\n", ""},
+		{"identical", strings.Repeat("abcdefgh", 20), strings.Repeat("abcdefgh", 20)},
+		{"append", strings.Repeat("0123456789", 10), strings.Repeat("0123456789", 10) + "tail\n"},
+		{"prepend", strings.Repeat("0123456789", 10), "head\n" + strings.Repeat("0123456789", 10)},
+		{"middle edit", strings.Repeat("a", 50) + "XYZ" + strings.Repeat("b", 50), strings.Repeat("a", 50) + "Q" + strings.Repeat("b", 50)},
+		{"unrelated", strings.Repeat("x", 100), strings.Repeat("y", 100)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delta := makeDelta([]byte(tt.base), []byte(tt.target))
+			got, err := applyDelta([]byte(tt.base), delta)
+			if err != nil {
+				t.Fatalf("applyDelta: %v", err)
+			}
+			if string(got) != tt.target {
+				t.Errorf("applyDelta(makeDelta(%q, %q)) = %q", tt.base, tt.target, got)
+			}
+		})
+	}
+
+	history := editHistory(1, 200, 50)
+	for i := 1; i < len(history); i++ {
+		delta := makeDelta(history[i-1], history[i])
+		got, err := applyDelta(history[i-1], delta)
+		if err != nil || string(got) != string(history[i]) {
+			t.Fatalf("revision %d does not round trip: %v", i+1, err)
+		}
+		if len(delta) > len(history[i])/10 {
+			t.Errorf("revision %d delta is %d bytes for a %d byte file", i+1, len(delta), len(history[i]))
+		}
+	}
+}
+
+func TestApplyDeltaRejectsMalformed(t *testing.T) {
+	base := []byte("0123456789")
+	tests := []struct {
+		name  string
+		delta []byte
+	}{
+		{"unknown op", []byte{0x7f}},
+		{"copy past end", []byte{opCopy, 8, 5}},
+		{"truncated copy", []byte{opCopy, 0x80}},
+		{"insert past end", []byte{opInsert, 4, 'a', 'b'}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := applyDelta(base, tt.delta); err == nil {
+				t.Errorf("applyDelta(%q, %v) succeeded, want error", base, tt.delta)
+			}
+		})
+	}
+}
+
+func TestVCSStoresDeltas(t *testing.T) {
+	store := NewMemoryStorage()
+	vcs, err := NewVCS(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	history := editHistory(2, 300, 3*defaultMaxChain)
+	for _, data := range history {
+		mustPut(t, vcs, "/src/main.go", string(data))
+	}
+	// A second file with the same content as an old revision adds nothing
+	mustPut(t, vcs, "/src/copy.go", string(history[5]))
+
+	for i, data := range history {
+		expectGet(t, vcs, "/src/main.go", "r"+strconv.Itoa(i+1), string(data))
+	}
+	expectGet(t, vcs, "/src/copy.go", "latest", string(history[5]))
+
+	u := vcs.Usage()
+	if u.Blobs != len(history) {
+		t.Errorf("Usage().Blobs = %d, want %d", u.Blobs, len(history))
+	}
+	if u.Bytes*5 > u.LogicalBytes {
+		t.Errorf("stored %d bytes for %d bytes of content, want under 20%%", u.Bytes, u.LogicalBytes)
+	}
+
+	for _, data := range history {
+		obj, err := vcs.readObject(hashData(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if obj.depth > defaultMaxChain {
+			t.Errorf("object has chain depth %d, want at most %d", obj.depth, defaultMaxChain)
+		}
+	}
+}
+
+func TestVCSReadsRawBlobs(t *testing.T) {
+	// Blobs written before objects existed hold plain content
+	store := NewMemoryStorage()
+	data := []byte("legacy content\n")
+	hash := hashData(data)
+	store.WriteBlob(hash, data)
+	store.AppendRevisions(Revision{Filename: "/old.txt", Number: 1, Hash: hash, Size: len(data)})
+
+	vcs, err := NewVCS(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectGet(t, vcs, "/old.txt", "r1", "legacy content\n")
+	mustPut(t, vcs, "/old.txt", "legacy content\nwith an extra line that is long enough to be worth a delta\n")
+	expectGet(t, vcs, "/old.txt", "r2", "legacy content\nwith an extra line that is long enough to be worth a delta\n")
+}
+
+func TestVCSDetectsCorruptBlob(t *testing.T) {
+	store := NewMemoryStorage()
+	vcs, err := NewVCS(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustPut(t, vcs, "/a.txt", "one\n")
+	store.blobs[hashData([]byte("one\n"))] = encodeObject(object{data: []byte("two\n")})
+
+	if _, err := vcs.Get("/a.txt", "r1"); err == nil {
+		t.Error("Get of corrupt blob succeeded, want error")
+	}
+}
+
+// BenchmarkEditHistory puts a realistic edit history of a 45KB source file and
+// reports how much the store holds compared to the content put.
+func BenchmarkEditHistory(b *testing.B) {
+	history := editHistory(3, 800, 200)
+
+	for _, bm := range []struct {
+		name     string
+		maxChain int
+	}{
+		{"full", 0},
+		{"delta", defaultMaxChain},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			var u Usage
+			for b.Loop() {
+				vcs, err := NewVCS(NewMemoryStorage())
+				if err != nil {
+					b.Fatal(err)
+				}
+				vcs.maxChain = bm.maxChain
+				for _, data := range history {
+					if _, err := vcs.Put("/src/main.go", data); err != nil {
+						b.Fatal(err)
+					}
+				}
+				u = vcs.Usage()
+			}
+			b.ReportMetric(float64(u.Bytes), "stored-bytes")
+			b.ReportMetric(float64(u.LogicalBytes), "content-bytes")
+			b.ReportMetric(float64(u.Bytes)/float64(u.LogicalBytes), "stored/content")
+		})
+	}
+}
+
+// BenchmarkGet measures rebuilding revisions at every depth of the chain.
+func BenchmarkGet(b *testing.B) {
+	history := editHistory(4, 800, 200)
+
+	for _, bm := range []struct {
+		name     string
+		maxChain int
+	}{
+		{"full", 0},
+		{"delta", defaultMaxChain},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			vcs, err := NewVCS(NewMemoryStorage())
+			if err != nil {
+				b.Fatal(err)
+			}
+			vcs.maxChain = bm.maxChain
+			for _, data := range history {
+				if _, err := vcs.Put("/src/main.go", data); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			r := 0
+			for b.Loop() {
+				if _, err := vcs.Get("/src/main.go", strconv.Itoa(r%len(history)+1)); err != nil {
+					b.Fatal(err)
+				}
+				r++
+			}
+		})
+	}
+}
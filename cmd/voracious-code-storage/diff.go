@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around each change.
+const diffContext = 3
+
+// maxDiffEdits bounds the work and memory spent finding a minimal diff. Files
+// that differ by more than this many lines are diffed as a whole replacement.
+const maxDiffEdits = 1 << 10
+
+type lineOp struct {
+	kind byte // ' ', '-' or '+'
+	a, b int  // line index in the old and new file
+}
+
+// unifiedDiff returns a unified diff turning a into b, or "" if they are the
+// same.
+func unifiedDiff(nameA, nameB string, a, b []byte) string {
+	linesA, linesB := splitLines(a), splitLines(b)
+	ops := diffLines(linesA, linesB)
+
+	var sb strings.Builder
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+
+		// Grow the hunk until the next change is too far away to share context
+		start := max(i-diffContext, 0)
+		end := i
+		for end < len(ops) {
+			if ops[end].kind != ' ' {
+				end++
+				continue
+			}
+			next := end
+			for next < len(ops) && ops[next].kind == ' ' {
+				next++
+			}
+			if next == len(ops) || next-end > 2*diffContext {
+				end = min(end+diffContext, len(ops))
+				break
+			}
+			end = next
+		}
+
+		if sb.Len() == 0 {
+			fmt.Fprintf(&sb, "--- %s\n+++ %s\n", nameA, nameB)
+		}
+		writeHunk(&sb, ops[start:end], linesA, linesB)
+		i = end
+	}
+	return sb.String()
+}
+
+func writeHunk(sb *strings.Builder, ops []lineOp, a, b []string) {
+	var countA, countB int
+	for _, op := range ops {
+		if op.kind != '+' {
+			countA++
+		}
+		if op.kind != '-' {
+			countB++
+		}
+	}
+	fmt.Fprintf(sb, "@@ -%s +%s @@\n", hunkRange(ops[0].a, countA), hunkRange(ops[0].b, countB))
+
+	for _, op := range ops {
+		var line string
+		if op.kind == '+' {
+			line = b[op.b]
+		} else {
+			line = a[op.a]
+		}
+		sb.WriteByte(op.kind)
+		sb.WriteString(line)
+		if !strings.HasSuffix(line, "\n") {
+			sb.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+// hunkRange formats the 1-based line range of a hunk side that starts at the
+// 0-based line index start.
+func hunkRange(start, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return fmt.Sprintf("%d", start+1)
+	default:
+		return fmt.Sprintf("%d,%d", start+1, count)
+	}
+}
+
+// splitLines splits data after each newline, so a final line without one
+// differs from the same line with one.
+func splitLines(data []byte) []string {
+	if len(data) == 0 {
+		return nil
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines returns the edit script turning a into b.
+func diffLines(a, b []string) []lineOp {
+	// Edits are usually small, so trim what is common at both ends first
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+
+	ops := make([]lineOp, 0, len(a)+len(b))
+	for i := range pre {
+		ops = append(ops, lineOp{' ', i, i})
+	}
+	ops = append(ops, myers(a[pre:len(a)-suf], b[pre:len(b)-suf], pre, pre)...)
+	for i := range suf {
+		ops = append(ops, lineOp{' ', len(a) - suf + i, len(b) - suf + i})
+	}
+
+	// Insertions take their position in a from the line they precede
+	next := len(a)
+	for i := len(ops) - 1; i >= 0; i-- {
+		if ops[i].kind == '+' {
+			ops[i].a = next
+		} else {
+			next = ops[i].a
+		}
+	}
+	next = len(b)
+	for i := len(ops) - 1; i >= 0; i-- {
+		if ops[i].kind == '-' {
+			ops[i].b = next
+		} else {
+			next = ops[i].b
+		}
+	}
+	return ops
+}
+
+// myers finds a shortest edit script with Myers' O(ND) algorithm. Line indexes
+// in the result are offset by offA and offB.
+func myers(a, b []string, offA, offB int) []lineOp {
+	n, m := len(a), len(b)
+
+	// frontier[d][k+d] is the furthest x reached on diagonal k with d edits
+	var frontier [][]int
+	found := false
+	for d := 0; d <= n+m && d <= maxDiffEdits && !found; d++ {
+		v := make([]int, 2*d+1)
+		for k := -d; k <= d; k += 2 {
+			var x int
+			switch {
+			case d == 0:
+				x = 0
+			case k == -d || (k != d && frontier[d-1][k-1+d-1] < frontier[d-1][k+1+d-1]):
+				x = frontier[d-1][k+1+d-1]
+			default:
+				x = frontier[d-1][k-1+d-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[k+d] = x
+			if x >= n && y >= m {
+				found = true
+			}
+		}
+		frontier = append(frontier, v)
+	}
+
+	var ops []lineOp
+	if !found {
+		for i := range n {
+			ops = append(ops, lineOp{'-', offA + i, 0})
+		}
+		for i := range m {
+			ops = append(ops, lineOp{'+', 0, offB + i})
+		}
+		return ops
+	}
+
+	// Walk back from the end, recording the edits in reverse
+	x, y := n, m
+	for d := len(frontier) - 1; d > 0; d-- {
+		k := x - y
+		prev := frontier[d-1]
+		var prevK int
+		if k == -d || (k != d && prev[k-1+d-1] < prev[k+1+d-1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := prev[prevK+d-1]
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			x--
+			y--
+			ops = append(ops, lineOp{' ', offA + x, offB + y})
+		}
+		if x == prevX {
+			y--
+			ops = append(ops, lineOp{'+', 0, offB + y})
+		} else {
+			x--
+			ops = append(ops, lineOp{'-', offA + x, 0})
+		}
+	}
+	for x > 0 {
+		x--
+		y--
+		ops = append(ops, lineOp{' ', offA + x, offB + y})
+	}
+	slices.Reverse(ops)
+	return ops
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/saurabh/protohackers/internal/recordlog"
+)
+
+// DiskStorage keeps append-only logs of revisions and tags, and a directory
+// of content-addressed blobs:
+//
+//	<dir>/revisions.log
+//	<dir>/tags.log
+//	<dir>/blobs/<first two hex digits>/<sha256>
+//
+// Blobs are written to a temporary file, fsynced and renamed into place
+// before the revision that refers to them is appended and fsynced, so the log
+// never points at a missing blob. Revisions appended together share one
+// record, so a crash keeps all of them or none. On open the logs are replayed
+// and a torn record at their tail, left by a crash mid-append, is truncated
+// away.
+type DiskStorage struct {
+	dir       string
+	revLog    *recordlog.Log
+	tagLog    *recordlog.Log
+	revisions []Revision
+	tags      []Tag
+	blobs     int
+	blobBytes int64
+	mu        sync.Mutex
+}
+
+func OpenDiskStorage(dir string) (*DiskStorage, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "blobs"), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %w", err)
+	}
+
+	ds := &DiskStorage{dir: dir}
+	var err error
+	ds.revLog, err = recordlog.Open(filepath.Join(dir, "revisions.log"), func(payload []byte) error {
+		revs, err := decodeRevisions(payload)
+		ds.revisions = append(ds.revisions, revs...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	ds.tagLog, err = recordlog.Open(filepath.Join(dir, "tags.log"), func(payload []byte) error {
+		var tag Tag
+		if err := json.Unmarshal(payload, &tag); err != nil {
+			return err
+		}
+		ds.tags = append(ds.tags, tag)
+		return nil
+	})
+	if err != nil {
+		ds.revLog.Close()
+		return nil, err
+	}
+	if err := ds.countBlobs(); err != nil {
+		ds.Close()
+		return nil, err
+	}
+	return ds, nil
+}
+
+// decodeRevisions reads a revision log record, which holds either a single
+// revision or a batch appended together.
+func decodeRevisions(payload []byte) ([]Revision, error) {
+	if len(payload) > 0 && payload[0] == '[' {
+		var revs []Revision
+		err := json.Unmarshal(payload, &revs)
+		return revs, err
+	}
+	var rev Revision
+	if err := json.Unmarshal(payload, &rev); err != nil {
+		return nil, err
+	}
+	return []Revision{rev}, nil
+}
+
+// countBlobs totals the blobs already on disk for Usage, and removes
+// temporary files left by blobs that were never committed.
+func (ds *DiskStorage) countBlobs() error {
+	return filepath.WalkDir(filepath.Join(ds.dir, "blobs"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".tmp-") {
+			return os.Remove(path)
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		ds.blobs++
+		ds.blobBytes += info.Size()
+		return nil
+	})
+}
+
+func (ds *DiskStorage) blobPath(hash string) string {
+	return filepath.Join(ds.dir, "blobs", hash[:2], hash)
+}
+
+func (ds *DiskStorage) WriteBlob(hash string, data []byte) error {
+	if ok, err := ds.HasBlob(hash); err != nil || ok {
+		return err
+	}
+
+	w, err := ds.CreateBlob()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Commit(hash)
+}
+
+// diskBlob is written to a temporary file at the top of the blob directory,
+// then fsynced and renamed into place on Commit.
+type diskBlob struct {
+	ds      *DiskStorage
+	f       *os.File
+	size    int64
+	renamed bool
+}
+
+func (ds *DiskStorage) CreateBlob() (BlobWriter, error) {
+	f, err := os.CreateTemp(filepath.Join(ds.dir, "blobs"), ".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	return &diskBlob{ds: ds, f: f}, nil
+}
+
+func (b *diskBlob) Write(p []byte) (int, error) {
+	n, err := b.f.Write(p)
+	b.size += int64(n)
+	return n, err
+}
+
+func (b *diskBlob) Commit(hash string) error {
+	defer b.Abort()
+
+	if err := b.f.Sync(); err != nil {
+		return err
+	}
+	if err := b.f.Close(); err != nil {
+		return err
+	}
+
+	path := b.ds.blobPath(hash)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(b.f.Name(), path); err != nil {
+		return err
+	}
+	b.renamed = true
+	if err := recordlog.SyncDir(dir); err != nil {
+		return err
+	}
+
+	b.ds.mu.Lock()
+	b.ds.blobs++
+	b.ds.blobBytes += b.size
+	b.ds.mu.Unlock()
+	return nil
+}
+
+// Abort removes the temporary file, if it is still there.
+func (b *diskBlob) Abort() {
+	b.f.Close()
+	if !b.renamed {
+		os.Remove(b.f.Name())
+	}
+}
+
+func (ds *DiskStorage) HasBlob(hash string) (bool, error) {
+	_, err := os.Stat(ds.blobPath(hash))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (ds *DiskStorage) ReadBlob(hash string) ([]byte, error) {
+	if len(hash) < 2 {
+		return nil, fmt.Errorf("bad blob hash %q", hash)
+	}
+	data, err := os.ReadFile(ds.blobPath(hash))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("no such blob %s", hash)
+	}
+	return data, err
+}
+
+func (ds *DiskStorage) OpenBlob(hash string) (io.ReadCloser, error) {
+	if len(hash) < 2 {
+		return nil, fmt.Errorf("bad blob hash %q", hash)
+	}
+	f, err := os.Open(ds.blobPath(hash))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("no such blob %s", hash)
+	}
+	return f, err
+}
+
+func (ds *DiskStorage) AppendRevisions(revs ...Revision) error {
+	var payload []byte
+	var err error
+	if len(revs) == 1 {
+		payload, err = json.Marshal(revs[0])
+	} else {
+		payload, err = json.Marshal(revs)
+	}
+	if err != nil {
+		return err
+	}
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if err := ds.revLog.Append(payload); err != nil {
+		return err
+	}
+	ds.revisions = append(ds.revisions, revs...)
+	return nil
+}
+
+func (ds *DiskStorage) Revisions() ([]Revision, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	return append([]Revision(nil), ds.revisions...), nil
+}
+
+func (ds *DiskStorage) AppendTag(tag Tag) error {
+	payload, err := json.Marshal(tag)
+	if err != nil {
+		return err
+	}
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	if err := ds.tagLog.Append(payload); err != nil {
+		return err
+	}
+	ds.tags = append(ds.tags, tag)
+	return nil
+}
+
+func (ds *DiskStorage) Tags() ([]Tag, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	return append([]Tag(nil), ds.tags...), nil
+}
+
+func (ds *DiskStorage) Usage() StorageUsage {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	return StorageUsage{Blobs: ds.blobs, Bytes: ds.blobBytes + ds.revLog.Size() + ds.tagLog.Size()}
+}
+
+func (ds *DiskStorage) Close() error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	return errors.Join(ds.revLog.Close(), ds.tagLog.Close())
+}
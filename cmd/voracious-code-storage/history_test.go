@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newMemoryVCS(t *testing.T) *VCS {
+	t.Helper()
+
+	vcs, err := NewVCS(NewMemoryStorage())
+	if err != nil {
+		t.Fatalf("NewVCS: %v", err)
+	}
+	return vcs
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want string
+	}{
+		{"identical", "a\nb\n", "a\nb\n", ""},
+		{"from empty", "", "a\nb\n", "--- old\n+++ new\n@@ -0,0 +1,2 @@\n+a\n+b\n"},
+		{"to empty", "a\n", "", "--- old\n+++ new\n@@ -1 +0,0 @@\n-a\n"},
+		{
+			"change in the middle",
+			"1\n2\n3\n4\n5\n6\n7\n8\n9\n",
+			"1\n2\n3\n4\nfive\n6\n7\n8\n9\n",
+			"--- old\n+++ new\n@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n",
+		},
+		{
+			"separate hunks",
+			"1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n",
+			"0\n1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n",
+			"--- old\n+++ new\n@@ -1,3 +1,4 @@\n+0\n 1\n 2\n 3\n@@ -9,4 +10,3 @@\n 9\n 10\n 11\n-12\n",
+		},
+		{
+			"missing final newline",
+			"a\nb",
+			"a\nb\n",
+			"--- old\n+++ new\n@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+b\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := unifiedDiff("old", "new", []byte(tt.a), []byte(tt.b)); got != tt.want {
+				t.Errorf("unifiedDiff(%q, %q) =\n%s\nwant\n%s", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+// applyUnifiedDiff applies the hunks of a diff produced by unifiedDiff.
+func applyUnifiedDiff(t *testing.T, a []byte, diff string) []byte {
+	t.Helper()
+
+	var out []string
+	old := splitLines(a)
+	pos := 0
+	for _, line := range strings.SplitAfter(diff, "\n") {
+		switch {
+		case line == "" || strings.HasPrefix(line, "---") || strings.HasPrefix(line, "+++"):
+		case strings.HasPrefix(line, "@@"):
+			var start int
+			field := strings.Fields(line)[1]
+			start, _ = strconv.Atoi(strings.Split(field[1:], ",")[0])
+			if !strings.HasSuffix(field, ",0") {
+				start--
+			}
+			out = append(out, old[pos:start]...)
+			pos = start
+		case strings.HasPrefix(line, "\\"):
+			out[len(out)-1] = strings.TrimSuffix(out[len(out)-1], "\n")
+		case line[0] == ' ':
+			out = append(out, line[1:])
+			pos++
+		case line[0] == '-':
+			pos++
+		case line[0] == '+':
+			out = append(out, line[1:])
+		}
+	}
+	out = append(out, old[pos:]...)
+	return []byte(strings.Join(out, ""))
+}
+
+func TestUnifiedDiffApplies(t *testing.T) {
+	history := editHistory(5, 100, 40)
+	for i := 1; i < len(history); i++ {
+		diff := unifiedDiff("old", "new", history[i-1], history[i])
+		if got := applyUnifiedDiff(t, history[i-1], diff); string(got) != string(history[i]) {
+			t.Fatalf("revision %d: applying diff does not give the new revision:\n%s", i+1, diff)
+		}
+	}
+
+	// Too different for a minimal diff, so one side replaces the other
+	a, b := editHistory(6, 2*maxDiffEdits, 1)[0], editHistory(7, 2*maxDiffEdits, 1)[0]
+	if got := applyUnifiedDiff(t, a, unifiedDiff("old", "new", a, b)); string(got) != string(b) {
+		t.Error("applying diff of unrelated files does not give the new file")
+	}
+}
+
+func TestDeleteKeepsHistory(t *testing.T) {
+	vcs := newMemoryVCS(t)
+	mustPut(t, vcs, "/dir/a.txt", "one\n")
+	mustPut(t, vcs, "/dir/a.txt", "two\n")
+	mustPut(t, vcs, "/dir/sub/b.txt", "bee\n")
+
+	if r, err := vcs.Delete("/dir/a.txt"); err != nil || r != 3 {
+		t.Fatalf("Delete = r%d, %v, want r3", r, err)
+	}
+	if _, err := vcs.Delete("/dir/a.txt"); err == nil {
+		t.Error("second Delete succeeded, want error")
+	}
+	if _, err := vcs.Delete("/missing.txt"); err == nil {
+		t.Error("Delete of missing file succeeded, want error")
+	}
+
+	expectList(t, vcs, "/dir/", "", "sub/ DIR")
+	if _, err := vcs.Get("/dir/a.txt", "latest"); err == nil {
+		t.Error("Get latest of deleted file succeeded, want error")
+	}
+	if _, err := vcs.Get("/dir/a.txt", "r3"); err == nil {
+		t.Error("Get of tombstone succeeded, want error")
+	}
+	expectGet(t, vcs, "/dir/a.txt", "r1", "one\n")
+	expectGet(t, vcs, "/dir/a.txt", "r2", "two\n")
+
+	// Putting the same content again brings the file back as a new revision
+	if r := mustPut(t, vcs, "/dir/a.txt", "two\n"); r != 4 {
+		t.Errorf("Put after delete = r%d, want r4", r)
+	}
+	expectList(t, vcs, "/dir", "", "sub/ DIR", "a.txt r4")
+
+	revisions, err := vcs.Log("/dir/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, rev := range revisions {
+		got = append(got, strconv.Itoa(rev.Number)+":"+strconv.Itoa(rev.Size)+":"+strconv.FormatBool(rev.Deleted))
+	}
+	want := []string{"1:4:false", "2:4:false", "3:0:true", "4:4:false"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Log = %v, want %v", got, want)
+	}
+}
+
+func TestDeleteSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	vcs, store := openDiskVCS(t, dir)
+	mustPut(t, vcs, "/a.txt", "one\n")
+	if _, err := vcs.Delete("/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	vcs, _ = openDiskVCS(t, dir)
+	expectList(t, vcs, "/", "")
+	expectGet(t, vcs, "/a.txt", "r1", "one\n")
+}
+
+func TestDiffRevisions(t *testing.T) {
+	vcs := newMemoryVCS(t)
+	mustPut(t, vcs, "/a.txt", "one\ntwo\n")
+	mustPut(t, vcs, "/a.txt", "one\n2\n")
+	vcs.Delete("/a.txt")
+
+	tests := []struct {
+		ra, rb string
+		want   string
+	}{
+		{"r1", "r2", "--- /a.txt r1\n+++ /a.txt r2\n@@ -1,2 +1,2 @@\n one\n-two\n+2\n"},
+		{"2", "1", "--- /a.txt r2\n+++ /a.txt r1\n@@ -1,2 +1,2 @@\n one\n-2\n+two\n"},
+		{"r2", "latest", "--- /a.txt r2\n+++ /a.txt r3\n@@ -1,2 +0,0 @@\n-one\n-2\n"},
+		{"r1", "r1", ""},
+	}
+	for _, tt := range tests {
+		got, err := vcs.Diff("/a.txt", tt.ra, tt.rb)
+		if err != nil {
+			t.Errorf("Diff(%s, %s): %v", tt.ra, tt.rb, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Diff(%s, %s) =\n%s\nwant\n%s", tt.ra, tt.rb, got, tt.want)
+		}
+	}
+
+	if _, err := vcs.Diff("/a.txt", "r1", "r9"); err == nil {
+		t.Error("Diff with a missing revision succeeded, want error")
+	}
+}
+
+// session drives the text protocol over an in-memory connection.
+type session struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func startSession(t *testing.T, vcs *VCS) *session {
+	t.Helper()
+
+	client, server := net.Pipe()
+	go handleConnection(server, vcs)
+	t.Cleanup(func() { client.Close() })
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	s := &session{t: t, conn: client, reader: bufio.NewReader(client)}
+	s.expect("READY")
+	return s
+}
+
+func (s *session) send(line string) {
+	s.t.Helper()
+	if _, err := io.WriteString(s.conn, line+"\n"); err != nil {
+		s.t.Fatalf("write %q: %v", line, err)
+	}
+}
+
+func (s *session) expect(want ...string) {
+	s.t.Helper()
+	for _, w := range want {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			s.t.Fatalf("reading %q: %v", w, err)
+		}
+		if got := strings.TrimSuffix(line, "\n"); got != w {
+			s.t.Fatalf("got %q, want %q", got, w)
+		}
+	}
+}
+
+func (s *session) expectData(want string) {
+	s.t.Helper()
+	s.expect("OK " + strconv.Itoa(len(want)))
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(s.reader, got); err != nil {
+		s.t.Fatalf("reading data: %v", err)
+	}
+	if string(got) != want {
+		s.t.Fatalf("data = %q, want %q", got, want)
+	}
+}
+
+func TestHistoryCommands(t *testing.T) {
+	vcs := newMemoryVCS(t)
+	s := startSession(t, vcs)
+
+	s.send("PUT /a.txt 4\none")
+	s.expect("OK r1", "READY")
+	s.send("PUT /a.txt 4\ntwo")
+	s.expect("OK r2", "READY")
+
+	s.send("DIFF /a.txt r1 r2")
+	s.expectData("--- /a.txt r1\n+++ /a.txt r2\n@@ -1 +1 @@\n-one\n+two\n")
+	s.expect("READY")
+
+	s.send("DELETE /a.txt")
+	s.expect("OK r3", "READY")
+	s.send("LIST /")
+	s.expect("OK 0", "READY")
+	s.send("GET /a.txt r2")
+	s.expectData("two\n")
+	s.expect("READY")
+
+	revisions, _ := vcs.Log("/a.txt")
+	s.send("LOG /a.txt")
+	s.expect("OK 3")
+	for i, size := range []string{"4", "4", "deleted"} {
+		s.expect("r" + strconv.Itoa(i+1) + " " + size + " " + revisions[i].Time.Format(time.RFC3339))
+	}
+	s.expect("READY")
+
+	s.send("DELETE /a.txt")
+	s.expect("ERR no such file", "READY")
+	s.send("DELETE bad//name")
+	s.expect("ERR illegal file name", "READY")
+	s.send("LOG /missing.txt")
+	s.expect("ERR no such file", "READY")
+	s.send("DIFF /a.txt r1")
+	s.expect("ERR usage: DIFF file revision revision", "READY")
+}
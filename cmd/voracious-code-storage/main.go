@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -11,123 +12,438 @@ import (
 	"net"
 	"os"
 	"os/signal"
-	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/saurabh/protohackers/internal/logger"
 )
 
 type File struct {
-	Data []byte
+	Hash    string
+	Size    int
+	Time    time.Time
+	Deleted bool
 }
 
 type VersionedFile struct {
 	Versions []*File
 }
 
+// Deleted reports whether the latest revision is a tombstone.
+func (vf *VersionedFile) Deleted() bool {
+	n := len(vf.Versions)
+	return n > 0 && vf.Versions[n-1].Deleted
+}
+
+// revision parses "latest", "rN" or "N" into a revision number.
+func (vf *VersionedFile) revision(revision string) (int, error) {
+	if revision == "latest" {
+		return len(vf.Versions), nil
+	}
+	r, err := strconv.Atoi(strings.TrimPrefix(revision, "r"))
+	if err != nil || r <= 0 || r > len(vf.Versions) {
+		return 0, fmt.Errorf("no such revision")
+	}
+	return r, nil
+}
+
 type VCS struct {
-	files map[string]*VersionedFile // map with name as key and VersionedFile as value
-	mu    sync.RWMutex
+	files    map[string]*VersionedFile // map with name as key and VersionedFile as value
+	store    Storage
+	maxChain int                  // longest delta chain to store, 0 stores every revision in full
+	last     content              // the last revision put, to delta the next one against
+	tree     *pathTree            // latest revision of every file not deleted
+	tags     map[string]*pathTree // the tree as of each tag
+	mu       sync.RWMutex
+}
+
+// NewVCS builds the file index from the revisions already in store.
+func NewVCS(store Storage) (*VCS, error) {
+	revisions, err := store.Revisions()
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := store.Tags()
+	if err != nil {
+		return nil, err
+	}
+
+	v := &VCS{
+		files:    make(map[string]*VersionedFile),
+		store:    store,
+		maxChain: defaultMaxChain,
+		tree:     &pathTree{},
+		tags:     make(map[string]*pathTree),
+	}
+	for _, rev := range revisions {
+		n := 0
+		if vf, ok := v.files[rev.Filename]; ok {
+			n = len(vf.Versions)
+		}
+		if rev.Number != n+1 {
+			return nil, fmt.Errorf("revision log out of order: %s r%d follows r%d", rev.Filename, rev.Number, n)
+		}
+		v.addRevision(rev)
+	}
+	for _, tag := range tags {
+		tree := &pathTree{}
+		for filename, revision := range tag.Files {
+			tree.set(filename, revision)
+		}
+		v.tags[tag.Name] = tree
+	}
+	log.Printf("Loaded %d revisions of %d files and %d tags", len(revisions), len(v.files), len(v.tags))
+	return v, nil
+}
+
+// Change is one staged modification: new content for a file, or its
+// deletion. New content is either an Upload already streamed into the store
+// or, for convenience, Data held in memory.
+type Change struct {
+	Filename string
+	Upload   *Upload
+	Data     []byte
+	Delete   bool
+}
+
+func (v *VCS) Put(filename string, data []byte) (int, error) {
+	revisions, err := v.Commit([]Change{{Filename: filename, Data: data}})
+	if err != nil {
+		return 0, err
+	}
+	return revisions[0], nil
+}
+
+// Delete records a tombstone revision for filename. The file disappears from
+// LIST and GET of the latest revision, but its history stays readable and a
+// later PUT brings it back.
+func (v *VCS) Delete(filename string) (int, error) {
+	revisions, err := v.Commit([]Change{{Filename: filename, Delete: true}})
+	if err != nil {
+		return 0, err
+	}
+	return revisions[0], nil
 }
 
-func (v *VCS) Put(filename string, data []byte) int {
+// Commit applies changes in order as one atomic step: readers see all of them
+// or none, and so does the store after a crash. It returns the revision each
+// change left its file at. Uploads are consumed whether or not it succeeds.
+func (v *VCS) Commit(changes []Change) ([]int, error) {
+	for i, c := range changes {
+		if c.Upload == nil && !c.Delete {
+			u, err := v.Stage(bytes.NewReader(c.Data), len(c.Data))
+			if err != nil {
+				discardUploads(changes)
+				return nil, err
+			}
+			changes[i].Upload = u
+		}
+	}
+	defer discardUploads(changes)
+
 	v.mu.Lock()
 	defer v.mu.Unlock()
 
-	vf, ok := v.files[filename]
+	// latest tracks each file as the earlier changes in this commit leave it
+	type state struct {
+		number  int
+		hash    string
+		size    int
+		deleted bool
+	}
+	latest := make(map[string]state)
+	now := time.Now().UTC()
+
+	var revs []Revision
+	numbers := make([]int, len(changes))
+	for i, c := range changes {
+		st, ok := latest[c.Filename]
+		if !ok {
+			if vf, exists := v.files[c.Filename]; exists {
+				f := vf.Versions[len(vf.Versions)-1]
+				st = state{number: len(vf.Versions), hash: f.Hash, size: f.Size, deleted: f.Deleted}
+			} else {
+				st = state{deleted: true}
+			}
+		}
+
+		rev := Revision{Filename: c.Filename, Number: st.number + 1, Time: now}
+		if c.Delete {
+			if st.deleted {
+				return nil, fmt.Errorf("no such file")
+			}
+			rev.Deleted = true
+		} else {
+			u := c.Upload
+			if !st.deleted && st.hash == u.Hash {
+				numbers[i] = st.number
+				continue
+			}
+			var base string
+			if !st.deleted && st.size <= maxDeltaSize {
+				base = st.hash
+			}
+			// Successive revisions of a file usually differ by a small edit,
+			// so store this one as a delta against the previous one where
+			// possible
+			if err := v.writeContent(u, base); err != nil {
+				return nil, err
+			}
+			rev.Hash, rev.Size = u.Hash, u.Size
+		}
+
+		revs = append(revs, rev)
+		latest[c.Filename] = state{number: rev.Number, hash: rev.Hash, size: rev.Size, deleted: rev.Deleted}
+		numbers[i] = rev.Number
+	}
+
+	if len(revs) > 0 {
+		if err := v.store.AppendRevisions(revs...); err != nil {
+			return nil, err
+		}
+	}
+	for _, rev := range revs {
+		v.addRevision(rev)
+	}
+	return numbers, nil
+}
+
+// discardUploads drops every upload that was not committed.
+func discardUploads(changes []Change) {
+	for _, c := range changes {
+		if c.Upload != nil {
+			c.Upload.Discard()
+		}
+	}
+}
+
+// addRevision appends rev to the index, which must already hold every earlier
+// revision of the file.
+func (v *VCS) addRevision(rev Revision) {
+	vf, ok := v.files[rev.Filename]
 	if !ok {
 		vf = &VersionedFile{Versions: make([]*File, 0)}
-		v.files[filename] = vf
+		v.files[rev.Filename] = vf
+	}
+	vf.Versions = append(vf.Versions, &File{Hash: rev.Hash, Size: rev.Size, Time: rev.Time, Deleted: rev.Deleted})
+
+	if rev.Deleted {
+		v.tree.remove(rev.Filename)
+	} else {
+		v.tree.set(rev.Filename, rev.Number)
+	}
+}
+
+// resolve finds the revision of filename named by revision, which is
+// "latest", "rN", "N" or a tag name.
+func (v *VCS) resolve(filename, revision string) (*VersionedFile, int, error) {
+	vf, ok := v.files[filename]
+	if !ok {
+		return nil, 0, fmt.Errorf("no such file")
+	}
+
+	if tree, ok := v.tags[revision]; ok {
+		r := tree.lookup(filename)
+		if r == 0 {
+			return nil, 0, fmt.Errorf("no such file")
+		}
+		return vf, r, nil
+	}
+	r, err := vf.revision(revision)
+	return vf, r, err
+}
+
+// lookup returns the revision of filename named by revision, which must not
+// be a tombstone.
+func (v *VCS) lookup(filename string, revision string) (*File, error) {
+	vf, r, err := v.resolve(filename, revision)
+	if err != nil {
+		return nil, err
 	}
-	if n := len(vf.Versions); n > 0 && bytes.Equal(vf.Versions[n-1].Data, data) {
-		return n
+	if vf.Versions[r-1].Deleted {
+		if revision == "latest" {
+			return nil, fmt.Errorf("no such file")
+		}
+		return nil, fmt.Errorf("no such revision")
 	}
-	vf.Versions = append(vf.Versions, &File{Data: data})
-	return len(vf.Versions)
+	return vf.Versions[r-1], nil
 }
 
 func (v *VCS) Get(filename string, revision string) ([]byte, error) {
 	v.mu.RLock()
 	defer v.mu.RUnlock()
 
-	vf, ok := v.files[filename]
-	if !ok {
-		return nil, fmt.Errorf("no such file")
+	f, err := v.lookup(filename, revision)
+	if err != nil {
+		return nil, err
 	}
+	return v.readContent(f.Hash)
+}
 
-	var r int
-	var err error
-	if revision == "latest" {
-		r = len(vf.Versions)
-	} else {
-		if revision[0] == 'r' {
-			r, err = strconv.Atoi(revision[1:])
-		} else {
-			r, err = strconv.Atoi(revision)
-		}
-		if err != nil || r <= 0 || r > len(vf.Versions) {
-			return nil, fmt.Errorf("no such revision")
+// isRevisionName reports whether name is a revision rather than a tag.
+func isRevisionName(name string) bool {
+	if name == "latest" {
+		return true
+	}
+	_, err := strconv.Atoi(strings.TrimPrefix(name, "r"))
+	return err == nil
+}
+
+func isValidTagName(name string) bool {
+	if name == "" || isRevisionName(name) {
+		return false
+	}
+	for _, char := range name {
+		if (char >= 'a' && char <= 'z') ||
+			(char >= 'A' && char <= 'Z') ||
+			(char >= '0' && char <= '9') ||
+			char == '-' || char == '_' || char == '.' {
+			continue
 		}
+		return false
+	}
+	return true
+}
+
+// Tag records the latest revision of every file that has not been deleted
+// under name, and returns how many files it covers.
+func (v *VCS) Tag(name string) (int, error) {
+	if !isValidTagName(name) {
+		return 0, fmt.Errorf("illegal tag name")
 	}
 
-	return vf.Versions[r-1].Data, nil
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if _, ok := v.tags[name]; ok {
+		return 0, fmt.Errorf("tag already exists")
+	}
+	tag := Tag{Name: name, Time: time.Now().UTC(), Files: make(map[string]int)}
+	for filename, vf := range v.files {
+		if !vf.Deleted() {
+			tag.Files[filename] = len(vf.Versions)
+		}
+	}
+	if err := v.store.AppendTag(tag); err != nil {
+		return 0, err
+	}
+	v.tags[name] = v.tree.clone()
+	return len(tag.Files), nil
 }
 
-func (v *VCS) GetLatestVersion(filename string) int {
+// Log returns every revision of filename, oldest first.
+func (v *VCS) Log(filename string) ([]Revision, error) {
 	v.mu.RLock()
 	defer v.mu.RUnlock()
 
 	vf, ok := v.files[filename]
 	if !ok {
-		return 0
+		return nil, fmt.Errorf("no such file")
 	}
 
-	return len(vf.Versions)
+	revisions := make([]Revision, len(vf.Versions))
+	for i, f := range vf.Versions {
+		revisions[i] = Revision{
+			Filename: filename,
+			Number:   i + 1,
+			Hash:     f.Hash,
+			Size:     f.Size,
+			Time:     f.Time,
+			Deleted:  f.Deleted,
+		}
+	}
+	return revisions, nil
 }
 
-func (v *VCS) List(dir string) ([]string, []string, error) {
+// Diff returns a unified diff from revision ra to revision rb of filename. A
+// tombstone diffs as an empty file.
+func (v *VCS) Diff(filename, ra, rb string) (string, error) {
 	v.mu.RLock()
 	defer v.mu.RUnlock()
 
-	// Normalize directory path - ensure it ends with /
-	if !strings.HasSuffix(dir, "/") {
-		dir = dir + "/"
+	var names [2]string
+	var contents [2][]byte
+	for i, revision := range []string{ra, rb} {
+		vf, r, err := v.resolve(filename, revision)
+		if err != nil {
+			return "", err
+		}
+		names[i] = filename + " r" + strconv.Itoa(r)
+		if f := vf.Versions[r-1]; !f.Deleted {
+			if contents[i], err = v.readContent(f.Hash); err != nil {
+				return "", err
+			}
+		}
 	}
+	return unifiedDiff(names[0], names[1], contents[0], contents[1]), nil
+}
 
-	files := make([]string, 0)
-	dirSet := make(map[string]bool) // Use map to track unique directories
+// Usage compares the size of every revision ever put with what the store
+// actually holds.
+type Usage struct {
+	Files        int
+	Revisions    int
+	LogicalBytes int64
+	StorageUsage
+}
 
-	for file := range v.files {
-		if after, ok := strings.CutPrefix(file, dir); ok {
-			// Get the relative path after the directory
-			relativePath := after
+func (u Usage) String() string {
+	ratio := 0.0
+	if u.LogicalBytes > 0 {
+		ratio = float64(u.Bytes) / float64(u.LogicalBytes)
+	}
+	return fmt.Sprintf("%d files, %d revisions, %d bytes of content stored in %d blobs taking %d bytes (%.1f%%)",
+		u.Files, u.Revisions, u.LogicalBytes, u.Blobs, u.Bytes, ratio*100)
+}
 
-			if strings.Contains(relativePath, "/") {
-				// It's in a subdirectory - extract the first directory component
-				dirName := strings.Split(relativePath, "/")[0]
-				dirSet[dirName] = true
-			} else if relativePath != "" {
-				// It's a file directly in this directory
-				files = append(files, relativePath)
-			}
+func (v *VCS) Usage() Usage {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	u := Usage{Files: len(v.files), StorageUsage: v.store.Usage()}
+	for _, vf := range v.files {
+		u.Revisions += len(vf.Versions)
+		for _, f := range vf.Versions {
+			u.LogicalBytes += int64(f.Size)
 		}
 	}
+	return u
+}
 
-	// Convert map keys to slice
-	directories := make([]string, 0, len(dirSet))
-	for dir := range dirSet {
-		directories = append(directories, dir)
-	}
+// List returns the subdirectories and files in dir along with each file's
+// revision, as of tag if it is not empty. It takes time in proportion to the
+// number of entries in dir, not the size of the repository.
+func (v *VCS) List(dir string, tag string) ([]ListEntry, error) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
 
-	sort.Strings(files)
-	sort.Strings(directories)
-	return files, directories, nil
+	tree := v.tree
+	if tag != "" {
+		var ok bool
+		if tree, ok = v.tags[tag]; !ok {
+			return nil, fmt.Errorf("no such tag")
+		}
+	}
+	return tree.list(dir), nil
 }
 
 var port = flag.String("port", "50001", "Port to listen on")
+var maxFileSize = flag.Int("max-file-size", 64<<20, "Largest file PUT will accept, in bytes")
+var maxMemoryFileSize = flag.Int("max-memory-file-size", 1<<20, "Largest file PUT will accept without -data-dir, in bytes")
+var dataDir = flag.String("data-dir", "", "Directory for persistent storage (in-memory if empty)")
+
+// fileSizeLimit is the largest file PUT accepts. Without -data-dir every
+// upload and revision is held in memory, so the cap is lower.
+func fileSizeLimit(vcs *VCS) int {
+	if _, inMemory := vcs.store.(*MemoryStorage); inMemory {
+		return min(*maxFileSize, *maxMemoryFileSize)
+	}
+	return *maxFileSize
+}
 
 func main() {
 	flag.Parse()
@@ -162,7 +478,24 @@ func main() {
 		ln.Close()
 	}()
 
-	vcs := &VCS{files: make(map[string]*VersionedFile)}
+	var store Storage
+	if *dataDir == "" {
+		store = NewMemoryStorage()
+	} else {
+		store, err = OpenDiskStorage(*dataDir)
+		if err != nil {
+			panic(err)
+		}
+		log.Println("Storing repository in", *dataDir)
+	}
+	defer store.Close()
+
+	vcs, err := NewVCS(store)
+	if err != nil {
+		panic(err)
+	}
+	log.Println("Storage usage:", vcs.Usage())
+	defer func() { log.Println("Storage usage:", vcs.Usage()) }()
 
 	for {
 		conn, err := ln.Accept()
@@ -236,6 +569,11 @@ func handleConnection(conn net.Conn, vcs *VCS) {
 	reader := bufio.NewReader(conn)
 	writer := bufio.NewWriter(conn)
 
+	// Changes staged by PUT and DELETE between BEGIN and COMMIT, nil outside
+	// a transaction
+	var staged []Change
+	defer func() { discardUploads(staged) }()
+
 	// Helper function to write a line and flush
 	writeLine := func(s string) error {
 		if _, err := writer.WriteString(s + "\n"); err != nil {
@@ -252,7 +590,7 @@ func handleConnection(conn net.Conn, vcs *VCS) {
 	}
 
 	handleHelp := func() {
-		writeLine("OK usage: HELP|GET|PUT|LIST")
+		writeLine("OK usage: HELP|GET|PUT|LIST|LOG|DIFF|DELETE|BEGIN|COMMIT|ABORT|TAG")
 		writeLine("READY")
 	}
 
@@ -267,14 +605,20 @@ func handleConnection(conn net.Conn, vcs *VCS) {
 		if len(parts) == 3 {
 			revision = parts[2]
 		}
-		data, err := vcs.Get(filename, revision)
+		rc, size, err := vcs.Open(filename, revision)
 		if err != nil {
 			writeLine("ERR " + err.Error())
 			writeLine("READY")
 			return
 		}
-		writeLine("OK " + fmt.Sprint(len(data)))
-		writeData(data)
+		defer rc.Close()
+		writeLine("OK " + fmt.Sprint(size))
+		if _, err := io.CopyN(writer, rc, int64(size)); err != nil {
+			// The length has been sent, so the client can't be told
+			log.Println("Get error:", err)
+			conn.Close()
+			return
+		}
 		writeLine("READY")
 	}
 
@@ -291,41 +635,68 @@ func handleConnection(conn net.Conn, vcs *VCS) {
 			return
 		}
 		length, err := strconv.Atoi(parts[2])
-		if err != nil {
+		if err != nil || length < 0 {
 			writeLine("ERR usage: PUT file length newline data")
 			writeLine("READY")
+			return
 		}
-		if length < 0 {
-			writeLine("ERR usage: PUT file length newline data")
-			writeLine("READY")
+		if length > fileSizeLimit(vcs) {
+			// Rather than read that much only to throw it away, hang up
+			writeLine("ERR file too large")
+			conn.Close()
+			return
 		}
-		data := make([]byte, length)
-		_, err = io.ReadFull(reader, data)
-		log.Println("Read data:", string(data))
+		data := &io.LimitedReader{R: reader, N: int64(length)}
+
+		upload, err := vcs.Stage(textReader{data}, length)
 		if err != nil {
-			writeLine("ERR usage: PUT file length newline data")
+			// Skip the rest of the data so the next request lines up
+			if _, err := io.Copy(io.Discard, data); err != nil || data.N > 0 {
+				log.Println("Read error:", err)
+				conn.Close()
+				return
+			}
+			switch {
+			case errors.Is(err, errNotText):
+				writeLine("ERR text files only")
+			case errors.Is(err, io.ErrUnexpectedEOF):
+				writeLine("ERR usage: PUT file length newline data")
+			default:
+				log.Println("Put error:", err)
+				writeLine("ERR storage failure")
+			}
 			writeLine("READY")
 			return
 		}
 
-		// Validate that data is text only
-		if !isValidTextData(data) {
-			writeLine("ERR text files only")
+		if staged != nil {
+			staged = append(staged, Change{Filename: fileName, Upload: upload})
+			writeLine("OK staged")
 			writeLine("READY")
 			return
 		}
 
-		revision := vcs.Put(fileName, data)
-		writeLine("OK r" + strconv.Itoa(revision))
+		revisions, err := vcs.Commit([]Change{{Filename: fileName, Upload: upload}})
+		if err != nil {
+			log.Println("Put error:", err)
+			writeLine("ERR storage failure")
+			writeLine("READY")
+			return
+		}
+		writeLine("OK r" + strconv.Itoa(revisions[0]))
 		writeLine("READY")
 	}
 
 	handleList := func(parts []string) {
-		if len(parts) != 2 {
-			writeLine("ERR usage: LIST dir")
+		if len(parts) != 2 && len(parts) != 3 {
+			writeLine("ERR usage: LIST dir [tag]")
 			writeLine("READY")
 			return
 		}
+		tag := ""
+		if len(parts) == 3 {
+			tag = parts[2]
+		}
 
 		dir := parts[1]
 		if !isValidDirectory(dir) {
@@ -334,25 +705,161 @@ func handleConnection(conn net.Conn, vcs *VCS) {
 			return
 		}
 
-		files, directories, err := vcs.List(dir)
+		entries, err := vcs.List(dir, tag)
+		if err != nil {
+			writeLine("ERR " + err.Error())
+			writeLine("READY")
+			return
+		}
+		writeLine("OK " + strconv.Itoa(len(entries)))
+
+		for _, entry := range entries {
+			if entry.Dir {
+				writeLine(entry.Name + "/" + " DIR")
+			} else {
+				writeLine(entry.Name + " r" + strconv.Itoa(entry.Revision))
+			}
+		}
+
+		writeLine("READY")
+
+	}
+
+	handleLog := func(parts []string) {
+		if len(parts) != 2 {
+			writeLine("ERR usage: LOG file")
+			writeLine("READY")
+			return
+		}
+		revisions, err := vcs.Log(parts[1])
+		if err != nil {
+			writeLine("ERR " + err.Error())
+			writeLine("READY")
+			return
+		}
+		writeLine("OK " + strconv.Itoa(len(revisions)))
+		for _, rev := range revisions {
+			size := strconv.Itoa(rev.Size)
+			if rev.Deleted {
+				size = "deleted"
+			}
+			writeLine("r" + strconv.Itoa(rev.Number) + " " + size + " " + rev.Time.Format(time.RFC3339))
+		}
+		writeLine("READY")
+	}
+
+	handleDiff := func(parts []string) {
+		if len(parts) != 4 {
+			writeLine("ERR usage: DIFF file revision revision")
+			writeLine("READY")
+			return
+		}
+		diff, err := vcs.Diff(parts[1], parts[2], parts[3])
+		if err != nil {
+			writeLine("ERR " + err.Error())
+			writeLine("READY")
+			return
+		}
+		writeLine("OK " + strconv.Itoa(len(diff)))
+		writeData([]byte(diff))
+		writeLine("READY")
+	}
+
+	handleDelete := func(parts []string) {
+		if len(parts) != 2 {
+			writeLine("ERR usage: DELETE file")
+			writeLine("READY")
+			return
+		}
+		if !isValidFilename(parts[1]) {
+			writeLine("ERR illegal file name")
+			writeLine("READY")
+			return
+		}
+		if staged != nil {
+			staged = append(staged, Change{Filename: parts[1], Delete: true})
+			writeLine("OK staged")
+			writeLine("READY")
+			return
+		}
+
+		revision, err := vcs.Delete(parts[1])
 		if err != nil {
-			log.Println("List error:", err)
+			writeLine("ERR " + err.Error())
+			writeLine("READY")
 			return
 		}
-		log.Println("files:", files)
-		log.Println("directories:", directories)
-		total := len(files) + len(directories)
-		writeLine("OK " + strconv.Itoa(total))
+		writeLine("OK r" + strconv.Itoa(revision))
+		writeLine("READY")
+	}
 
-		for _, directory := range directories {
-			writeLine(directory + "/" + " DIR")
+	handleBegin := func(parts []string) {
+		if len(parts) != 1 {
+			writeLine("ERR usage: BEGIN")
+		} else if staged != nil {
+			writeLine("ERR transaction already open")
+		} else {
+			staged = make([]Change, 0)
+			writeLine("OK")
 		}
-		for _, file := range files {
-			writeLine(file + " r" + strconv.Itoa(vcs.GetLatestVersion(file)))
+		writeLine("READY")
+	}
+
+	handleCommit := func(parts []string) {
+		if len(parts) != 1 {
+			writeLine("ERR usage: COMMIT")
+			writeLine("READY")
+			return
+		}
+		if staged == nil {
+			writeLine("ERR no transaction")
+			writeLine("READY")
+			return
+		}
+		changes := staged
+		staged = nil
+
+		revisions, err := vcs.Commit(changes)
+		if err != nil {
+			log.Println("Commit error:", err)
+			writeLine("ERR " + err.Error())
+			writeLine("READY")
+			return
+		}
+		writeLine("OK " + strconv.Itoa(len(changes)))
+		for i, c := range changes {
+			writeLine(c.Filename + " r" + strconv.Itoa(revisions[i]))
 		}
+		writeLine("READY")
+	}
 
+	handleAbort := func(parts []string) {
+		if len(parts) != 1 {
+			writeLine("ERR usage: ABORT")
+		} else if staged == nil {
+			writeLine("ERR no transaction")
+		} else {
+			discardUploads(staged)
+			staged = nil
+			writeLine("OK")
+		}
 		writeLine("READY")
+	}
 
+	handleTag := func(parts []string) {
+		if len(parts) != 2 {
+			writeLine("ERR usage: TAG name")
+			writeLine("READY")
+			return
+		}
+		files, err := vcs.Tag(parts[1])
+		if err != nil {
+			writeLine("ERR " + err.Error())
+			writeLine("READY")
+			return
+		}
+		writeLine("OK " + strconv.Itoa(files))
+		writeLine("READY")
 	}
 
 	// Send initial READY message
@@ -384,6 +891,20 @@ func handleConnection(conn net.Conn, vcs *VCS) {
 			handlePut(parts)
 		case "LIST":
 			handleList(parts)
+		case "LOG":
+			handleLog(parts)
+		case "DIFF":
+			handleDiff(parts)
+		case "DELETE":
+			handleDelete(parts)
+		case "BEGIN":
+			handleBegin(parts)
+		case "COMMIT":
+			handleCommit(parts)
+		case "ABORT":
+			handleAbort(parts)
+		case "TAG":
+			handleTag(parts)
 		default:
 			writeLine("ERR illegal method: " + parts[0])
 			return
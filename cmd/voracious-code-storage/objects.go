@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// Blobs hold an encoded object rather than raw file content. The first byte
+// says how to read the rest:
+//
+//	objFull   content
+//	objDelta  32-byte base hash, uvarint chain depth, delta against base
+//
+// Both kinds are stored under the hash of the content they decode to, so
+// dedup across files works exactly as it did for raw blobs. File content is
+// text only and can never start with either kind byte, so a blob starting
+// with anything else is raw content written before objects existed.
+const (
+	objFull  byte = 0x01
+	objDelta byte = 0x02
+)
+
+// defaultMaxChain bounds how many deltas Get may have to apply to rebuild a
+// revision. Every revision that would exceed it is stored in full.
+const defaultMaxChain = 16
+
+// maxChainWalk stops readContent looping forever on a corrupt chain.
+const maxChainWalk = 1 << 10
+
+var errBadObject = errors.New("malformed object")
+
+type object struct {
+	base  string // hash of the base content for a delta, empty if full
+	depth int    // number of deltas between this object and a full one
+	data  []byte // content, or a delta against base
+}
+
+func encodeObject(obj object) []byte {
+	if obj.base == "" {
+		return append([]byte{objFull}, obj.data...)
+	}
+	base, _ := hex.DecodeString(obj.base)
+	out := append([]byte{objDelta}, base...)
+	out = binary.AppendUvarint(out, uint64(obj.depth))
+	return append(out, obj.data...)
+}
+
+func decodeObject(blob []byte) (object, error) {
+	if len(blob) == 0 {
+		return object{}, nil
+	}
+	switch blob[0] {
+	case objFull:
+		return object{data: blob[1:]}, nil
+	case objDelta:
+		if len(blob) < 1+32 {
+			return object{}, errBadObject
+		}
+		depth, n := binary.Uvarint(blob[33:])
+		if n <= 0 {
+			return object{}, errBadObject
+		}
+		return object{
+			base:  hex.EncodeToString(blob[1:33]),
+			depth: int(depth),
+			data:  blob[33+n:],
+		}, nil
+	default:
+		return object{data: blob}, nil
+	}
+}
+
+// readObject returns the decoded object stored under hash.
+func (v *VCS) readObject(hash string) (object, error) {
+	blob, err := v.store.ReadBlob(hash)
+	if err != nil {
+		return object{}, err
+	}
+	return decodeObject(blob)
+}
+
+// readContent rebuilds the content stored under hash by walking back to the
+// nearest full object and applying each delta on the way forward.
+func (v *VCS) readContent(hash string) ([]byte, error) {
+	var chain []object
+	next := hash
+	for {
+		obj, err := v.readObject(next)
+		if err != nil {
+			return nil, err
+		}
+		if obj.base == "" {
+			chain = append(chain, obj)
+			break
+		}
+		if len(chain) >= maxChainWalk {
+			return nil, fmt.Errorf("delta chain for %s is too long", hash)
+		}
+		chain = append(chain, obj)
+		next = obj.base
+	}
+
+	data := chain[len(chain)-1].data
+	for i := len(chain) - 2; i >= 0; i-- {
+		var err error
+		if data, err = applyDelta(data, chain[i].data); err != nil {
+			return nil, fmt.Errorf("blob %s: %w", hash, err)
+		}
+	}
+	if hashData(data) != hash {
+		return nil, fmt.Errorf("blob %s is corrupt", hash)
+	}
+	return data, nil
+}
+
+// writeContent commits u under its hash, or a delta against base in its
+// place if that is much smaller and keeps the chain within v.maxChain.
+func (v *VCS) writeContent(u *Upload, base string) error {
+	if ok, err := v.store.HasBlob(u.Hash); err != nil || ok {
+		return err
+	}
+
+	depth := 0
+	if base != "" && u.data != nil && v.maxChain > 0 {
+		if delta, d, ok := v.deltaAgainst(base, u.data); ok {
+			obj := object{base: base, depth: d, data: delta}
+			if err := v.store.WriteBlob(u.Hash, encodeObject(obj)); err != nil {
+				return err
+			}
+			u.Discard()
+			depth = d
+		}
+	}
+	if u.blob != nil {
+		if err := u.blob.Commit(u.Hash); err != nil {
+			return err
+		}
+		u.blob = nil
+	}
+
+	if u.data != nil {
+		v.last = content{hash: u.Hash, depth: depth, data: u.data}
+	}
+	return nil
+}
+
+// content is rebuilt file content along with the depth of its object.
+type content struct {
+	hash  string
+	depth int
+	data  []byte
+}
+
+func (v *VCS) deltaAgainst(base string, data []byte) ([]byte, int, bool) {
+	// Successive puts to the same file need not rebuild the base
+	c := v.last
+	if c.hash != base {
+		obj, err := v.readObject(base)
+		if err != nil || obj.depth+1 > v.maxChain {
+			return nil, 0, false
+		}
+		c = content{hash: base, depth: obj.depth}
+		if c.data, err = v.readContent(base); err != nil {
+			return nil, 0, false
+		}
+	}
+	if c.depth+1 > v.maxChain {
+		return nil, 0, false
+	}
+
+	delta := makeDelta(c.data, data)
+	if len(delta) > len(data)/2 {
+		return nil, 0, false
+	}
+	return delta, c.depth + 1, true
+}
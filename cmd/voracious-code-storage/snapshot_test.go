@@ -0,0 +1,167 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCommitIsAtomic(t *testing.T) {
+	vcs := newMemoryVCS(t)
+	mustPut(t, vcs, "/a.txt", "one\n")
+
+	revisions, err := vcs.Commit([]Change{
+		{Filename: "/a.txt", Data: []byte("two\n")},
+		{Filename: "/b.txt", Data: []byte("bee\n")},
+		{Filename: "/a.txt", Data: []byte("two\n")},
+		{Filename: "/a.txt", Data: []byte("three\n")},
+		{Filename: "/b.txt", Delete: true},
+	})
+	if err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if want := []int{2, 1, 2, 3, 2}; !reflect.DeepEqual(revisions, want) {
+		t.Errorf("Commit = %v, want %v", revisions, want)
+	}
+	expectGet(t, vcs, "/a.txt", "r2", "two\n")
+	expectGet(t, vcs, "/a.txt", "latest", "three\n")
+	expectGet(t, vcs, "/b.txt", "r1", "bee\n")
+
+	// A change that fails takes the rest of the commit with it
+	_, err = vcs.Commit([]Change{
+		{Filename: "/a.txt", Data: []byte("four\n")},
+		{Filename: "/missing.txt", Delete: true},
+	})
+	if err == nil {
+		t.Fatal("Commit deleting a missing file succeeded, want error")
+	}
+	expectList(t, vcs, "/", "", "a.txt r3")
+}
+
+func TestCommitSurvivesRestartWhole(t *testing.T) {
+	dir := t.TempDir()
+
+	vcs, store := openDiskVCS(t, dir)
+	mustPut(t, vcs, "/a.txt", "one\n")
+	logPath := filepath.Join(dir, "revisions.log")
+	before, err := os.Stat(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vcs.Commit([]Change{
+		{Filename: "/a.txt", Data: []byte("two\n")},
+		{Filename: "/b.txt", Data: []byte("bee\n")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	// Reopening keeps the whole commit
+	vcs, store = openDiskVCS(t, dir)
+	expectGet(t, vcs, "/a.txt", "r2", "two\n")
+	expectGet(t, vcs, "/b.txt", "r1", "bee\n")
+	after, err := os.Stat(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	// A crash part way through writing it loses all of it
+	if err := os.Truncate(logPath, (before.Size()+after.Size())/2); err != nil {
+		t.Fatal(err)
+	}
+	vcs, _ = openDiskVCS(t, dir)
+	expectList(t, vcs, "/", "", "a.txt r1")
+}
+
+func TestTags(t *testing.T) {
+	dir := t.TempDir()
+
+	vcs, store := openDiskVCS(t, dir)
+	mustPut(t, vcs, "/src/a.txt", "a1\n")
+	mustPut(t, vcs, "/src/b.txt", "b1\n")
+	mustPut(t, vcs, "/src/old.txt", "old\n")
+	vcs.Delete("/src/old.txt")
+
+	if n, err := vcs.Tag("v1"); err != nil || n != 2 {
+		t.Fatalf("Tag(v1) = %d, %v, want 2 files", n, err)
+	}
+	for _, name := range []string{"v1", "r2", "latest", "7", "bad/name", ""} {
+		if _, err := vcs.Tag(name); err == nil {
+			t.Errorf("Tag(%q) succeeded, want error", name)
+		}
+	}
+
+	mustPut(t, vcs, "/src/a.txt", "a2\n")
+	mustPut(t, vcs, "/src/new/c.txt", "c1\n")
+	vcs.Delete("/src/b.txt")
+	store.Close()
+
+	vcs, _ = openDiskVCS(t, dir)
+	expectGet(t, vcs, "/src/a.txt", "v1", "a1\n")
+	expectGet(t, vcs, "/src/a.txt", "latest", "a2\n")
+	expectGet(t, vcs, "/src/b.txt", "v1", "b1\n")
+	if _, err := vcs.Get("/src/new/c.txt", "v1"); err == nil {
+		t.Error("Get of file created after the tag succeeded, want error")
+	}
+	if _, err := vcs.Get("/src/a.txt", "v2"); err == nil {
+		t.Error("Get with unknown tag succeeded, want error")
+	}
+
+	expectList(t, vcs, "/src", "v1", "a.txt r1", "b.txt r1")
+	expectList(t, vcs, "/src", "", "new/ DIR", "a.txt r2")
+	if _, err := vcs.List("/src", "v2"); err == nil {
+		t.Error("List with unknown tag succeeded, want error")
+	}
+}
+
+func TestTransactionCommands(t *testing.T) {
+	vcs := newMemoryVCS(t)
+	s := startSession(t, vcs)
+	other := startSession(t, vcs)
+
+	s.send("BEGIN")
+	s.expect("OK", "READY")
+	s.send("BEGIN")
+	s.expect("ERR transaction already open", "READY")
+	s.send("PUT /a.txt 4\none")
+	s.expect("OK staged", "READY")
+	s.send("PUT /b.txt 4\nbee")
+	s.expect("OK staged", "READY")
+
+	// Nothing is visible until the commit
+	other.send("LIST /")
+	other.expect("OK 0", "READY")
+
+	s.send("COMMIT")
+	s.expect("OK 2", "/a.txt r1", "/b.txt r1", "READY")
+	other.send("LIST /")
+	other.expect("OK 2", "a.txt r1", "b.txt r1", "READY")
+
+	s.send("BEGIN")
+	s.expect("OK", "READY")
+	s.send("PUT /a.txt 4\ntwo")
+	s.expect("OK staged", "READY")
+	s.send("DELETE /b//a.txt")
+	s.expect("ERR illegal file name", "READY")
+	s.send("ABORT")
+	s.expect("OK", "READY")
+	s.send("COMMIT")
+	s.expect("ERR no transaction", "READY")
+	s.send("GET /a.txt")
+	s.expectData("one\n")
+	s.expect("READY")
+
+	s.send("TAG release")
+	s.expect("OK 2", "READY")
+	s.send("PUT /a.txt 4\ntwo")
+	s.expect("OK r2", "READY")
+	s.send("LIST / release")
+	s.expect("OK 2", "a.txt r1", "b.txt r1", "READY")
+	s.send("GET /a.txt release")
+	s.expectData("one\n")
+	s.expect("READY")
+	s.send("LIST / nope")
+	s.expect("ERR no such tag", "READY")
+}
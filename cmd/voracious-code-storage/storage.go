@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Revision records one version of a file. Its content lives in the blob
+// named by Hash. A deleted revision is a tombstone with no content.
+type Revision struct {
+	Filename string    `json:"filename"`
+	Number   int       `json:"number"`
+	Hash     string    `json:"hash"`
+	Size     int       `json:"size"`
+	Time     time.Time `json:"time"`
+	Deleted  bool      `json:"deleted,omitempty"`
+}
+
+// Tag names a snapshot of the latest revision of every file.
+type Tag struct {
+	Name  string         `json:"name"`
+	Time  time.Time      `json:"time"`
+	Files map[string]int `json:"files"`
+}
+
+// Storage persists revisions and the content they refer to. Blobs are
+// content-addressed, so identical content is only stored once no matter how
+// many files or revisions refer to it.
+type Storage interface {
+	// WriteBlob stores data under hash. Writing a hash that already exists
+	// is a no-op.
+	WriteBlob(hash string, data []byte) error
+
+	// CreateBlob starts a blob whose hash is not known until all of it has
+	// been written.
+	CreateBlob() (BlobWriter, error)
+
+	// ReadBlob returns the data stored under hash.
+	ReadBlob(hash string) ([]byte, error)
+
+	// OpenBlob streams the data stored under hash.
+	OpenBlob(hash string) (io.ReadCloser, error)
+
+	// HasBlob reports whether anything is stored under hash.
+	HasBlob(hash string) (bool, error)
+
+	// AppendRevisions records revs. Once it returns nil the revisions must
+	// survive a restart, and a crash part way through must keep either all
+	// of them or none.
+	AppendRevisions(revs ...Revision) error
+
+	// Revisions returns every recorded revision in the order it was
+	// appended.
+	Revisions() ([]Revision, error)
+
+	// AppendTag records tag. Once it returns nil the tag must survive a
+	// restart.
+	AppendTag(tag Tag) error
+
+	// Tags returns every recorded tag in the order it was appended.
+	Tags() ([]Tag, error)
+
+	// Usage reports how much space the store is taking.
+	Usage() StorageUsage
+
+	Close() error
+}
+
+// BlobWriter streams a blob into a store. Nothing is visible under any hash
+// until Commit.
+type BlobWriter interface {
+	io.Writer
+
+	// Commit stores what was written under hash. If hash already exists the
+	// written data is discarded.
+	Commit(hash string) error
+
+	// Abort discards what was written.
+	Abort()
+}
+
+// StorageUsage is the space a store occupies, in memory or on disk.
+type StorageUsage struct {
+	Blobs int
+	Bytes int64 // blobs plus any revision log
+}
+
+func hashData(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// MemoryStorage keeps everything in memory. Nothing survives a restart.
+type MemoryStorage struct {
+	blobs     map[string][]byte
+	blobBytes int64
+	revisions []Revision
+	tags      []Tag
+	mu        sync.RWMutex
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{blobs: make(map[string][]byte)}
+}
+
+func (m *MemoryStorage) WriteBlob(hash string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.blobs[hash]; !ok {
+		m.blobs[hash] = data
+		m.blobBytes += int64(len(data))
+	}
+	return nil
+}
+
+type memoryBlob struct {
+	m   *MemoryStorage
+	buf bytes.Buffer
+}
+
+func (m *MemoryStorage) CreateBlob() (BlobWriter, error) {
+	return &memoryBlob{m: m}, nil
+}
+
+func (b *memoryBlob) Write(p []byte) (int, error) {
+	return b.buf.Write(p)
+}
+
+func (b *memoryBlob) Commit(hash string) error {
+	return b.m.WriteBlob(hash, b.buf.Bytes())
+}
+
+func (b *memoryBlob) Abort() {}
+
+func (m *MemoryStorage) ReadBlob(hash string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	data, ok := m.blobs[hash]
+	if !ok {
+		return nil, fmt.Errorf("no such blob %s", hash)
+	}
+	return data, nil
+}
+
+func (m *MemoryStorage) OpenBlob(hash string) (io.ReadCloser, error) {
+	data, err := m.ReadBlob(hash)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m *MemoryStorage) HasBlob(hash string) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, ok := m.blobs[hash]
+	return ok, nil
+}
+
+func (m *MemoryStorage) AppendRevisions(revs ...Revision) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.revisions = append(m.revisions, revs...)
+	return nil
+}
+
+func (m *MemoryStorage) Revisions() ([]Revision, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return append([]Revision(nil), m.revisions...), nil
+}
+
+func (m *MemoryStorage) AppendTag(tag Tag) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.tags = append(m.tags, tag)
+	return nil
+}
+
+func (m *MemoryStorage) Tags() ([]Tag, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return append([]Tag(nil), m.tags...), nil
+}
+
+func (m *MemoryStorage) Usage() StorageUsage {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return StorageUsage{Blobs: len(m.blobs), Bytes: m.blobBytes}
+}
+
+func (m *MemoryStorage) Close() error {
+	return nil
+}
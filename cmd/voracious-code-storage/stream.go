@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+)
+
+// maxDeltaSize is the largest file kept in memory while it is put, so it can
+// be stored as a delta. Anything bigger streams straight into a full object.
+const maxDeltaSize = 1 << 20
+
+// streamChunk is how much of a file is read, checked and written at a time.
+const streamChunk = 32 << 10
+
+var errNotText = errors.New("text files only")
+
+// textReader fails with errNotText as soon as it reads a byte that could not
+// be part of a text file.
+type textReader struct {
+	r io.Reader
+}
+
+func (t textReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if !isValidTextData(p[:n]) {
+		return 0, errNotText
+	}
+	return n, err
+}
+
+// Upload is file content streamed into the store ahead of the commit that
+// gives it a revision.
+type Upload struct {
+	Hash string
+	Size int
+	data []byte     // the content, if small enough to delta
+	blob BlobWriter // the content as a full object until committed
+}
+
+// Discard drops an upload that will not be committed.
+func (u *Upload) Discard() {
+	if u.blob != nil {
+		u.blob.Abort()
+		u.blob = nil
+	}
+}
+
+// Stage reads exactly size bytes of content from r into the store, a chunk
+// at a time. It fails with io.ErrUnexpectedEOF if r ends early.
+func (v *VCS) Stage(r io.Reader, size int) (*Upload, error) {
+	blob, err := v.store.CreateBlob()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := blob.Write([]byte{objFull}); err != nil {
+		blob.Abort()
+		return nil, err
+	}
+
+	hash := sha256.New()
+	w := io.MultiWriter(blob, hash)
+	var kept *bytes.Buffer
+	if size <= maxDeltaSize {
+		kept = bytes.NewBuffer(make([]byte, 0, size))
+		w = io.MultiWriter(w, kept)
+	}
+
+	n, err := io.CopyBuffer(w, io.LimitReader(r, int64(size)), make([]byte, streamChunk))
+	if err == nil && n < int64(size) {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		blob.Abort()
+		return nil, err
+	}
+
+	u := &Upload{Hash: hex.EncodeToString(hash.Sum(nil)), Size: size, blob: blob}
+	if kept != nil {
+		u.data = kept.Bytes()
+	}
+	return u, nil
+}
+
+// Open streams a revision of filename, returning its size. Full objects
+// stream straight from the store; deltas are small and rebuilt in memory.
+func (v *VCS) Open(filename string, revision string) (io.ReadCloser, int, error) {
+	v.mu.RLock()
+	f, err := v.lookup(filename, revision)
+	v.mu.RUnlock()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Blobs never change once written, so there is no need to hold the
+	// lock while reading one
+	rc, err := v.store.OpenBlob(f.Hash)
+	if err != nil {
+		return nil, 0, err
+	}
+	var kind [1]byte
+	if _, err := io.ReadFull(rc, kind[:]); err != nil {
+		rc.Close()
+		if err == io.EOF {
+			return io.NopCloser(bytes.NewReader(nil)), 0, nil
+		}
+		return nil, 0, err
+	}
+
+	switch kind[0] {
+	case objFull:
+		return rc, f.Size, nil
+	case objDelta:
+		rc.Close()
+		data, err := v.readContent(f.Hash)
+		if err != nil {
+			return nil, 0, err
+		}
+		return io.NopCloser(bytes.NewReader(data)), len(data), nil
+	default:
+		// Raw content from before objects existed
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(kind[:]), rc), rc}, f.Size, nil
+	}
+}
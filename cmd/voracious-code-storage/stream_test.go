@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// tempBlobs returns the uncommitted blob files in a disk store.
+func tempBlobs(t *testing.T, dir string) []string {
+	t.Helper()
+
+	matches, err := filepath.Glob(filepath.Join(dir, "blobs", ".tmp-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return matches
+}
+
+func TestPutRejectsOversizedFile(t *testing.T) {
+	defer func(n int) { *maxFileSize = n }(*maxFileSize)
+	*maxFileSize = 16
+
+	vcs := newMemoryVCS(t)
+	s := startSession(t, vcs)
+	s.send("PUT /big.txt 17")
+	s.expect("ERR file too large")
+
+	// The connection is closed rather than made to read the data
+	if line, err := s.reader.ReadString('\n'); err != io.EOF {
+		t.Errorf("read %q, %v after an oversized PUT, want EOF", line, err)
+	}
+	s = startSession(t, vcs)
+	s.send("PUT /small.txt 16\n" + strings.Repeat("y", 15))
+	s.expect("OK r1", "READY")
+	s.send("LIST /")
+	s.expect("OK 1", "small.txt r1", "READY")
+}
+
+func TestPutInMemoryHasLowerLimit(t *testing.T) {
+	defer func(n, m int) { *maxFileSize, *maxMemoryFileSize = n, m }(*maxFileSize, *maxMemoryFileSize)
+	*maxFileSize, *maxMemoryFileSize = 32, 16
+
+	s := startSession(t, newMemoryVCS(t))
+	s.send("PUT /big.txt 17")
+	s.expect("ERR file too large")
+	if line, err := s.reader.ReadString('\n'); err != io.EOF {
+		t.Errorf("read %q, %v after an oversized PUT, want EOF", line, err)
+	}
+
+	// On disk the same file is fine
+	vcs, _ := openDiskVCS(t, t.TempDir())
+	s = startSession(t, vcs)
+	s.send("PUT /big.txt 17\n" + strings.Repeat("x", 16))
+	s.expect("OK r1", "READY")
+}
+
+func TestPutRejectsBinaryWhileStreaming(t *testing.T) {
+	dir := t.TempDir()
+	vcs, _ := openDiskVCS(t, dir)
+	s := startSession(t, vcs)
+
+	// The bad byte is in the middle of a file spanning many chunks
+	data := []byte(strings.Repeat("text\n", 4*streamChunk/5))
+	data[len(data)/2] = 0x00
+	s.send("PUT /bin.txt " + strconv.Itoa(len(data)) + "\n" + string(data[:len(data)-1]))
+	s.expect("ERR text files only", "READY")
+	s.send("LIST /")
+	s.expect("OK 0", "READY")
+
+	if tmp := tempBlobs(t, dir); len(tmp) != 0 {
+		t.Errorf("rejected put left %v behind", tmp)
+	}
+}
+
+func TestLargeFilesStream(t *testing.T) {
+	dir := t.TempDir()
+	vcs, store := openDiskVCS(t, dir)
+	s := startSession(t, vcs)
+
+	big := bytes.Repeat([]byte("0123456789abcdef\n"), maxDeltaSize/17+100)
+	s.send("PUT /big.txt " + strconv.Itoa(len(big)) + "\n" + string(big[:len(big)-1]))
+	s.expect("OK r1", "READY")
+	big2 := append([]byte("one more line\n"), big...)
+	s.send("PUT /big.txt " + strconv.Itoa(len(big2)) + "\n" + string(big2[:len(big2)-1]))
+	s.expect("OK r2", "READY")
+
+	s.send("GET /big.txt r1")
+	s.expectData(string(big))
+	s.expect("READY")
+	s.send("GET /big.txt")
+	s.expectData(string(big2))
+	s.expect("READY")
+
+	// Too big to keep in memory for a delta, so both are stored in full
+	for _, data := range [][]byte{big, big2} {
+		obj, err := vcs.readObject(hashData(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if obj.base != "" {
+			t.Errorf("%d byte file stored as a delta", len(data))
+		}
+	}
+	if u := store.Usage(); u.Bytes < int64(len(big)+len(big2)) {
+		t.Errorf("store holds %d bytes, want at least %d", u.Bytes, len(big)+len(big2))
+	}
+}
+
+func TestOpenStreamsEveryKindOfObject(t *testing.T) {
+	store := NewMemoryStorage()
+	legacy := []byte("stored before objects\n")
+	store.WriteBlob(hashData(legacy), legacy)
+	store.AppendRevisions(Revision{Filename: "/old.txt", Number: 1, Hash: hashData(legacy), Size: len(legacy)})
+	store.WriteBlob(hashData(nil), nil)
+	store.AppendRevisions(Revision{Filename: "/empty.txt", Number: 1, Hash: hashData(nil)})
+
+	vcs, err := NewVCS(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	history := editHistory(8, 100, 3)
+	for _, data := range history {
+		mustPut(t, vcs, "/new.txt", string(data))
+	}
+
+	tests := []struct {
+		filename, revision string
+		want               []byte
+	}{
+		{"/old.txt", "r1", legacy},
+		{"/empty.txt", "r1", nil},
+		{"/new.txt", "r1", history[0]},
+		{"/new.txt", "r3", history[2]},
+	}
+	for _, tt := range tests {
+		rc, size, err := vcs.Open(tt.filename, tt.revision)
+		if err != nil {
+			t.Errorf("Open(%s, %s): %v", tt.filename, tt.revision, err)
+			continue
+		}
+		got, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil || !bytes.Equal(got, tt.want) || size != len(tt.want) {
+			t.Errorf("Open(%s, %s) = %d bytes %q, %v, want %q", tt.filename, tt.revision, size, got, err, tt.want)
+		}
+	}
+}
+
+func TestAbortDiscardsUploads(t *testing.T) {
+	dir := t.TempDir()
+	vcs, _ := openDiskVCS(t, dir)
+	s := startSession(t, vcs)
+
+	s.send("BEGIN")
+	s.expect("OK", "READY")
+	s.send("PUT /a.txt 4\none")
+	s.expect("OK staged", "READY")
+	if tmp := tempBlobs(t, dir); len(tmp) != 1 {
+		t.Errorf("staged put left %d temporary blobs, want 1", len(tmp))
+	}
+	s.send("ABORT")
+	s.expect("OK", "READY")
+	if tmp := tempBlobs(t, dir); len(tmp) != 0 {
+		t.Errorf("aborted transaction left %v behind", tmp)
+	}
+}
+
+func TestOpenRemovesLeftoverTempBlobs(t *testing.T) {
+	dir := t.TempDir()
+	_, store := openDiskVCS(t, dir)
+	if _, err := store.CreateBlob(); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	openDiskVCS(t, dir)
+	if tmp := tempBlobs(t, dir); len(tmp) != 0 {
+		t.Errorf("reopening left %v behind", tmp)
+	}
+}
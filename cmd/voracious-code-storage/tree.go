@@ -0,0 +1,135 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// ListEntry is one line of a LIST response: a subdirectory, or a file and
+// its revision.
+type ListEntry struct {
+	Name     string
+	Dir      bool
+	Revision int
+}
+
+// pathTree indexes files by path component so listing a directory only
+// touches that directory's entries. It maps each file to a revision number
+// and only holds directories that have a file somewhere beneath them.
+type pathTree struct {
+	files map[string]int
+	dirs  map[string]*pathTree
+}
+
+// splitPath splits "/a/b/c" into its directories [a b] and name c.
+func splitPath(filename string) ([]string, string) {
+	parts := strings.Split(strings.Trim(filename, "/"), "/")
+	return parts[:len(parts)-1], parts[len(parts)-1]
+}
+
+func (t *pathTree) set(filename string, revision int) {
+	dirs, name := splitPath(filename)
+	node := t
+	for _, d := range dirs {
+		child, ok := node.dirs[d]
+		if !ok {
+			if node.dirs == nil {
+				node.dirs = make(map[string]*pathTree)
+			}
+			child = &pathTree{}
+			node.dirs[d] = child
+		}
+		node = child
+	}
+	if node.files == nil {
+		node.files = make(map[string]int)
+	}
+	node.files[name] = revision
+}
+
+// remove drops filename along with any directories it leaves empty.
+func (t *pathTree) remove(filename string) {
+	dirs, name := splitPath(filename)
+	path := []*pathTree{t}
+	for _, d := range dirs {
+		child, ok := path[len(path)-1].dirs[d]
+		if !ok {
+			return
+		}
+		path = append(path, child)
+	}
+	delete(path[len(path)-1].files, name)
+
+	for i := len(path) - 1; i > 0 && path[i].empty(); i-- {
+		delete(path[i-1].dirs, dirs[i-1])
+	}
+}
+
+func (t *pathTree) empty() bool {
+	return len(t.files) == 0 && len(t.dirs) == 0
+}
+
+// lookup returns the revision of filename, or 0 if it is not in the tree.
+func (t *pathTree) lookup(filename string) int {
+	dirs, name := splitPath(filename)
+	if node := t.dir(dirs); node != nil {
+		return node.files[name]
+	}
+	return 0
+}
+
+// dir returns the node for the directory with the given components, or nil.
+func (t *pathTree) dir(components []string) *pathTree {
+	node := t
+	for _, d := range components {
+		if node = node.dirs[d]; node == nil {
+			return nil
+		}
+	}
+	return node
+}
+
+// list returns the entries of dir, subdirectories first, each sorted by name.
+func (t *pathTree) list(dir string) []ListEntry {
+	var components []string
+	if trimmed := strings.Trim(dir, "/"); trimmed != "" {
+		components = strings.Split(trimmed, "/")
+	}
+	node := t.dir(components)
+	if node == nil {
+		return []ListEntry{}
+	}
+
+	entries := make([]ListEntry, 0, len(node.dirs)+len(node.files))
+	for name := range node.dirs {
+		entries = append(entries, ListEntry{Name: name, Dir: true})
+	}
+	for name, revision := range node.files {
+		entries = append(entries, ListEntry{Name: name, Revision: revision})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Dir != entries[j].Dir {
+			return entries[i].Dir
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	return entries
+}
+
+// clone returns a deep copy of the tree.
+func (t *pathTree) clone() *pathTree {
+	c := &pathTree{}
+	if len(t.files) > 0 {
+		c.files = make(map[string]int, len(t.files))
+		for name, revision := range t.files {
+			c.files[name] = revision
+		}
+	}
+	if len(t.dirs) > 0 {
+		c.dirs = make(map[string]*pathTree, len(t.dirs))
+		for name, child := range t.dirs {
+			c.dirs[name] = child.clone()
+		}
+	}
+	return c
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// expectList checks the entries of dir, formatted as LIST response lines.
+func expectList(t *testing.T, vcs *VCS, dir, tag string, want ...string) {
+	t.Helper()
+
+	entries, err := vcs.List(dir, tag)
+	if err != nil {
+		t.Fatalf("List(%s, %q): %v", dir, tag, err)
+	}
+	got := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.Dir {
+			got = append(got, e.Name+"/ DIR")
+		} else {
+			got = append(got, e.Name+" r"+strconv.Itoa(e.Revision))
+		}
+	}
+	if want == nil {
+		want = []string{}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("List(%s, %q) = %q, want %q", dir, tag, got, want)
+	}
+}
+
+func TestPathTree(t *testing.T) {
+	vcs := newMemoryVCS(t)
+	mustPut(t, vcs, "/a", "file a\n")
+	mustPut(t, vcs, "/a/b.txt", "file b\n")
+	mustPut(t, vcs, "/a/b.txt", "file b again\n")
+	mustPut(t, vcs, "/a/deep/er/c.txt", "file c\n")
+	mustPut(t, vcs, "/z.txt", "file z\n")
+
+	tests := []struct {
+		dir  string
+		want []string
+	}{
+		{"/", []string{"a/ DIR", "a r1", "z.txt r1"}},
+		{"/a", []string{"deep/ DIR", "b.txt r2"}},
+		{"/a/", []string{"deep/ DIR", "b.txt r2"}},
+		{"/a/deep", []string{"er/ DIR"}},
+		{"/a/deep/er/", []string{"c.txt r1"}},
+		{"/missing/", nil},
+		{"/z.txt/", nil},
+	}
+	for _, tt := range tests {
+		expectList(t, vcs, tt.dir, "", tt.want...)
+	}
+
+	// Deleting the only file in a directory removes the directory, all the
+	// way up
+	vcs.Delete("/a/deep/er/c.txt")
+	expectList(t, vcs, "/a", "", "b.txt r2")
+	expectList(t, vcs, "/a/deep", "")
+	vcs.Delete("/a/b.txt")
+	expectList(t, vcs, "/", "", "a r1", "z.txt r1")
+	mustPut(t, vcs, "/a/deep/er/c.txt", "back\n")
+	expectList(t, vcs, "/a/deep/er", "", "c.txt r3")
+}
+
+func TestListSnapshotIsConsistent(t *testing.T) {
+	vcs := newMemoryVCS(t)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range 200 {
+			vcs.Commit([]Change{
+				{Filename: "/x/a.txt", Data: []byte(strconv.Itoa(i))},
+				{Filename: "/x/b.txt", Data: []byte(strconv.Itoa(i))},
+			})
+		}
+	}()
+
+	// Both files change in every commit, so a listing must always show them
+	// at the same revision
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		entries, _ := vcs.List("/x", "")
+		if len(entries) == 2 && entries[0].Revision != entries[1].Revision {
+			t.Fatalf("List(/x) = %+v, want matching revisions", entries)
+		}
+	}
+}
+
+// populate puts files spread over 100 directories of 10 subdirectories each.
+func populate(b *testing.B, vcs *VCS, files int) {
+	b.Helper()
+
+	changes := make([]Change, 0, files)
+	for i := range files {
+		changes = append(changes, Change{
+			Filename: fmt.Sprintf("/d%d/s%d/f%d.txt", i%100, i/100%10, i),
+			Data:     []byte(strconv.Itoa(i)),
+		})
+	}
+	if _, err := vcs.Commit(changes); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// BenchmarkList lists directories of a 100k-file tree, which should cost no
+// more than the handful of entries in each.
+func BenchmarkList(b *testing.B) {
+	vcs, err := NewVCS(NewMemoryStorage())
+	if err != nil {
+		b.Fatal(err)
+	}
+	populate(b, vcs, 100000)
+
+	for _, bm := range []struct {
+		name, dir string
+	}{
+		{"root", "/"},
+		{"dir", "/d7"},
+		{"leaf", "/d7/s3"},
+		{"missing", "/missing"},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			for b.Loop() {
+				if _, err := vcs.List(bm.dir, ""); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkTag(b *testing.B) {
+	vcs, err := NewVCS(NewMemoryStorage())
+	if err != nil {
+		b.Fatal(err)
+	}
+	populate(b, vcs, 100000)
+
+	i := 0
+	for b.Loop() {
+		if _, err := vcs.Tag("t" + strconv.Itoa(i) + "x"); err != nil {
+			b.Fatal(err)
+		}
+		i++
+	}
+}
@@ -0,0 +1,258 @@
+// Package fakeauthority is a local stand-in for the pest-control Authority
+// Server. It serves configurable target populations per site over the
+// pestproto wire format and records every policy change it is asked to make,
+// so tests can assert on the policies a client ends up with.
+package fakeauthority
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/saurabh/protohackers/internal/pestproto"
+)
+
+// Policy is a policy currently in force at a site.
+type Policy struct {
+	ID      uint32
+	Species string
+	Action  pestproto.Action
+}
+
+// Request is a CreatePolicy or DeletePolicy received for a site. For a
+// DeletePolicy, Policy describes the policy that was deleted.
+type Request struct {
+	Site   uint32
+	Delete bool
+	Policy Policy
+}
+
+type Server struct {
+	ln net.Listener
+
+	mu          sync.Mutex
+	targets     map[uint32][]pestproto.PopulationTarget
+	policies    map[uint32]map[uint32]Policy // site -> policy id -> policy
+	requests    []Request
+	connections map[uint32]int // site -> connections dialled for it
+	nextID      uint32
+	conns       map[net.Conn]struct{}
+	wg          sync.WaitGroup
+}
+
+// New returns a Server that answers DialAuthority for the sites in targets.
+// Dialling any other site gets an Error.
+func New(targets map[uint32][]pestproto.PopulationTarget) *Server {
+	s := &Server{
+		targets:     make(map[uint32][]pestproto.PopulationTarget),
+		policies:    make(map[uint32]map[uint32]Policy),
+		connections: make(map[uint32]int),
+		conns:       make(map[net.Conn]struct{}),
+	}
+	for site, t := range targets {
+		s.targets[site] = t
+	}
+	return s
+}
+
+// Listen starts serving on addr. Use "127.0.0.1:0" for an ephemeral port and
+// Addr to find out which one was chosen.
+func (s *Server) Listen(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.ln = ln
+
+	s.wg.Add(1)
+	go s.serve()
+	return nil
+}
+
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Close stops the listener, drops every open connection and waits for their
+// handlers to finish.
+func (s *Server) Close() error {
+	err := s.ln.Close()
+
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+// SetTargets replaces the target populations served for site. Connections
+// that already dialled the site keep the targets they were given.
+func (s *Server) SetTargets(site uint32, targets []pestproto.PopulationTarget) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.targets[site] = targets
+}
+
+// Policies returns the policies in force at site, sorted by species.
+func (s *Server) Policies(site uint32) []Policy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	policies := make([]Policy, 0, len(s.policies[site]))
+	for _, p := range s.policies[site] {
+		policies = append(policies, p)
+	}
+	sort.Slice(policies, func(i, j int) bool {
+		return policies[i].Species < policies[j].Species
+	})
+	return policies
+}
+
+// Requests returns every CreatePolicy and DeletePolicy received, in order.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Request(nil), s.requests...)
+}
+
+// Connections returns how many connections have dialled site.
+func (s *Server) Connections(site uint32) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.connections[site]
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Println("Fake authority accept error:", err)
+			}
+			return
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer func() {
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+				conn.Close()
+			}()
+
+			if err := s.handleConnection(conn); err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Println("Fake authority:", err)
+			}
+		}()
+	}
+}
+
+func (s *Server) handleConnection(conn net.Conn) error {
+	enc := pestproto.NewEncoder(conn)
+	dec := pestproto.NewDecoder(conn)
+
+	fail := func(err error) error {
+		enc.Encode(pestproto.Error{Message: err.Error()})
+		return err
+	}
+
+	if err := enc.Encode(pestproto.Hello{Protocol: pestproto.Protocol, Version: pestproto.Version}); err != nil {
+		return err
+	}
+	msg, err := dec.Decode()
+	if err != nil {
+		return fail(err)
+	}
+	hello, ok := msg.(pestproto.Hello)
+	if !ok || hello.Protocol != pestproto.Protocol || hello.Version != pestproto.Version {
+		return fail(fmt.Errorf("bad hello: %+v", msg))
+	}
+
+	msg, err = dec.Decode()
+	if err != nil {
+		return fail(err)
+	}
+	dial, ok := msg.(pestproto.DialAuthority)
+	if !ok {
+		return fail(fmt.Errorf("expected DialAuthority, got %T", msg))
+	}
+
+	s.mu.Lock()
+	targets, known := s.targets[dial.Site]
+	if known {
+		s.connections[dial.Site]++
+	}
+	s.mu.Unlock()
+	if !known {
+		return fail(fmt.Errorf("no such site: %d", dial.Site))
+	}
+
+	if err := enc.Encode(pestproto.TargetPopulations{Site: dial.Site, Populations: targets}); err != nil {
+		return err
+	}
+
+	for {
+		msg, err := dec.Decode()
+		if err != nil {
+			return fail(err)
+		}
+
+		var reply pestproto.Message
+		switch m := msg.(type) {
+		case pestproto.CreatePolicy:
+			reply = s.createPolicy(dial.Site, m)
+		case pestproto.DeletePolicy:
+			reply = s.deletePolicy(dial.Site, m)
+		default:
+			return fail(fmt.Errorf("unexpected message %T", msg))
+		}
+		if err := enc.Encode(reply); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Server) createPolicy(site uint32, m pestproto.CreatePolicy) pestproto.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	p := Policy{ID: s.nextID, Species: m.Species, Action: m.Action}
+	if s.policies[site] == nil {
+		s.policies[site] = make(map[uint32]Policy)
+	}
+	s.policies[site][p.ID] = p
+	s.requests = append(s.requests, Request{Site: site, Policy: p})
+	return pestproto.PolicyResult{Policy: p.ID}
+}
+
+func (s *Server) deletePolicy(site uint32, m pestproto.DeletePolicy) pestproto.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.policies[site][m.Policy]
+	if !ok {
+		return pestproto.Error{Message: fmt.Sprintf("no such policy: %d", m.Policy)}
+	}
+	delete(s.policies[site], m.Policy)
+	s.requests = append(s.requests, Request{Site: site, Delete: true, Policy: p})
+	return pestproto.OK{}
+}
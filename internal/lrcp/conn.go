@@ -0,0 +1,339 @@
+package lrcp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var errStreamTooLong = errors.New("lrcp: stream position would exceed 2147483647")
+
+// Conn is one LRCP session. It implements net.Conn.
+type Conn struct {
+	ep     *endpoint
+	id     int32
+	raddr  net.Addr
+	client bool // the endpoint belongs to this Conn alone and closes with it
+
+	mu            sync.Mutex
+	cond          *sync.Cond
+	connected     bool   // handshake complete
+	closed        bool   // session is over; Read drains rbuf then returns io.EOF
+	localClosed   bool   // Close was called
+	recvPos       int32  // bytes received in order
+	rbuf          []byte // received bytes not yet Read
+	unacked       []byte // sent bytes the peer has not acknowledged
+	acked         int32  // bytes the peer has acknowledged
+	lastSeen      time.Time
+	resendAt      time.Time // when to resend /connect/, or from the oldest unacked byte
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readTimer     *time.Timer
+}
+
+func newConn(ep *endpoint, id int32, raddr net.Addr, client bool) *Conn {
+	now := time.Now()
+	c := &Conn{
+		ep:       ep,
+		id:       id,
+		raddr:    raddr,
+		client:   client,
+		lastSeen: now,
+		resendAt: now.Add(ep.cfg.RetransmitTimeout),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// sentLen is the total number of bytes written to the session. Caller must
+// hold c.mu.
+func (c *Conn) sentLen() int32 {
+	return c.acked + int32(len(c.unacked))
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.rbuf) == 0 {
+		if c.localClosed {
+			return 0, net.ErrClosed
+		}
+		if c.closed {
+			return 0, io.EOF
+		}
+		if !c.readDeadline.IsZero() && !time.Now().Before(c.readDeadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		c.cond.Wait()
+	}
+
+	n := copy(b, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+// Write queues b for delivery and transmits it immediately. LRCP has no flow
+// control, so Write never blocks waiting for the peer.
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.localClosed {
+		return 0, net.ErrClosed
+	}
+	if c.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if !c.writeDeadline.IsZero() && !time.Now().Before(c.writeDeadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	if int64(c.sentLen())+int64(len(b)) >= maxNumeric {
+		return 0, errStreamTooLong
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	// New data only starts the retransmission timer if nothing was already
+	// waiting for an ack, so steady writes can't keep putting off a resend
+	if len(c.unacked) == 0 {
+		c.resendAt = time.Now().Add(c.ep.cfg.RetransmitTimeout)
+	}
+	from := c.sentLen()
+	c.unacked = append(c.unacked, b...)
+	c.transmit(from)
+	return len(b), nil
+}
+
+// Close sends /close/ to the peer and releases the session. Unacknowledged
+// data is discarded.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.localClosed {
+		c.mu.Unlock()
+		return nil
+	}
+	wasClosed := c.closed
+	c.localClosed = true
+	c.closed = true
+	if c.readTimer != nil {
+		c.readTimer.Stop()
+	}
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	if !wasClosed {
+		c.ep.send(c.raddr, "/close/%d/", c.id)
+	}
+	c.ep.remove(c)
+	if c.client {
+		return c.ep.close()
+	}
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.ep.pc.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+// SessionID returns the LRCP session number.
+func (c *Conn) SessionID() int32 {
+	return c.id
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readDeadline = t
+	if c.readTimer != nil {
+		c.readTimer.Stop()
+		c.readTimer = nil
+	}
+	if !t.IsZero() {
+		c.readTimer = time.AfterFunc(time.Until(t), func() {
+			c.mu.Lock()
+			c.cond.Broadcast()
+			c.mu.Unlock()
+		})
+	}
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writeDeadline = t
+	return nil
+}
+
+// transmit sends unacked data from stream position from onwards, split into
+// messages that fit the size limit. Caller must hold c.mu.
+func (c *Conn) transmit(from int32) {
+	data := c.unacked[from-c.acked:]
+	for len(data) > 0 {
+		header := fmt.Sprintf("/data/%d/%d/", c.id, from)
+		budget := maxMessageSize - 1 - len(header) - 1
+
+		// Take as many bytes as fit once escaped
+		n, size := 0, 0
+		for n < len(data) {
+			w := 1
+			if data[n] == '/' || data[n] == '\\' {
+				w = 2
+			}
+			if size+w > budget {
+				break
+			}
+			size += w
+			n++
+		}
+
+		msg := header + string(escape(data[:n])) + "/"
+		c.ep.write([]byte(msg), c.raddr)
+		data = data[n:]
+		from += int32(n)
+	}
+}
+
+// resend retransmits all unacked data and restarts the retransmission timer.
+// Caller must hold c.mu.
+func (c *Conn) resend(now time.Time) {
+	c.transmit(c.acked)
+	c.resendAt = now.Add(c.ep.cfg.RetransmitTimeout)
+}
+
+// shutdown marks the session closed after the peer closed it, it expired or
+// the peer misbehaved. Caller must hold c.mu.
+func (c *Conn) shutdown() {
+	c.closed = true
+	c.cond.Broadcast()
+}
+
+func (c *Conn) handleConnect() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+	c.lastSeen = time.Now()
+	c.ep.send(c.raddr, "/ack/%d/%d/", c.id, c.recvPos)
+}
+
+func (c *Conn) handleData(pos int32, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		c.ep.send(c.raddr, "/close/%d/", c.id)
+		return
+	}
+	c.lastSeen = time.Now()
+
+	// Accept data that starts at or before what we have so far and extends
+	// past it; anything else is acked with what we already have.
+	end := int64(pos) + int64(len(data))
+	if pos <= c.recvPos && end > int64(c.recvPos) {
+		if end >= maxNumeric {
+			c.ep.send(c.raddr, "/close/%d/", c.id)
+			c.shutdown()
+			c.ep.remove(c)
+			return
+		}
+		fresh := data[c.recvPos-pos:]
+		c.recvPos += int32(len(fresh))
+		c.rbuf = append(c.rbuf, fresh...)
+		c.cond.Broadcast()
+	}
+	c.ep.send(c.raddr, "/ack/%d/%d/", c.id, c.recvPos)
+}
+
+func (c *Conn) handleAck(length int32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		c.ep.send(c.raddr, "/close/%d/", c.id)
+		return
+	}
+	now := time.Now()
+	c.lastSeen = now
+
+	if !c.connected {
+		// The ack of our /connect/ completes the handshake
+		c.connected = true
+		c.cond.Broadcast()
+	}
+	if length < c.acked {
+		// Delayed ack, superseded by a later one
+		return
+	}
+	if length > c.sentLen() {
+		// Peer acked data we never sent
+		c.ep.send(c.raddr, "/close/%d/", c.id)
+		c.shutdown()
+		c.ep.remove(c)
+		return
+	}
+
+	// Anything the peer hasn't got after LENGTH is resent, including when it
+	// repeats the last ack because data after it was lost
+	c.unacked = c.unacked[length-c.acked:]
+	c.acked = length
+	if len(c.unacked) > 0 {
+		c.resend(now)
+	}
+}
+
+func (c *Conn) handleClose() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ep.send(c.raddr, "/close/%d/", c.id)
+	c.shutdown()
+	c.ep.remove(c)
+}
+
+// tick runs the retransmission and expiry timers.
+func (c *Conn) tick(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+	if now.Sub(c.lastSeen) >= c.ep.cfg.SessionExpiry {
+		c.ep.send(c.raddr, "/close/%d/", c.id)
+		c.shutdown()
+		c.ep.remove(c)
+		return
+	}
+	if now.Before(c.resendAt) {
+		return
+	}
+	if !c.connected {
+		c.ep.send(c.raddr, "/connect/%d/", c.id)
+		c.resendAt = now.Add(c.ep.cfg.RetransmitTimeout)
+		return
+	}
+	if len(c.unacked) > 0 {
+		c.resend(now)
+	}
+}
@@ -0,0 +1,389 @@
+package lrcp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// quietConfig keeps the timers out of the way, so a peer only sees what it
+// provokes.
+var quietConfig = &Config{RetransmitTimeout: time.Minute, SessionExpiry: time.Hour}
+
+// peer speaks raw LRCP to an endpoint over loopback UDP.
+type peer struct {
+	t    *testing.T
+	pc   net.PacketConn
+	addr net.Addr // the endpoint's
+}
+
+func newPeer(t *testing.T, addr net.Addr) *peer {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	return &peer{t: t, pc: pc, addr: addr}
+}
+
+// startListener returns a listener and a peer connected to it as session 1,
+// along with the listener's side of that session.
+func startListener(t *testing.T, cfg *Config) (*Listener, *peer, net.Conn) {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	ln := NewListener(pc, cfg)
+	t.Cleanup(func() { ln.Close() })
+
+	p := newPeer(t, ln.Addr())
+	p.send("/connect/1/")
+	p.expect("/ack/1/0/")
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	return ln, p, conn
+}
+
+func (p *peer) send(msg string) {
+	p.t.Helper()
+	if _, err := p.pc.WriteTo([]byte(msg), p.addr); err != nil {
+		p.t.Fatalf("send %s: %v", msg, err)
+	}
+}
+
+// receive waits up to timeout for a message, returning "" if none comes.
+func (p *peer) receive(timeout time.Duration) string {
+	p.t.Helper()
+
+	buf := make([]byte, maxMessageSize)
+	p.pc.SetReadDeadline(time.Now().Add(timeout))
+	n, addr, err := p.pc.ReadFrom(buf)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return ""
+	}
+	if err != nil {
+		p.t.Fatalf("ReadFrom: %v", err)
+	}
+	p.addr = addr
+	return string(buf[:n])
+}
+
+func (p *peer) expect(want string) {
+	p.t.Helper()
+	if got := p.receive(5 * time.Second); got != want {
+		p.t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+// expectNothing checks the endpoint doesn't answer what was just sent.
+func (p *peer) expectNothing() {
+	p.t.Helper()
+	if got := p.receive(50 * time.Millisecond); got != "" {
+		p.t.Fatalf("got %q, want no reply", got)
+	}
+}
+
+// expectRead reads exactly len(want) bytes from conn.
+func expectRead(t *testing.T, conn net.Conn, want string) {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("reading %q: %v", want, err)
+	}
+	if string(got) != want {
+		t.Fatalf("read %q, want %q", got, want)
+	}
+}
+
+func TestDataIsEscaped(t *testing.T) {
+	_, p, conn := startListener(t, quietConfig)
+
+	p.send(`/data/1/0/a\/b\\c` + "\n/")
+	p.expect("/ack/1/6/")
+	expectRead(t, conn, "a/b\\c\n")
+
+	if _, err := conn.Write([]byte(`x/y\`)); err != nil {
+		t.Fatal(err)
+	}
+	p.expect(`/data/1/0/x\/y\\/`)
+}
+
+func TestLongWritesAreSplit(t *testing.T) {
+	_, p, conn := startListener(t, quietConfig)
+
+	data := strings.Repeat("/", 1500)
+	if _, err := conn.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	got := ""
+	for len(got) < len(data) {
+		msg := p.receive(5 * time.Second)
+		if len(msg) >= maxMessageSize {
+			t.Fatalf("sent a %d byte message", len(msg))
+		}
+		fields, ok := parseMessage([]byte(msg))
+		if !ok || len(fields) != 4 || fields[0] != "data" || fields[2] != fmt.Sprint(len(got)) {
+			t.Fatalf("got %q, want data from %d", msg, len(got))
+		}
+		chunk, _ := unescape(fields[3])
+		got += chunk
+	}
+	if got != data {
+		t.Errorf("received %q, want %q", got, data)
+	}
+}
+
+func TestInvalidMessagesAreIgnored(t *testing.T) {
+	_, p, conn := startListener(t, quietConfig)
+
+	for _, msg := range []string{
+		`/data/1/0/bad\escape/`,
+		`/data/1/0/un/escaped/`,
+		`/data/1/+0/x/`,
+		`/data/1/-1/x/`,
+		`/data/1/2147483648/x/`,
+		`/data/1/0/x`,
+		`data/1/0/x/`,
+		`/data/x/0/x/`,
+		`/data/1/0/` + strings.Repeat("x", maxMessageSize) + `/`,
+		`/ack/1/`,
+		`/connect/1/2/`,
+		`/connect/2147483648/`,
+		`/close/1/0/`,
+		`/bogus/1/`,
+		`//`,
+	} {
+		p.send(msg)
+		p.expectNothing()
+	}
+
+	// The session carries on as before
+	p.send("/data/1/0/ok/")
+	p.expect("/ack/1/2/")
+	expectRead(t, conn, "ok")
+}
+
+func TestUnknownSessionIsClosed(t *testing.T) {
+	_, p, _ := startListener(t, quietConfig)
+
+	for _, msg := range []string{"/data/2/0/x/", "/ack/2/0/", "/close/2/"} {
+		p.send(msg)
+		p.expect("/close/2/")
+	}
+}
+
+func TestSessionBelongsToItsPeer(t *testing.T) {
+	ln, _, conn := startListener(t, quietConfig)
+
+	other := newPeer(t, ln.Addr())
+	other.send("/data/1/0/hijack/")
+	other.expectNothing()
+	other.send("/close/1/")
+	other.expectNothing()
+
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, err := conn.Read(make([]byte, 10)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read = %d, %v, want a timeout", n, err)
+	}
+}
+
+func TestDataOutOfOrder(t *testing.T) {
+	_, p, conn := startListener(t, quietConfig)
+
+	// Data past what has arrived is acked with what has
+	p.send("/data/1/5/world/")
+	p.expect("/ack/1/0/")
+	p.send("/data/1/0/hello/")
+	p.expect("/ack/1/5/")
+
+	// As is data already received
+	p.send("/data/1/0/hel/")
+	p.expect("/ack/1/5/")
+
+	// Data overlapping the end only adds the new part
+	p.send("/data/1/3/lo world/")
+	p.expect("/ack/1/11/")
+	expectRead(t, conn, "hello world")
+
+	// A repeated /connect/ is acked with where the session is
+	p.send("/connect/1/")
+	p.expect("/ack/1/11/")
+}
+
+func TestAcks(t *testing.T) {
+	_, p, conn := startListener(t, quietConfig)
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	p.expect("/data/1/0/hello/")
+
+	// Whatever follows an ack is resent at once, including when the ack
+	// repeats because the resend was lost too
+	p.send("/ack/1/2/")
+	p.expect("/data/1/2/llo/")
+	p.send("/ack/1/2/")
+	p.expect("/data/1/2/llo/")
+
+	// An ack older than the last is stale
+	p.send("/ack/1/1/")
+	p.expectNothing()
+
+	p.send("/ack/1/5/")
+	p.expectNothing()
+	p.send("/ack/1/5/")
+	p.expectNothing()
+
+	// Acking more than was sent is a protocol error
+	p.send("/ack/1/6/")
+	p.expect("/close/1/")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 10)); err != io.EOF {
+		t.Errorf("Read after bad ack = %d, %v, want EOF", n, err)
+	}
+}
+
+func TestRetransmit(t *testing.T) {
+	_, p, conn := startListener(t, &Config{RetransmitTimeout: 50 * time.Millisecond, SessionExpiry: time.Hour})
+
+	conn.Write([]byte("hi"))
+	p.expect("/data/1/0/hi/")
+	p.expect("/data/1/0/hi/")
+	p.send("/ack/1/2/")
+	for {
+		// A resend may already have been on its way
+		msg := p.receive(200 * time.Millisecond)
+		if msg == "" {
+			break
+		}
+		if msg != "/data/1/0/hi/" {
+			t.Fatalf("got %q after the ack, want nothing", msg)
+		}
+	}
+}
+
+func TestPeerClose(t *testing.T) {
+	_, p, conn := startListener(t, quietConfig)
+
+	p.send("/data/1/0/bye/")
+	p.expect("/ack/1/3/")
+	p.send("/close/1/")
+	p.expect("/close/1/")
+
+	// What arrived before the close can still be read
+	expectRead(t, conn, "bye")
+	if n, err := conn.Read(make([]byte, 10)); err != io.EOF {
+		t.Errorf("Read after close = %d, %v, want EOF", n, err)
+	}
+	if _, err := conn.Write([]byte("x")); err == nil {
+		t.Error("Write after close succeeded")
+	}
+
+	// The session is gone
+	p.send("/data/1/3/more/")
+	p.expect("/close/1/")
+}
+
+func TestLocalClose(t *testing.T) {
+	_, p, conn := startListener(t, quietConfig)
+
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	p.expect("/close/1/")
+	if err := conn.Close(); err != nil {
+		t.Errorf("second Close = %v", err)
+	}
+	p.expectNothing()
+
+	if _, err := conn.Read(make([]byte, 10)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Read after Close = %v, want %v", err, net.ErrClosed)
+	}
+	if _, err := conn.Write([]byte("x")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Write after Close = %v, want %v", err, net.ErrClosed)
+	}
+}
+
+// dialPeer starts NewClient towards p and returns the session number it
+// connects with, along with a channel for NewClient's result.
+func dialPeer(t *testing.T, p *peer, pc net.PacketConn, cfg *Config) (string, chan *Conn, chan error) {
+	t.Helper()
+
+	conns, errs := make(chan *Conn, 1), make(chan error, 1)
+	go func() {
+		c, err := NewClient(pc, p.pc.LocalAddr(), cfg)
+		conns <- c
+		errs <- err
+	}()
+	msg := p.receive(5 * time.Second)
+	fields, ok := parseMessage([]byte(msg))
+	if !ok || len(fields) != 2 || fields[0] != "connect" {
+		t.Fatalf("got %q, want a /connect/", msg)
+	}
+	return fields[1], conns, errs
+}
+
+func TestNewClient(t *testing.T) {
+	p := newPeer(t, nil)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sid, conns, errs := dialPeer(t, p, pc, quietConfig)
+	p.send("/ack/" + sid + "/0/")
+	conn := <-conns
+	if err := <-errs; err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	conn.Write([]byte("ping"))
+	p.expect("/data/" + sid + "/0/ping/")
+	p.send("/data/" + sid + "/0/pong/")
+	p.expect("/ack/" + sid + "/4/")
+	expectRead(t, conn, "pong")
+
+	// The client owns its socket and closes it along with the session
+	if err := conn.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	p.expect("/close/" + sid + "/")
+	if _, err := pc.WriteTo([]byte("x"), p.pc.LocalAddr()); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("writing to the client's socket after Close = %v, want %v", err, net.ErrClosed)
+	}
+}
+
+func TestNewClientTimesOut(t *testing.T) {
+	p := newPeer(t, nil)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &Config{RetransmitTimeout: 50 * time.Millisecond, SessionExpiry: 300 * time.Millisecond}
+	sid, conns, errs := dialPeer(t, p, pc, cfg)
+	// The /connect/ is repeated until the session expires
+	p.expect("/connect/" + sid + "/")
+	if conn := <-conns; conn != nil {
+		t.Errorf("NewClient returned a session with nobody answering")
+	}
+	if err := <-errs; err == nil {
+		t.Error("NewClient succeeded with nobody answering")
+	}
+	if _, err := pc.WriteTo([]byte("x"), p.pc.LocalAddr()); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("writing to the client's socket after a failed dial = %v, want %v", err, net.ErrClosed)
+	}
+}
@@ -0,0 +1,309 @@
+package lrcp
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+// acceptBacklog is how many opened sessions may wait for Accept. Further
+// /connect/ messages are dropped and the peer will retry.
+const acceptBacklog = 128
+
+// endpoint reads datagrams from a packet connection and demultiplexes them to
+// sessions by session number.
+type endpoint struct {
+	pc  net.PacketConn
+	cfg Config
+
+	mu     sync.Mutex
+	conns  map[int32]*Conn
+	accept chan *Conn // nil on the dialing side
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newEndpoint(pc net.PacketConn, cfg *Config, listening bool) *endpoint {
+	ep := &endpoint{
+		pc:    pc,
+		cfg:   cfg.withDefaults(),
+		conns: make(map[int32]*Conn),
+		done:  make(chan struct{}),
+	}
+	if listening {
+		ep.accept = make(chan *Conn, acceptBacklog)
+	}
+	return ep
+}
+
+func (ep *endpoint) start() {
+	go ep.readLoop()
+	go ep.maintain()
+}
+
+func (ep *endpoint) close() error {
+	var err error
+	ep.closeOnce.Do(func() {
+		close(ep.done)
+		err = ep.pc.Close()
+
+		ep.mu.Lock()
+		conns := make([]*Conn, 0, len(ep.conns))
+		for _, c := range ep.conns {
+			conns = append(conns, c)
+		}
+		ep.mu.Unlock()
+
+		for _, c := range conns {
+			c.mu.Lock()
+			c.shutdown()
+			c.mu.Unlock()
+		}
+	})
+	return err
+}
+
+func (ep *endpoint) remove(c *Conn) {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+
+	if ep.conns[c.id] == c {
+		delete(ep.conns, c.id)
+	}
+}
+
+func (ep *endpoint) write(msg []byte, addr net.Addr) {
+	if _, err := ep.pc.WriteTo(msg, addr); err != nil {
+		select {
+		case <-ep.done:
+		default:
+			log.Println("LRCP write error:", err)
+		}
+	}
+}
+
+func (ep *endpoint) send(addr net.Addr, format string, args ...any) {
+	ep.write(fmt.Appendf(nil, format, args...), addr)
+}
+
+func (ep *endpoint) readLoop() {
+	defer ep.close()
+
+	buffer := make([]byte, 1024)
+	for {
+		n, addr, err := ep.pc.ReadFrom(buffer)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			select {
+			case <-ep.done:
+			default:
+				log.Println("LRCP read error:", err)
+			}
+			return
+		}
+		ep.handlePacket(buffer[:n], addr)
+	}
+}
+
+// maintain drives the retransmission and expiry timers of every session.
+func (ep *endpoint) maintain() {
+	ticker := time.NewTicker(ep.cfg.RetransmitTimeout / 10)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ep.done:
+			return
+		case now := <-ticker.C:
+			ep.mu.Lock()
+			conns := make([]*Conn, 0, len(ep.conns))
+			for _, c := range ep.conns {
+				conns = append(conns, c)
+			}
+			ep.mu.Unlock()
+
+			for _, c := range conns {
+				c.tick(now)
+			}
+		}
+	}
+}
+
+func (ep *endpoint) handlePacket(msg []byte, addr net.Addr) {
+	if len(msg) >= maxMessageSize {
+		return
+	}
+	fields, ok := parseMessage(msg)
+	if !ok || len(fields) < 2 {
+		return
+	}
+	sid, ok := parseNumeric(fields[1])
+	if !ok {
+		return
+	}
+
+	ep.mu.Lock()
+	c, exists := ep.conns[sid]
+	if exists && c.raddr.String() != addr.String() {
+		// Sessions are bound to the peer that opened them
+		ep.mu.Unlock()
+		return
+	}
+
+	if fields[0] == "connect" {
+		if len(fields) != 2 {
+			ep.mu.Unlock()
+			return
+		}
+		if !exists {
+			if ep.accept == nil {
+				ep.mu.Unlock()
+				return
+			}
+			c = newConn(ep, sid, addr, false)
+			c.connected = true
+			select {
+			case ep.accept <- c:
+				ep.conns[sid] = c
+			default:
+				ep.mu.Unlock()
+				log.Println("LRCP accept backlog full, dropping session", sid)
+				return
+			}
+		}
+		ep.mu.Unlock()
+		c.handleConnect()
+		return
+	}
+	ep.mu.Unlock()
+
+	switch fields[0] {
+	case "data":
+		if len(fields) != 4 {
+			return
+		}
+		pos, ok := parseNumeric(fields[2])
+		if !ok {
+			return
+		}
+		data, ok := unescape(fields[3])
+		if !ok {
+			return
+		}
+		if !exists {
+			ep.send(addr, "/close/%d/", sid)
+			return
+		}
+		c.handleData(pos, []byte(data))
+
+	case "ack":
+		if len(fields) != 3 {
+			return
+		}
+		length, ok := parseNumeric(fields[2])
+		if !ok {
+			return
+		}
+		if !exists {
+			ep.send(addr, "/close/%d/", sid)
+			return
+		}
+		c.handleAck(length)
+
+	case "close":
+		if len(fields) != 2 {
+			return
+		}
+		if !exists {
+			ep.send(addr, "/close/%d/", sid)
+			return
+		}
+		c.handleClose()
+	}
+}
+
+// Listener accepts LRCP sessions. It implements net.Listener.
+type Listener struct {
+	ep *endpoint
+}
+
+// Listen announces on the local UDP address and accepts LRCP sessions.
+func Listen(network, address string) (*Listener, error) {
+	pc, err := net.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewListener(pc, nil), nil
+}
+
+// NewListener serves LRCP on pc, which is closed when the Listener is. A nil
+// cfg uses the default timers.
+func NewListener(pc net.PacketConn, cfg *Config) *Listener {
+	ep := newEndpoint(pc, cfg, true)
+	ep.start()
+	return &Listener{ep: ep}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.ep.accept:
+		return c, nil
+	case <-l.ep.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops the listener and closes every session it accepted.
+func (l *Listener) Close() error {
+	return l.ep.close()
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.ep.pc.LocalAddr()
+}
+
+// Dial opens an LRCP session to a listening peer at address.
+func Dial(network, address string) (*Conn, error) {
+	raddr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenPacket(network, ":0")
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(pc, raddr, nil)
+}
+
+// NewClient opens an LRCP session to raddr over pc. The session owns pc and
+// closes it when the session is closed. NewClient blocks until the peer acks
+// the /connect/ or the session expires.
+func NewClient(pc net.PacketConn, raddr net.Addr, cfg *Config) (*Conn, error) {
+	ep := newEndpoint(pc, cfg, false)
+
+	c := newConn(ep, rand.Int32(), raddr, true)
+	ep.conns[c.id] = c
+	ep.start()
+	ep.send(raddr, "/connect/%d/", c.id)
+
+	c.mu.Lock()
+	for !c.connected && !c.closed {
+		c.cond.Wait()
+	}
+	connected := c.connected
+	c.mu.Unlock()
+
+	if !connected {
+		ep.close()
+		return nil, fmt.Errorf("lrcp: connect to %s timed out", raddr)
+	}
+	return c, nil
+}
@@ -0,0 +1,126 @@
+// Package lrcp implements the Line Reversal Control Protocol, a reliable
+// ordered byte stream carried over UDP.
+//
+// Listen returns a net.Listener whose Accept yields a net.Conn for every LRCP
+// session opened by a peer, and Dial opens a session to a listening peer, so
+// any stream-oriented handler can be served over LRCP without changes.
+//
+// Messages are slash-delimited ASCII and must be smaller than 1000 bytes:
+//
+//	/connect/SESSION/
+//	/data/SESSION/POS/DATA/
+//	/ack/SESSION/LENGTH/
+//	/close/SESSION/
+//
+// Slashes and backslashes inside DATA are escaped as \/ and \\. Numeric
+// fields must be non-negative and smaller than 2147483648.
+package lrcp
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// All LRCP messages must be smaller than 1000 bytes
+	maxMessageSize = 1000
+
+	// Numeric fields must be smaller than 2147483648
+	maxNumeric = 1 << 31
+)
+
+// Config holds the protocol timers. The zero value of a field selects the
+// default from the LRCP specification.
+type Config struct {
+	// RetransmitTimeout is how long to wait for an ack before resending
+	// unacknowledged data. Defaults to 3 seconds.
+	RetransmitTimeout time.Duration
+
+	// SessionExpiry closes a session after this long without hearing from
+	// the peer. Defaults to 60 seconds.
+	SessionExpiry time.Duration
+}
+
+func (c *Config) withDefaults() Config {
+	var cfg Config
+	if c != nil {
+		cfg = *c
+	}
+	if cfg.RetransmitTimeout <= 0 {
+		cfg.RetransmitTimeout = 3 * time.Second
+	}
+	if cfg.SessionExpiry <= 0 {
+		cfg.SessionExpiry = 60 * time.Second
+	}
+	return cfg
+}
+
+// parseMessage splits an LRCP message into its fields. Fields are separated by
+// unescaped slashes; escape sequences are left in place so the data field can
+// be unescaped separately.
+func parseMessage(msg []byte) ([]string, bool) {
+	if len(msg) < 2 || msg[0] != '/' || msg[len(msg)-1] != '/' {
+		return nil, false
+	}
+
+	var fields []string
+	var field []byte
+	for i := 1; i < len(msg); i++ {
+		switch msg[i] {
+		case '\\':
+			if i+1 >= len(msg)-1 {
+				// An escape can't consume the closing slash
+				return nil, false
+			}
+			field = append(field, msg[i], msg[i+1])
+			i++
+		case '/':
+			fields = append(fields, string(field))
+			field = nil
+		default:
+			field = append(field, msg[i])
+		}
+	}
+	return fields, true
+}
+
+// unescape resolves \/ and \\ in a data field. Any other escape is invalid.
+func unescape(data string) (string, bool) {
+	var sb strings.Builder
+	for i := 0; i < len(data); i++ {
+		if data[i] != '\\' {
+			sb.WriteByte(data[i])
+			continue
+		}
+		if i+1 >= len(data) || (data[i+1] != '/' && data[i+1] != '\\') {
+			return "", false
+		}
+		sb.WriteByte(data[i+1])
+		i++
+	}
+	return sb.String(), true
+}
+
+func escape(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	for _, b := range data {
+		if b == '/' || b == '\\' {
+			out = append(out, '\\')
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// parseNumeric parses a numeric field, which is plain digits with no sign.
+func parseNumeric(s string) (int32, bool) {
+	if s == "" || s[0] < '0' || s[0] > '9' {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 || n >= maxNumeric {
+		return 0, false
+	}
+	return int32(n), true
+}
@@ -0,0 +1,89 @@
+package lrcp
+
+import (
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+func TestParseMessage(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want []string // nil if the message is malformed
+	}{
+		{`/connect/12345/`, []string{"connect", "12345"}},
+		{`/data/1/0/hello/`, []string{"data", "1", "0", "hello"}},
+		{`/data/1/0//`, []string{"data", "1", "0", ""}},
+		{`/data/1/0/a\/b/`, []string{"data", "1", "0", `a\/b`}},
+		{`/data/1/0/a\\/`, []string{"data", "1", "0", `a\\`}},
+		{`/data/1/0/a/b/`, []string{"data", "1", "0", "a", "b"}},
+		{`/data/1/0/a\/`, nil},
+		{`/ack/1/0`, nil},
+		{`ack/1/0/`, nil},
+		{`/`, nil},
+		{``, nil},
+	}
+	for _, tt := range tests {
+		got, ok := parseMessage([]byte(tt.msg))
+		if ok != (tt.want != nil) || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseMessage(%s) = %q, %v, want %q", tt.msg, got, ok, tt.want)
+		}
+	}
+}
+
+func TestEscaping(t *testing.T) {
+	tests := []struct {
+		data, escaped string
+	}{
+		{"hello", "hello"},
+		{"a/b", `a\/b`},
+		{`a\b`, `a\\b`},
+		{`/\/\`, `\/\\\/\\`},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := string(escape([]byte(tt.data))); got != tt.escaped {
+			t.Errorf("escape(%s) = %s, want %s", tt.data, got, tt.escaped)
+		}
+		if got, ok := unescape(tt.escaped); !ok || got != tt.data {
+			t.Errorf("unescape(%s) = %s, %v, want %s", tt.escaped, got, ok, tt.data)
+		}
+	}
+
+	for _, bad := range []string{`\`, `a\b`, `\n`, `ab\`} {
+		if got, ok := unescape(bad); ok {
+			t.Errorf("unescape(%s) = %s, want an error", bad, got)
+		}
+	}
+}
+
+func TestParseNumeric(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int32
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"12345", 12345, true},
+		{"2147483647", 2147483647, true},
+		{"2147483648", 0, false},
+		{"-1", 0, false},
+		{"+1", 0, false},
+		{"1a", 0, false},
+		{"", 0, false},
+		{strings.Repeat("9", 30), 0, false},
+	}
+	for _, tt := range tests {
+		if got, ok := parseNumeric(tt.s); got != tt.want || ok != tt.ok {
+			t.Errorf("parseNumeric(%q) = %d, %v, want %d, %v", tt.s, got, ok, tt.want, tt.ok)
+		}
+	}
+}
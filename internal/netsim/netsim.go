@@ -0,0 +1,156 @@
+// Package netsim simulates an unreliable network in-process. PacketConn wraps
+// a net.PacketConn and drops, duplicates, reorders and delays the datagrams
+// written through it, so UDP protocols can be tested against the conditions
+// they are meant to survive.
+package netsim
+
+import (
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+// reorderFlush is how long a datagram may be held back for reordering when no
+// further datagrams arrive to push it out of the window.
+const reorderFlush = 5 * time.Millisecond
+
+// Config describes the impairments applied to outgoing datagrams.
+type Config struct {
+	// DropRate is the probability in [0, 1] that a datagram is discarded.
+	DropRate float64
+
+	// DuplicateRate is the probability in [0, 1] that a datagram is sent
+	// twice.
+	DuplicateRate float64
+
+	// ReorderWindow is how many datagrams are held back and released in
+	// random order. Zero preserves write order.
+	ReorderWindow int
+
+	// Delay is added to every datagram before it is sent.
+	Delay time.Duration
+
+	// Seed makes the random choices reproducible.
+	Seed uint64
+}
+
+// Stats counts what happened to datagrams written through a PacketConn.
+type Stats struct {
+	Written    int // datagrams passed to WriteTo
+	Dropped    int
+	Duplicated int
+	Delivered  int // datagrams handed to the underlying connection
+}
+
+type packet struct {
+	data []byte
+	addr net.Addr
+}
+
+// PacketConn is a net.PacketConn whose writes go through a simulated lossy
+// network. Reads are passed through unchanged; wrap both ends to impair
+// traffic in both directions.
+type PacketConn struct {
+	net.PacketConn
+	cfg Config
+
+	mu     sync.Mutex
+	rng    *rand.Rand
+	held   []packet
+	timer  *time.Timer
+	stats  Stats
+	closed bool
+}
+
+// Wrap returns pc with cfg's impairments applied to everything written to it.
+func Wrap(pc net.PacketConn, cfg Config) *PacketConn {
+	return &PacketConn{
+		PacketConn: pc,
+		cfg:        cfg,
+		rng:        rand.New(rand.NewPCG(cfg.Seed, cfg.Seed^0x9e3779b97f4a7c15)),
+	}
+}
+
+// WriteTo always reports success for datagrams the simulated network loses,
+// just as a real UDP socket would.
+func (c *PacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	c.stats.Written++
+
+	if c.rng.Float64() < c.cfg.DropRate {
+		c.stats.Dropped++
+		return len(p), nil
+	}
+
+	copies := 1
+	if c.rng.Float64() < c.cfg.DuplicateRate {
+		c.stats.Duplicated++
+		copies = 2
+	}
+	for range copies {
+		c.held = append(c.held, packet{data: append([]byte(nil), p...), addr: addr})
+	}
+
+	// Release random datagrams until the window is back within bounds
+	for len(c.held) > c.cfg.ReorderWindow {
+		c.release(c.rng.IntN(len(c.held)))
+	}
+	if len(c.held) > 0 && c.timer == nil {
+		c.timer = time.AfterFunc(reorderFlush, c.flush)
+	}
+	return len(p), nil
+}
+
+// flush releases every held datagram in random order.
+func (c *PacketConn) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.timer = nil
+	for len(c.held) > 0 {
+		c.release(c.rng.IntN(len(c.held)))
+	}
+}
+
+// release sends the i'th held datagram after the configured delay. Caller
+// must hold c.mu.
+func (c *PacketConn) release(i int) {
+	pkt := c.held[i]
+	c.held = append(c.held[:i], c.held[i+1:]...)
+	c.stats.Delivered++
+
+	if c.cfg.Delay <= 0 {
+		c.PacketConn.WriteTo(pkt.data, pkt.addr)
+		return
+	}
+	time.AfterFunc(c.cfg.Delay, func() {
+		c.PacketConn.WriteTo(pkt.data, pkt.addr)
+	})
+}
+
+// Stats returns a snapshot of the counters.
+func (c *PacketConn) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.stats
+}
+
+// Close discards held datagrams and closes the underlying connection.
+func (c *PacketConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.held = nil
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.mu.Unlock()
+
+	return c.PacketConn.Close()
+}
@@ -0,0 +1,394 @@
+// Package pestproto implements the binary wire format shared by pest-control
+// clients, the pest-control server and the Authority Server.
+//
+// Every message is framed as
+//
+//	type     u8
+//	length   u32  total length of the message in bytes, including type,
+//	              length and checksum
+//	content  ...
+//	checksum u8   chosen so that all bytes of the message sum to 0 mod 256
+//
+// Integers are big-endian. A str is a u32 length followed by that many bytes
+// and an array is a u32 count followed by that many elements.
+package pestproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Message type tags
+const (
+	TypeHello             byte = 0x50
+	TypeError             byte = 0x51
+	TypeOK                byte = 0x52
+	TypeDialAuthority     byte = 0x53
+	TypeTargetPopulations byte = 0x54
+	TypeCreatePolicy      byte = 0x55
+	TypeDeletePolicy      byte = 0x56
+	TypePolicyResult      byte = 0x57
+	TypeSiteVisit         byte = 0x58
+)
+
+// Protocol and Version are the only values a valid Hello may carry.
+const (
+	Protocol = "pestcontrol"
+	Version  = 1
+)
+
+// MaxMessageSize bounds the declared length of an incoming message so a peer
+// can't make us allocate arbitrarily large buffers.
+const MaxMessageSize = 1 << 20
+
+// headerSize is type + length; a message also has a trailing checksum byte.
+const headerSize = 5
+
+var (
+	ErrTruncated     = errors.New("truncated message")
+	ErrBadChecksum   = errors.New("bad checksum")
+	ErrBadLength     = errors.New("declared length does not match content")
+	ErrTooLarge      = errors.New("message too large")
+	ErrUnknownType   = errors.New("unknown message type")
+	ErrUnknownAction = errors.New("unknown policy action")
+)
+
+// Action is what a policy does to a species.
+type Action byte
+
+const (
+	Cull     Action = 0x90
+	Conserve Action = 0xa0
+)
+
+func (a Action) String() string {
+	switch a {
+	case Cull:
+		return "cull"
+	case Conserve:
+		return "conserve"
+	default:
+		return fmt.Sprintf("Action(0x%02x)", byte(a))
+	}
+}
+
+// Message is implemented by every message type.
+type Message interface {
+	Type() byte
+}
+
+// Hello (0x50) is the first message sent by each side of every connection.
+type Hello struct {
+	Protocol string
+	Version  uint32
+}
+
+// Error (0x51)
+type Error struct {
+	Message string
+}
+
+// OK (0x52) acknowledges a DeletePolicy.
+type OK struct{}
+
+// DialAuthority (0x53) selects the site an Authority Server connection is for.
+type DialAuthority struct {
+	Site uint32
+}
+
+type PopulationTarget struct {
+	Species string
+	Min     uint32
+	Max     uint32
+}
+
+// TargetPopulations (0x54) answers DialAuthority.
+type TargetPopulations struct {
+	Site        uint32
+	Populations []PopulationTarget
+}
+
+// CreatePolicy (0x55)
+type CreatePolicy struct {
+	Species string
+	Action  Action
+}
+
+// DeletePolicy (0x56)
+type DeletePolicy struct {
+	Policy uint32
+}
+
+// PolicyResult (0x57) answers CreatePolicy with the new policy's id.
+type PolicyResult struct {
+	Policy uint32
+}
+
+type PopulationCount struct {
+	Species string
+	Count   uint32
+}
+
+// SiteVisit (0x58) reports the species counted at a site.
+type SiteVisit struct {
+	Site        uint32
+	Populations []PopulationCount
+}
+
+func (Hello) Type() byte             { return TypeHello }
+func (Error) Type() byte             { return TypeError }
+func (OK) Type() byte                { return TypeOK }
+func (DialAuthority) Type() byte     { return TypeDialAuthority }
+func (TargetPopulations) Type() byte { return TypeTargetPopulations }
+func (CreatePolicy) Type() byte      { return TypeCreatePolicy }
+func (DeletePolicy) Type() byte      { return TypeDeletePolicy }
+func (PolicyResult) Type() byte      { return TypePolicyResult }
+func (SiteVisit) Type() byte         { return TypeSiteVisit }
+
+// Marshal returns the framed wire encoding of m, including its length and
+// checksum.
+func Marshal(m Message) ([]byte, error) {
+	buf := []byte{m.Type(), 0, 0, 0, 0}
+
+	switch m := m.(type) {
+	case Hello:
+		buf = appendStr(buf, m.Protocol)
+		buf = binary.BigEndian.AppendUint32(buf, m.Version)
+	case Error:
+		buf = appendStr(buf, m.Message)
+	case OK:
+	case DialAuthority:
+		buf = binary.BigEndian.AppendUint32(buf, m.Site)
+	case TargetPopulations:
+		buf = binary.BigEndian.AppendUint32(buf, m.Site)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(m.Populations)))
+		for _, p := range m.Populations {
+			buf = appendStr(buf, p.Species)
+			buf = binary.BigEndian.AppendUint32(buf, p.Min)
+			buf = binary.BigEndian.AppendUint32(buf, p.Max)
+		}
+	case CreatePolicy:
+		buf = appendStr(buf, m.Species)
+		buf = append(buf, byte(m.Action))
+	case DeletePolicy:
+		buf = binary.BigEndian.AppendUint32(buf, m.Policy)
+	case PolicyResult:
+		buf = binary.BigEndian.AppendUint32(buf, m.Policy)
+	case SiteVisit:
+		buf = binary.BigEndian.AppendUint32(buf, m.Site)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(m.Populations)))
+		for _, p := range m.Populations {
+			buf = appendStr(buf, p.Species)
+			buf = binary.BigEndian.AppendUint32(buf, p.Count)
+		}
+	default:
+		return nil, fmt.Errorf("%w: %T", ErrUnknownType, m)
+	}
+
+	buf = append(buf, 0)
+	if len(buf) > MaxMessageSize {
+		return nil, ErrTooLarge
+	}
+	binary.BigEndian.PutUint32(buf[1:headerSize], uint32(len(buf)))
+	buf[len(buf)-1] = -checksum(buf)
+	return buf, nil
+}
+
+// Unmarshal decodes one complete framed message.
+func Unmarshal(frame []byte) (Message, error) {
+	if len(frame) < headerSize+1 {
+		return nil, ErrTruncated
+	}
+	if length := binary.BigEndian.Uint32(frame[1:headerSize]); int(length) != len(frame) {
+		return nil, ErrBadLength
+	}
+	if checksum(frame) != 0 {
+		return nil, ErrBadChecksum
+	}
+
+	p := parser{buf: frame[headerSize : len(frame)-1]}
+	m := p.message(frame[0])
+	if p.err != nil {
+		return nil, p.err
+	}
+	if len(p.buf) != 0 {
+		// Content shorter than the declared length
+		return nil, ErrBadLength
+	}
+	return m, nil
+}
+
+func checksum(buf []byte) byte {
+	var sum byte
+	for _, b := range buf {
+		sum += b
+	}
+	return sum
+}
+
+func appendStr(buf []byte, s string) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(s)))
+	return append(buf, s...)
+}
+
+// parser consumes message content, recording the first error.
+type parser struct {
+	buf []byte
+	err error
+}
+
+func (p *parser) take(n int) []byte {
+	if p.err != nil {
+		return nil
+	}
+	if n > len(p.buf) {
+		// Content runs past the declared length
+		p.err = ErrBadLength
+		return nil
+	}
+	b := p.buf[:n]
+	p.buf = p.buf[n:]
+	return b
+}
+
+func (p *parser) u8() byte {
+	b := p.take(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (p *parser) u32() uint32 {
+	b := p.take(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (p *parser) str() string {
+	n := p.u32()
+	if uint64(n) > uint64(len(p.buf)) {
+		p.take(len(p.buf) + 1)
+		return ""
+	}
+	return string(p.take(int(n)))
+}
+
+// count reads an array length, rejecting counts that could not possibly fit
+// in the remaining content given each element's minimum size.
+func (p *parser) count(minElem int) int {
+	n := p.u32()
+	if uint64(n)*uint64(minElem) > uint64(len(p.buf)) {
+		p.take(len(p.buf) + 1)
+		return 0
+	}
+	return int(n)
+}
+
+func (p *parser) message(t byte) Message {
+	switch t {
+	case TypeHello:
+		return Hello{Protocol: p.str(), Version: p.u32()}
+	case TypeError:
+		return Error{Message: p.str()}
+	case TypeOK:
+		return OK{}
+	case TypeDialAuthority:
+		return DialAuthority{Site: p.u32()}
+	case TypeTargetPopulations:
+		m := TargetPopulations{Site: p.u32()}
+		n := p.count(12)
+		m.Populations = make([]PopulationTarget, 0, n)
+		for range n {
+			m.Populations = append(m.Populations, PopulationTarget{Species: p.str(), Min: p.u32(), Max: p.u32()})
+		}
+		return m
+	case TypeCreatePolicy:
+		m := CreatePolicy{Species: p.str(), Action: Action(p.u8())}
+		if p.err == nil && m.Action != Cull && m.Action != Conserve {
+			p.err = fmt.Errorf("%w: 0x%02x", ErrUnknownAction, byte(m.Action))
+		}
+		return m
+	case TypeDeletePolicy:
+		return DeletePolicy{Policy: p.u32()}
+	case TypePolicyResult:
+		return PolicyResult{Policy: p.u32()}
+	case TypeSiteVisit:
+		m := SiteVisit{Site: p.u32()}
+		n := p.count(8)
+		m.Populations = make([]PopulationCount, 0, n)
+		for range n {
+			m.Populations = append(m.Populations, PopulationCount{Species: p.str(), Count: p.u32()})
+		}
+		return m
+	default:
+		p.err = fmt.Errorf("%w: 0x%02x", ErrUnknownType, t)
+		return nil
+	}
+}
+
+// Encoder writes messages to a stream.
+type Encoder struct {
+	w io.Writer
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes m with a single Write call.
+func (e *Encoder) Encode(m Message) error {
+	buf, err := Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(buf)
+	return err
+}
+
+// Decoder reads framed messages from a stream.
+type Decoder struct {
+	r *bufio.Reader
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Decoder{r: br}
+}
+
+// Decode reads the next message. It returns io.EOF if the stream ends cleanly
+// between messages and ErrTruncated if it ends part way through one. The
+// declared length is checked against MaxMessageSize before any content is
+// read.
+func (d *Decoder) Decode() (Message, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(d.r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, ErrTruncated
+		}
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[1:])
+	if length < headerSize+1 {
+		return nil, ErrBadLength
+	}
+	if length > MaxMessageSize {
+		return nil, ErrTooLarge
+	}
+
+	frame := make([]byte, length)
+	copy(frame, header)
+	if _, err := io.ReadFull(d.r, frame[headerSize:]); err != nil {
+		return nil, ErrTruncated
+	}
+	return Unmarshal(frame)
+}
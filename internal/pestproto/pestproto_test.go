@@ -0,0 +1,178 @@
+package pestproto
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatalf("bad hex %q: %v", s, err)
+	}
+	return b
+}
+
+var messageTests = []struct {
+	name string
+	hex  string
+	msg  Message
+}{
+	{
+		name: "hello",
+		hex:  "50 00 00 00 19 00 00 00 0b 70 65 73 74 63 6f 6e 74 72 6f 6c 00 00 00 01 ce",
+		msg:  Hello{Protocol: "pestcontrol", Version: 1},
+	},
+	{
+		name: "error",
+		hex:  "51 00 00 00 0d 00 00 00 03 62 61 64 78",
+		msg:  Error{Message: "bad"},
+	},
+	{
+		name: "ok",
+		hex:  "52 00 00 00 06 a8",
+		msg:  OK{},
+	},
+	{
+		name: "dial authority",
+		hex:  "53 00 00 00 0a 00 00 30 39 3a",
+		msg:  DialAuthority{Site: 12345},
+	},
+	{
+		name: "target populations",
+		hex: "54 00 00 00 2c 00 00 30 39 00 00 00 02 00 00 00 03 64 6f 67 00 00 00 01 00 00 00 03" +
+			"00 00 00 03 72 61 74 00 00 00 00 00 00 00 0a 80",
+		msg: TargetPopulations{Site: 12345, Populations: []PopulationTarget{
+			{Species: "dog", Min: 1, Max: 3},
+			{Species: "rat", Min: 0, Max: 10},
+		}},
+	},
+	{
+		name: "create policy",
+		hex:  "55 00 00 00 0e 00 00 00 03 64 6f 67 a0 c0",
+		msg:  CreatePolicy{Species: "dog", Action: Conserve},
+	},
+	{
+		name: "delete policy",
+		hex:  "56 00 00 00 0a 00 00 00 7b 25",
+		msg:  DeletePolicy{Policy: 123},
+	},
+	{
+		name: "policy result",
+		hex:  "57 00 00 00 0a 00 00 00 7b 24",
+		msg:  PolicyResult{Policy: 123},
+	},
+	{
+		name: "site visit",
+		hex: "58 00 00 00 24 00 00 30 39 00 00 00 02 00 00 00 03 64 6f 67 00 00 00 01" +
+			"00 00 00 03 72 61 74 00 00 00 05 8c",
+		msg: SiteVisit{Site: 12345, Populations: []PopulationCount{
+			{Species: "dog", Count: 1},
+			{Species: "rat", Count: 5},
+		}},
+	},
+}
+
+func TestMarshal(t *testing.T) {
+	for _, tt := range messageTests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Marshal(tt.msg)
+			if err != nil {
+				t.Fatalf("Marshal(%+v) error: %v", tt.msg, err)
+			}
+			if want := mustHex(t, tt.hex); !bytes.Equal(got, want) {
+				t.Errorf("Marshal(%+v) = % x, want % x", tt.msg, got, want)
+			}
+		})
+	}
+}
+
+func TestDecodeStream(t *testing.T) {
+	var stream []byte
+	for _, tt := range messageTests {
+		stream = append(stream, mustHex(t, tt.hex)...)
+	}
+
+	dec := NewDecoder(bytes.NewReader(stream))
+	for _, tt := range messageTests {
+		got, err := dec.Decode()
+		if err != nil {
+			t.Fatalf("Decode for %s error: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(got, tt.msg) {
+			t.Errorf("Decode = %+v, want %+v", got, tt.msg)
+		}
+	}
+	if _, err := dec.Decode(); err != io.EOF {
+		t.Errorf("Decode at end of stream = %v, want io.EOF", err)
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		hex  string
+		err  error
+	}{
+		{
+			name: "bad checksum",
+			hex:  "52 00 00 00 06 a9",
+			err:  ErrBadChecksum,
+		},
+		{
+			name: "content shorter than length",
+			hex:  "53 00 00 00 0b 00 00 30 39 00 39",
+			err:  ErrBadLength,
+		},
+		{
+			name: "string runs past length",
+			hex:  "51 00 00 00 0d 00 00 00 04 62 61 64 77",
+			err:  ErrBadLength,
+		},
+		{
+			name: "array count runs past length",
+			hex:  "58 00 00 00 0e 00 00 30 39 00 00 00 02 2f",
+			err:  ErrBadLength,
+		},
+		{
+			name: "length below minimum",
+			hex:  "52 00 00 00 05",
+			err:  ErrBadLength,
+		},
+		{
+			name: "length too large",
+			hex:  "52 7f ff ff ff",
+			err:  ErrTooLarge,
+		},
+		{
+			name: "unknown type",
+			hex:  "59 00 00 00 06 a1",
+			err:  ErrUnknownType,
+		},
+		{
+			name: "unknown action",
+			hex:  "55 00 00 00 0e 00 00 00 03 64 6f 67 a1 bf",
+			err:  ErrUnknownAction,
+		},
+		{
+			name: "truncated",
+			hex:  "50 00 00 00 19 00 00 00 0b 70 65",
+			err:  ErrTruncated,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewDecoder(bytes.NewReader(mustHex(t, tt.hex))).Decode()
+			if !errors.Is(err, tt.err) {
+				t.Errorf("Decode error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,204 @@
+// Package recordlog implements an append-only file of checksummed records, for
+// write-ahead logs that must survive a crash part way through an append.
+//
+// Each record is framed as a u32 payload length and a u32 CRC-32 of the
+// payload, both big-endian, followed by the payload. When a log is opened its
+// records are replayed, and a record torn by a crash part way through the last
+// append is truncated away so appends carry on from the last good one. A bad
+// record anywhere else is corruption, and fails the open rather than losing
+// the records after it.
+//
+// A Log is not safe for concurrent use.
+package recordlog
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const headerSize = 8
+
+// MaxRecordSize guards against a corrupt length field making us allocate a
+// huge buffer during recovery.
+const MaxRecordSize = 64 << 20
+
+// ErrCorrupt is returned for a log holding a bad record that isn't just the
+// torn tail of the last append.
+var ErrCorrupt = errors.New("corrupt record")
+
+// Log is an append-only file of checksummed records.
+type Log struct {
+	name string
+	f    *os.File
+	size int64 // offset just past the last complete record
+}
+
+// Open opens the log at path, creating it if needed, and passes each record
+// to fn in order. A record at the end of the file that was cut short is
+// truncated away. Any other bad record, or one fn rejects, fails with
+// ErrCorrupt and leaves the file as it was.
+func Open(path string, fn func(payload []byte) error) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", filepath.Base(path), err)
+	}
+
+	l := &Log{name: filepath.Base(path), f: f}
+	good, torn, err := scan(f, l.name, fn)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if torn {
+		log.Printf("%s: torn record at offset %d", l.name, good)
+	}
+	l.size = good
+	if err := l.rewind(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Replay passes each record in the complete log at path to fn in order,
+// without opening it for appends. Even a torn record at its end fails with
+// ErrCorrupt, since a log that was closed after its last append has none.
+func Replay(path string, fn func(payload []byte) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", filepath.Base(path), err)
+	}
+	defer f.Close()
+
+	good, torn, err := scan(f, filepath.Base(path), fn)
+	if err == nil && torn {
+		err = fmt.Errorf("%s: %w: torn record at offset %d", filepath.Base(path), ErrCorrupt, good)
+	}
+	return err
+}
+
+// scan passes each record in f to fn and returns the offset just past the
+// last good one. A record cut short by the end of the file, or the last one
+// with a bad checksum since its payload may not all have reached the disk,
+// ends the scan and is reported as torn.
+func scan(f *os.File, name string, fn func(payload []byte) error) (good int64, torn bool, err error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, false, err
+	}
+	size := info.Size()
+	reader := bufio.NewReader(f)
+
+	header := make([]byte, headerSize)
+	for good < size {
+		if size-good < headerSize {
+			return good, true, nil
+		}
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return good, false, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		length := binary.BigEndian.Uint32(header[0:4])
+		sum := binary.BigEndian.Uint32(header[4:8])
+		if length > MaxRecordSize {
+			// Write never produces one, so this isn't a torn append
+			return good, false, fmt.Errorf("%s: %w: bad length at offset %d", name, ErrCorrupt, good)
+		}
+		end := good + headerSize + int64(length)
+		if end > size {
+			return good, true, nil
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return good, false, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		if crc32.ChecksumIEEE(payload) != sum {
+			if end == size {
+				return good, true, nil
+			}
+			return good, false, fmt.Errorf("%s: %w: checksum mismatch at offset %d", name, ErrCorrupt, good)
+		}
+		if err := fn(payload); err != nil {
+			return good, false, fmt.Errorf("%s: %w: undecodable record at offset %d: %w", name, ErrCorrupt, good, err)
+		}
+		good = end
+	}
+	return good, false, nil
+}
+
+// rewind truncates the log to the end of the last complete record.
+func (l *Log) rewind() error {
+	if err := l.f.Truncate(l.size); err != nil {
+		return fmt.Errorf("failed to truncate %s: %w", l.name, err)
+	}
+	if _, err := l.f.Seek(l.size, io.SeekStart); err != nil {
+		return err
+	}
+	return l.f.Sync()
+}
+
+// Write appends one record holding payload without waiting for it to reach
+// the disk. It survives the process being killed, but a machine crash may
+// lose it until the next Sync.
+func (l *Log) Write(payload []byte) error {
+	if len(payload) > MaxRecordSize {
+		return fmt.Errorf("%s: %d byte record is too large", l.name, len(payload))
+	}
+	record := make([]byte, headerSize, headerSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	record = append(record, payload...)
+
+	if _, err := l.f.Write(record); err != nil {
+		// Don't leave a partial record for later appends to follow
+		l.rewind()
+		return err
+	}
+	l.size += int64(len(record))
+	return nil
+}
+
+// Append writes and fsyncs one record holding payload.
+func (l *Log) Append(payload []byte) error {
+	size := l.size
+	if err := l.Write(payload); err != nil {
+		return err
+	}
+	if err := l.f.Sync(); err != nil {
+		l.size = size
+		l.rewind()
+		return err
+	}
+	return nil
+}
+
+// Sync makes every record written so far durable.
+func (l *Log) Sync() error {
+	return l.f.Sync()
+}
+
+// Size returns the length of the log in bytes.
+func (l *Log) Size() int64 {
+	return l.size
+}
+
+func (l *Log) Close() error {
+	return l.f.Close()
+}
+
+// SyncDir makes a file created or renamed in dir durable.
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,237 @@
+package recordlog
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// replay opens the log at path and returns it with the records it held.
+func replay(t *testing.T, path string) (*Log, []string) {
+	t.Helper()
+
+	var records []string
+	l, err := Open(path, func(payload []byte) error {
+		records = append(records, string(payload))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l, records
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func TestAppendAndReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.log")
+	l, records := replay(t, path)
+	if len(records) != 0 || l.Size() != 0 {
+		t.Fatalf("new log has %d records and size %d, want none", len(records), l.Size())
+	}
+
+	want := []string{"one", "", "three"}
+	for _, record := range want {
+		if err := l.Append([]byte(record)); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+	if err := l.Write([]byte("four")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	want = append(want, "four")
+	size := l.Size()
+	l.Close()
+
+	l, records = replay(t, path)
+	if !slices.Equal(records, want) {
+		t.Errorf("replayed %q, want %q", records, want)
+	}
+	if l.Size() != size || fileSize(t, path) != size {
+		t.Errorf("size %d, file %d bytes, want %d", l.Size(), fileSize(t, path), size)
+	}
+}
+
+func TestTornTailIsTruncated(t *testing.T) {
+	for _, torn := range []struct {
+		name string
+		tail []byte
+	}{
+		{"header", []byte{0, 0, 0}},
+		{"payload", []byte{0, 0, 0, 10, 0, 0, 0, 0, 'a', 'b'}},
+	} {
+		t.Run(torn.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.log")
+			l, _ := replay(t, path)
+			l.Append([]byte("kept"))
+			size := l.Size()
+			l.Close()
+
+			f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Write(torn.tail)
+			f.Close()
+
+			// Replay stops at the torn record, and appends carry on in its place
+			l, records := replay(t, path)
+			if !slices.Equal(records, []string{"kept"}) || l.Size() != size || fileSize(t, path) != size {
+				t.Fatalf("replayed %q to size %d, want just the record before the tear", records, l.Size())
+			}
+			l.Append([]byte("after"))
+			l.Close()
+			if _, records := replay(t, path); !slices.Equal(records, []string{"kept", "after"}) {
+				t.Errorf("replayed %q, want kept and after", records)
+			}
+		})
+	}
+}
+
+func TestWriteRejectsOversizedRecord(t *testing.T) {
+	l, _ := replay(t, filepath.Join(t.TempDir(), "test.log"))
+	if err := l.Write(make([]byte, MaxRecordSize+1)); err == nil {
+		t.Error("Write of an oversized record succeeded")
+	}
+	if l.Size() != 0 {
+		t.Errorf("size %d after failed write, want 0", l.Size())
+	}
+}
+
+// writeLog writes records to a new log at path and returns the offset each
+// starts at.
+func writeLog(t *testing.T, path string, records ...string) []int64 {
+	t.Helper()
+
+	l, _ := replay(t, path)
+	var offsets []int64
+	for _, record := range records {
+		offsets = append(offsets, l.Size())
+		if err := l.Append([]byte(record)); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+	l.Close()
+	return offsets
+}
+
+// flipByte corrupts the byte at offset in the file at path.
+func flipByte(t *testing.T, path string, offset int64) {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[offset] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCorruptionBeforeTheEndFailsOpen(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		corrupt int64 // offset into the second record
+	}{
+		{"length", 0},
+		{"checksum", 4},
+		{"payload", headerSize + 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.log")
+			offsets := writeLog(t, path, "first", "second", "third")
+			flipByte(t, path, offsets[1]+tt.corrupt)
+			size := fileSize(t, path)
+
+			if _, err := Open(path, func([]byte) error { return nil }); !errors.Is(err, ErrCorrupt) {
+				t.Errorf("Open = %v, want %v", err, ErrCorrupt)
+			}
+			if err := Replay(path, func([]byte) error { return nil }); !errors.Is(err, ErrCorrupt) {
+				t.Errorf("Replay = %v, want %v", err, ErrCorrupt)
+			}
+			// The records after it are still there to be recovered by hand
+			if fileSize(t, path) != size {
+				t.Errorf("file truncated to %d bytes, want %d left alone", fileSize(t, path), size)
+			}
+		})
+	}
+}
+
+func TestRejectedRecordFailsOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.log")
+	writeLog(t, path, "good", "bad")
+	size := fileSize(t, path)
+
+	_, err := Open(path, func(payload []byte) error {
+		if string(payload) == "bad" {
+			return errors.New("bad record")
+		}
+		return nil
+	})
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Open = %v, want %v", err, ErrCorrupt)
+	}
+	if fileSize(t, path) != size {
+		t.Errorf("file truncated to %d bytes, want %d left alone", fileSize(t, path), size)
+	}
+}
+
+func TestBadChecksumAtTheEndIsTorn(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.log")
+	offsets := writeLog(t, path, "kept", "torn")
+	flipByte(t, path, offsets[1]+headerSize)
+
+	if _, records := replay(t, path); !slices.Equal(records, []string{"kept"}) || fileSize(t, path) != offsets[1] {
+		t.Errorf("replayed %q to %d bytes, want just the first record", records, fileSize(t, path))
+	}
+}
+
+func TestReplayRefusesTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.log")
+	writeLog(t, path, "first", "second")
+	size := fileSize(t, path)
+	if err := os.Truncate(path, size-1); err != nil {
+		t.Fatal(err)
+	}
+
+	var records []string
+	err := Replay(path, func(payload []byte) error {
+		records = append(records, string(payload))
+		return nil
+	})
+	if !errors.Is(err, ErrCorrupt) || !slices.Equal(records, []string{"first"}) {
+		t.Errorf("Replay = %q, %v, want the first record and %v", records, err, ErrCorrupt)
+	}
+	if fileSize(t, path) != size-1 {
+		t.Errorf("Replay changed the file to %d bytes", fileSize(t, path))
+	}
+}
+
+func TestSyncDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := SyncDir(dir); err != nil {
+		t.Errorf("SyncDir(%s) = %v", dir, err)
+	}
+	if err := SyncDir(filepath.Join(dir, "missing")); err == nil {
+		t.Error("SyncDir of a missing directory succeeded")
+	}
+}
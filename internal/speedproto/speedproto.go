@@ -0,0 +1,334 @@
+// Package speedproto implements the binary wire format of the speed-daemon
+// protocol.
+//
+// All integers are unsigned and big-endian:
+//
+//	Type | Hex data    | Value
+//	-------------------------------
+//	u8   |          20 |         32
+//	u16  |       12 45 |       4677
+//	u32  | a6 a9 b5 67 | 2796139879
+//
+// A str is a u8 length followed by that many bytes of ASCII:
+//
+//	Type | Hex data                   | Value
+//	----------------------------------------------
+//	str  | 00                         | ""
+//	str  | 03 66 6f 6f                | "foo"
+//	str  | 08 45 6C 62 65 72 65 74 68 | "Elbereth"
+//
+// Every message starts with a u8 type tag followed by its fields in order.
+package speedproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Message type tags
+const (
+	TypeError         byte = 0x10
+	TypePlate         byte = 0x20
+	TypeTicket        byte = 0x21
+	TypeWantHeartbeat byte = 0x40
+	TypeHeartbeat     byte = 0x41
+	TypeIAmCamera     byte = 0x80
+	TypeIAmDispatcher byte = 0x81
+)
+
+// MaxStringLen is the longest string a u8 length prefix can describe.
+const MaxStringLen = 255
+
+var (
+	ErrTruncated     = errors.New("truncated message")
+	ErrStringTooLong = errors.New("string longer than 255 bytes")
+	ErrTooManyRoads  = errors.New("more than 255 roads")
+	ErrUnknownType   = errors.New("unknown message type")
+)
+
+// Message is implemented by every message type.
+type Message interface {
+	Type() byte
+}
+
+// Error (0x10, Server->Client)
+type Error struct {
+	Msg string
+}
+
+// Plate (0x20, Client->Server)
+type Plate struct {
+	Plate     string
+	Timestamp uint32
+}
+
+// Ticket (0x21, Server->Client). Speed is 100x miles per hour.
+type Ticket struct {
+	Plate      string
+	Road       uint16
+	Mile1      uint16
+	Timestamp1 uint32
+	Mile2      uint16
+	Timestamp2 uint32
+	Speed      uint16
+}
+
+// WantHeartbeat (0x40, Client->Server). Interval is in deciseconds.
+type WantHeartbeat struct {
+	Interval uint32
+}
+
+// Heartbeat (0x41, Server->Client)
+type Heartbeat struct{}
+
+// IAmCamera (0x80, Client->Server)
+type IAmCamera struct {
+	Road  uint16
+	Mile  uint16
+	Limit uint16
+}
+
+// IAmDispatcher (0x81, Client->Server)
+type IAmDispatcher struct {
+	Roads []uint16
+}
+
+func (Error) Type() byte         { return TypeError }
+func (Plate) Type() byte         { return TypePlate }
+func (Ticket) Type() byte        { return TypeTicket }
+func (WantHeartbeat) Type() byte { return TypeWantHeartbeat }
+func (Heartbeat) Type() byte     { return TypeHeartbeat }
+func (IAmCamera) Type() byte     { return TypeIAmCamera }
+func (IAmDispatcher) Type() byte { return TypeIAmDispatcher }
+
+// Marshal returns the wire encoding of m.
+func Marshal(m Message) ([]byte, error) {
+	buf := []byte{m.Type()}
+	var err error
+
+	switch m := m.(type) {
+	case Error:
+		buf, err = appendStr(buf, m.Msg)
+	case Plate:
+		buf, err = appendStr(buf, m.Plate)
+		buf = binary.BigEndian.AppendUint32(buf, m.Timestamp)
+	case Ticket:
+		buf, err = appendStr(buf, m.Plate)
+		buf = binary.BigEndian.AppendUint16(buf, m.Road)
+		buf = binary.BigEndian.AppendUint16(buf, m.Mile1)
+		buf = binary.BigEndian.AppendUint32(buf, m.Timestamp1)
+		buf = binary.BigEndian.AppendUint16(buf, m.Mile2)
+		buf = binary.BigEndian.AppendUint32(buf, m.Timestamp2)
+		buf = binary.BigEndian.AppendUint16(buf, m.Speed)
+	case WantHeartbeat:
+		buf = binary.BigEndian.AppendUint32(buf, m.Interval)
+	case Heartbeat:
+	case IAmCamera:
+		buf = binary.BigEndian.AppendUint16(buf, m.Road)
+		buf = binary.BigEndian.AppendUint16(buf, m.Mile)
+		buf = binary.BigEndian.AppendUint16(buf, m.Limit)
+	case IAmDispatcher:
+		if len(m.Roads) > 255 {
+			return nil, ErrTooManyRoads
+		}
+		buf = append(buf, byte(len(m.Roads)))
+		for _, road := range m.Roads {
+			buf = binary.BigEndian.AppendUint16(buf, road)
+		}
+	default:
+		return nil, fmt.Errorf("%w: %T", ErrUnknownType, m)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// Unmarshal decodes exactly one message from data.
+func Unmarshal(data []byte) (Message, error) {
+	r := bytes.NewReader(data)
+	m, err := NewDecoder(r).Decode()
+	if err == io.EOF {
+		return nil, ErrTruncated
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r.Len() > 0 {
+		return nil, fmt.Errorf("%d trailing bytes after message", r.Len())
+	}
+	return m, nil
+}
+
+func appendStr(buf []byte, s string) ([]byte, error) {
+	if len(s) > MaxStringLen {
+		return nil, ErrStringTooLong
+	}
+	buf = append(buf, byte(len(s)))
+	return append(buf, s...), nil
+}
+
+// Encoder writes messages to a stream.
+type Encoder struct {
+	w io.Writer
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes m with a single Write call.
+func (e *Encoder) Encode(m Message) error {
+	buf, err := Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(buf)
+	return err
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// Decoder reads messages from a stream. If r does not implement
+// io.ByteReader it is wrapped in a bufio.Reader, so the Decoder may read
+// past the last message it returns.
+type Decoder struct {
+	r byteReader
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	br, ok := r.(byteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Decoder{r: br}
+}
+
+// Decode reads the next message. It returns io.EOF if the stream ends cleanly
+// between messages and ErrTruncated if it ends part way through one. An
+// unknown type tag yields an error wrapping ErrUnknownType.
+func (d *Decoder) Decode() (Message, error) {
+	t, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := d.decodeBody(t)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, fmt.Errorf("%w: type 0x%02x", ErrTruncated, t)
+	}
+	return m, err
+}
+
+func (d *Decoder) decodeBody(t byte) (Message, error) {
+	var err error
+
+	switch t {
+	case TypeError:
+		var m Error
+		m.Msg, err = d.str()
+		return m, err
+
+	case TypePlate:
+		var m Plate
+		if m.Plate, err = d.str(); err != nil {
+			return nil, err
+		}
+		m.Timestamp, err = d.u32()
+		return m, err
+
+	case TypeTicket:
+		var m Ticket
+		if m.Plate, err = d.str(); err != nil {
+			return nil, err
+		}
+		if m.Road, err = d.u16(); err != nil {
+			return nil, err
+		}
+		if m.Mile1, err = d.u16(); err != nil {
+			return nil, err
+		}
+		if m.Timestamp1, err = d.u32(); err != nil {
+			return nil, err
+		}
+		if m.Mile2, err = d.u16(); err != nil {
+			return nil, err
+		}
+		if m.Timestamp2, err = d.u32(); err != nil {
+			return nil, err
+		}
+		m.Speed, err = d.u16()
+		return m, err
+
+	case TypeWantHeartbeat:
+		var m WantHeartbeat
+		m.Interval, err = d.u32()
+		return m, err
+
+	case TypeHeartbeat:
+		return Heartbeat{}, nil
+
+	case TypeIAmCamera:
+		var m IAmCamera
+		if m.Road, err = d.u16(); err != nil {
+			return nil, err
+		}
+		if m.Mile, err = d.u16(); err != nil {
+			return nil, err
+		}
+		m.Limit, err = d.u16()
+		return m, err
+
+	case TypeIAmDispatcher:
+		n, err := d.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		m := IAmDispatcher{Roads: make([]uint16, n)}
+		for i := range m.Roads {
+			if m.Roads[i], err = d.u16(); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+
+	default:
+		return nil, fmt.Errorf("%w: 0x%02x", ErrUnknownType, t)
+	}
+}
+
+func (d *Decoder) u16() (uint16, error) {
+	var buf [2]byte
+	if _, err := io.ReadFull(d.r, buf[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(buf[:]), nil
+}
+
+func (d *Decoder) u32() (uint32, error) {
+	var buf [4]byte
+	if _, err := io.ReadFull(d.r, buf[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(buf[:]), nil
+}
+
+func (d *Decoder) str() (string, error) {
+	n, err := d.r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(d.r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
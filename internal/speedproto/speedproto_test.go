@@ -0,0 +1,230 @@
+package speedproto
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatalf("bad hex %q: %v", s, err)
+	}
+	return b
+}
+
+var messageTests = []struct {
+	name string
+	hex  string
+	msg  Message
+}{
+	{
+		name: "error bad",
+		hex:  "10 03 62 61 64",
+		msg:  Error{Msg: "bad"},
+	},
+	{
+		name: "error illegal msg",
+		hex:  "10 0b 69 6c 6c 65 67 61 6c 20 6d 73 67",
+		msg:  Error{Msg: "illegal msg"},
+	},
+	{
+		name: "error empty",
+		hex:  "10 00",
+		msg:  Error{Msg: ""},
+	},
+	{
+		name: "plate UN1X",
+		hex:  "20 04 55 4e 31 58 00 00 03 e8",
+		msg:  Plate{Plate: "UN1X", Timestamp: 1000},
+	},
+	{
+		name: "plate RE05BKG",
+		hex:  "20 07 52 45 30 35 42 4b 47 00 01 e2 40",
+		msg:  Plate{Plate: "RE05BKG", Timestamp: 123456},
+	},
+	{
+		name: "ticket UN1X",
+		hex:  "21 04 55 4e 31 58 00 42 00 64 00 01 e2 40 00 6e 00 01 e3 a8 27 10",
+		msg: Ticket{
+			Plate: "UN1X", Road: 66,
+			Mile1: 100, Timestamp1: 123456,
+			Mile2: 110, Timestamp2: 123816,
+			Speed: 10000,
+		},
+	},
+	{
+		name: "ticket RE05BKG",
+		hex:  "21 07 52 45 30 35 42 4b 47 01 70 04 d2 00 0f 42 40 04 d3 00 0f 42 7c 17 70",
+		msg: Ticket{
+			Plate: "RE05BKG", Road: 368,
+			Mile1: 1234, Timestamp1: 1000000,
+			Mile2: 1235, Timestamp2: 1000060,
+			Speed: 6000,
+		},
+	},
+	{
+		name: "want heartbeat 10",
+		hex:  "40 00 00 00 0a",
+		msg:  WantHeartbeat{Interval: 10},
+	},
+	{
+		name: "want heartbeat 1243",
+		hex:  "40 00 00 04 db",
+		msg:  WantHeartbeat{Interval: 1243},
+	},
+	{
+		name: "heartbeat",
+		hex:  "41",
+		msg:  Heartbeat{},
+	},
+	{
+		name: "camera road 66",
+		hex:  "80 00 42 00 64 00 3c",
+		msg:  IAmCamera{Road: 66, Mile: 100, Limit: 60},
+	},
+	{
+		name: "camera road 368",
+		hex:  "80 01 70 04 d2 00 28",
+		msg:  IAmCamera{Road: 368, Mile: 1234, Limit: 40},
+	},
+	{
+		name: "dispatcher one road",
+		hex:  "81 01 00 42",
+		msg:  IAmDispatcher{Roads: []uint16{66}},
+	},
+	{
+		name: "dispatcher three roads",
+		hex:  "81 03 00 42 01 70 13 88",
+		msg:  IAmDispatcher{Roads: []uint16{66, 368, 5000}},
+	},
+	{
+		name: "dispatcher no roads",
+		hex:  "81 00",
+		msg:  IAmDispatcher{Roads: []uint16{}},
+	},
+}
+
+func TestMarshal(t *testing.T) {
+	for _, tt := range messageTests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Marshal(tt.msg)
+			if err != nil {
+				t.Fatalf("Marshal(%+v) error: %v", tt.msg, err)
+			}
+			want := mustHex(t, tt.hex)
+			if !bytes.Equal(got, want) {
+				t.Errorf("Marshal(%+v) = % x, want % x", tt.msg, got, want)
+			}
+		})
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	for _, tt := range messageTests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Unmarshal(mustHex(t, tt.hex))
+			if err != nil {
+				t.Fatalf("Unmarshal(%s) error: %v", tt.hex, err)
+			}
+			if !reflect.DeepEqual(got, tt.msg) {
+				t.Errorf("Unmarshal(%s) = %+v, want %+v", tt.hex, got, tt.msg)
+			}
+		})
+	}
+}
+
+func TestRoundTripStream(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	for _, tt := range messageTests {
+		if err := enc.Encode(tt.msg); err != nil {
+			t.Fatalf("Encode(%+v) error: %v", tt.msg, err)
+		}
+	}
+
+	dec := NewDecoder(&buf)
+	for _, tt := range messageTests {
+		got, err := dec.Decode()
+		if err != nil {
+			t.Fatalf("Decode for %s error: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(got, tt.msg) {
+			t.Errorf("Decode = %+v, want %+v", got, tt.msg)
+		}
+	}
+	if _, err := dec.Decode(); err != io.EOF {
+		t.Errorf("Decode at end of stream = %v, want io.EOF", err)
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	for _, tt := range messageTests {
+		full := mustHex(t, tt.hex)
+		// Every proper prefix that includes the type byte is a truncated frame
+		for n := 1; n < len(full); n++ {
+			_, err := Unmarshal(full[:n])
+			if !errors.Is(err, ErrTruncated) {
+				t.Errorf("%s: Unmarshal(% x) error = %v, want ErrTruncated", tt.name, full[:n], err)
+			}
+		}
+	}
+}
+
+func TestUnmarshalEmpty(t *testing.T) {
+	if _, err := Unmarshal(nil); !errors.Is(err, ErrTruncated) {
+		t.Errorf("Unmarshal(nil) error = %v, want ErrTruncated", err)
+	}
+}
+
+func TestUnmarshalTrailingBytes(t *testing.T) {
+	if _, err := Unmarshal(mustHex(t, "41 41")); err == nil {
+		t.Error("Unmarshal with trailing bytes succeeded, want error")
+	}
+}
+
+func TestDecodeUnknownType(t *testing.T) {
+	tests := []string{"00", "11", "42", "ff"}
+	for _, h := range tests {
+		_, err := Unmarshal(mustHex(t, h))
+		if !errors.Is(err, ErrUnknownType) {
+			t.Errorf("Unmarshal(%s) error = %v, want ErrUnknownType", h, err)
+		}
+	}
+}
+
+func TestMarshalStringTooLong(t *testing.T) {
+	long := strings.Repeat("x", MaxStringLen+1)
+	tests := []struct {
+		name string
+		msg  Message
+	}{
+		{"error", Error{Msg: long}},
+		{"plate", Plate{Plate: long}},
+		{"ticket", Ticket{Plate: long}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Marshal(tt.msg); !errors.Is(err, ErrStringTooLong) {
+				t.Errorf("Marshal error = %v, want ErrStringTooLong", err)
+			}
+		})
+	}
+
+	if _, err := Marshal(Error{Msg: long[:MaxStringLen]}); err != nil {
+		t.Errorf("Marshal of %d-byte string error: %v", MaxStringLen, err)
+	}
+}
+
+func TestMarshalTooManyRoads(t *testing.T) {
+	m := IAmDispatcher{Roads: make([]uint16, 256)}
+	if _, err := Marshal(m); !errors.Is(err, ErrTooManyRoads) {
+		t.Errorf("Marshal error = %v, want ErrTooManyRoads", err)
+	}
+}